@@ -0,0 +1,279 @@
+package rsocket
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AdmissionPolicy is what a TCPListener does when accepting a connection
+// would exceed its admission budget.
+type AdmissionPolicy int
+
+const (
+	// AdmissionQueue makes Accept wait for a free connection slot and for
+	// the rate limit before it accepts, leaving clients in the listen
+	// backlog.
+	AdmissionQueue AdmissionPolicy = iota
+	// AdmissionReject accepts and closes connections over the budget at
+	// once, and Accept waits for the next one.
+	AdmissionReject
+)
+
+// String returns the name of the policy.
+func (p AdmissionPolicy) String() string {
+	switch p {
+	case AdmissionQueue:
+		return "queue"
+	case AdmissionReject:
+		return "reject"
+	default:
+		return "unknown"
+	}
+}
+
+// AdmissionConfig is the admission budget of a TCPListener, see WithAdmission.
+// Zero values mean no limit.
+type AdmissionConfig struct {
+	// MaxConns is the number of accepted connections open at once.
+	MaxConns int
+	// Rate is the number of connections accepted per second, Burst of them
+	// at once.
+	Rate  float64
+	Burst int // 0 means 1
+	// MaxConnsPerIP is the number of accepted connections open at once
+	// from a single source IP. The source is only known once accepted, so
+	// connections over it are rejected whatever the Policy.
+	MaxConnsPerIP int
+	Policy        AdmissionPolicy
+}
+
+// AdmissionStats are the counters of the admission control of a TCPListener.
+type AdmissionStats struct {
+	Admitted      uint64 // connections returned by Accept
+	Queued        uint64 // times Accept waited for the budget
+	RejectedConns uint64 // rejected over MaxConns
+	RejectedRate  uint64 // rejected over Rate
+	RejectedPerIP uint64 // rejected over MaxConnsPerIP
+}
+
+// Rejected returns the number of rejected connections.
+func (s AdmissionStats) Rejected() uint64 {
+	return s.RejectedConns + s.RejectedRate + s.RejectedPerIP
+}
+
+// WithAdmission limits the connections a TCPListener accepts, since every
+// accepted rsocket pins registered buffers. It is ignored by dialers.
+func WithAdmission(cfg AdmissionConfig) OptionSocketFn {
+	return func(fd int) error {
+		if cfg.MaxConns < 0 || cfg.Rate < 0 || cfg.Burst < 0 || cfg.MaxConnsPerIP < 0 {
+			return errors.New("rsocket: admission: negative limit")
+		}
+		if cfg.Policy != AdmissionQueue && cfg.Policy != AdmissionReject {
+			return fmt.Errorf("rsocket: admission: invalid policy %d", cfg.Policy)
+		}
+		if s := lookupSetup(fd); s != nil {
+			s.admission = &cfg
+		}
+		return nil
+	}
+}
+
+// admission is the admission control state of a TCPListener.
+type admission struct {
+	cfg       AdmissionConfig
+	slots     chan struct{} // holds a value per open connection, nil without MaxConns
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	perIP  map[string]int
+
+	admitted      atomic.Uint64
+	queued        atomic.Uint64
+	rejectedConns atomic.Uint64
+	rejectedRate  atomic.Uint64
+	rejectedPerIP atomic.Uint64
+}
+
+func newAdmission(cfg AdmissionConfig) *admission {
+	if cfg.Burst == 0 {
+		cfg.Burst = 1
+	}
+	a := &admission{
+		cfg:    cfg,
+		closed: make(chan struct{}),
+		tokens: float64(cfg.Burst),
+		last:   time.Now(),
+	}
+	if cfg.MaxConns > 0 {
+		a.slots = make(chan struct{}, cfg.MaxConns)
+	}
+	if cfg.MaxConnsPerIP > 0 {
+		a.perIP = make(map[string]int)
+	}
+	return a
+}
+
+// wait waits for a connection slot and the rate limit before Accept, with
+// AdmissionQueue. It returns net.ErrClosed if the listener is closed.
+func (a *admission) wait() error {
+	if a == nil || a.cfg.Policy != AdmissionQueue {
+		return nil
+	}
+	if a.slots != nil {
+		select {
+		case a.slots <- struct{}{}:
+		default:
+			a.queued.Add(1)
+			select {
+			case a.slots <- struct{}{}:
+			case <-a.closed:
+				return net.ErrClosed
+			}
+		}
+	}
+	if a.cfg.Rate > 0 {
+		a.mu.Lock()
+		a.refill()
+		a.tokens--
+		delay := time.Duration(-a.tokens / a.cfg.Rate * float64(time.Second))
+		a.mu.Unlock()
+		if delay > 0 {
+			a.queued.Add(1)
+			t := time.NewTimer(delay)
+			defer t.Stop()
+			select {
+			case <-t.C:
+			case <-a.closed:
+				a.releaseSlot()
+				return net.ErrClosed
+			}
+		}
+	}
+	return nil
+}
+
+// cancel gives back what wait took when Accept fails.
+func (a *admission) cancel() {
+	if a == nil || a.cfg.Policy != AdmissionQueue {
+		return
+	}
+	a.releaseSlot()
+	if a.cfg.Rate > 0 {
+		a.mu.Lock()
+		a.tokens = min(a.tokens+1, float64(a.cfg.Burst))
+		a.mu.Unlock()
+	}
+}
+
+// admit decides on a connection accepted from ip. It returns the limit the
+// connection is over, or "" if it is admitted.
+func (a *admission) admit(ip net.IP) string {
+	if a == nil {
+		return ""
+	}
+	queue := a.cfg.Policy == AdmissionQueue
+	if a.slots != nil && !queue {
+		select {
+		case a.slots <- struct{}{}:
+		default:
+			a.rejectedConns.Add(1)
+			return "max_conns"
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key := ip.String()
+	if a.perIP != nil && a.perIP[key] >= a.cfg.MaxConnsPerIP {
+		// the slot goes back, not the rate token of wait: the connection
+		// was accepted and counts against the rate
+		a.releaseSlot()
+		a.rejectedPerIP.Add(1)
+		return "max_conns_per_ip"
+	}
+	if a.cfg.Rate > 0 && !queue {
+		a.refill()
+		if a.tokens < 1 {
+			a.releaseSlot()
+			a.rejectedRate.Add(1)
+			return "rate"
+		}
+		a.tokens--
+	}
+	if a.perIP != nil {
+		a.perIP[key]++
+	}
+	a.admitted.Add(1)
+	return ""
+}
+
+// refill adds the tokens earned since the last call, a.mu held.
+func (a *admission) refill() {
+	now := time.Now()
+	a.tokens = min(a.tokens+now.Sub(a.last).Seconds()*a.cfg.Rate, float64(a.cfg.Burst))
+	a.last = now
+}
+
+func (a *admission) releaseSlot() {
+	if a.slots != nil {
+		<-a.slots
+	}
+}
+
+// release frees the budget of an admitted connection from ip once closed.
+func (a *admission) release(ip net.IP) {
+	if a == nil {
+		return
+	}
+	a.releaseSlot()
+	if a.perIP != nil {
+		key := ip.String()
+		a.mu.Lock()
+		if a.perIP[key]--; a.perIP[key] <= 0 {
+			delete(a.perIP, key)
+		}
+		a.mu.Unlock()
+	}
+}
+
+func (a *admission) close() {
+	if a != nil {
+		a.closeOnce.Do(func() { close(a.closed) })
+	}
+}
+
+func (a *admission) stats() AdmissionStats {
+	if a == nil {
+		return AdmissionStats{}
+	}
+	return AdmissionStats{
+		Admitted:      a.admitted.Load(),
+		Queued:        a.queued.Load(),
+		RejectedConns: a.rejectedConns.Load(),
+		RejectedRate:  a.rejectedRate.Load(),
+		RejectedPerIP: a.rejectedPerIP.Load(),
+	}
+}
+
+// reject closes fd, accepted from remote over the limit named reason.
+func (l *TCPListener) reject(fd int, remote *net.TCPAddr, reason string) {
+	err := Close(fd)
+	if logger := loggerOr(l.logger); debugEnabled(logger) {
+		logDebug(logger, "rsocket: reject", appendErr([]slog.Attr{slog.Int("lfd", l.fd), slog.Int("fd", fd),
+			addrAttr("remote", remote), slog.String("limit", reason)}, err)...)
+	}
+}
+
+// AdmissionStats returns the counters of the admission control of the
+// listener, zero without WithAdmission.
+func (l *TCPListener) AdmissionStats() AdmissionStats {
+	return l.admission.stats()
+}
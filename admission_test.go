@@ -0,0 +1,167 @@
+package rsocket
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+var (
+	testIP1 = net.IPv4(10, 0, 0, 1)
+	testIP2 = net.IPv4(10, 0, 0, 2)
+)
+
+func TestAdmissionQueue(t *testing.T) {
+	a := newAdmission(AdmissionConfig{MaxConns: 1, Policy: AdmissionQueue})
+	if err := a.wait(); err != nil {
+		t.Fatal(err)
+	}
+	if reason := a.admit(testIP1); reason != "" {
+		t.Fatalf("got %q, want the first connection admitted", reason)
+	}
+
+	waited := make(chan error, 1)
+	go func() { waited <- a.wait() }()
+	select {
+	case err := <-waited:
+		t.Fatalf("wait returned %v with no free slot", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	a.release(testIP1)
+	if err := <-waited; err != nil {
+		t.Fatal(err)
+	}
+
+	go func() { waited <- a.wait() }()
+	time.Sleep(10 * time.Millisecond)
+	a.close()
+	if err := <-waited; !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("got %v waiting on a closed listener, want net.ErrClosed", err)
+	}
+	if s := a.stats(); s.Admitted != 1 || s.Queued != 2 || s.Rejected() != 0 {
+		t.Errorf("got %+v", s)
+	}
+}
+
+func TestAdmissionQueuePerIP(t *testing.T) {
+	a := newAdmission(AdmissionConfig{MaxConns: 4, Rate: 0.001, Burst: 2, MaxConnsPerIP: 1, Policy: AdmissionQueue})
+	for _, want := range []string{"", "max_conns_per_ip"} {
+		if err := a.wait(); err != nil {
+			t.Fatal(err)
+		}
+		if reason := a.admit(testIP1); reason != want {
+			t.Fatalf("got %q, want %q", reason, want)
+		}
+	}
+
+	// the rejected connection was accepted: its slot is back, its rate
+	// token is not
+	if n := len(a.slots); n != 1 {
+		t.Errorf("got %d slots taken, want 1", n)
+	}
+	a.mu.Lock()
+	tokens := a.tokens
+	a.mu.Unlock()
+	if tokens >= 0.5 {
+		t.Errorf("got %.3f tokens after two accepts with a burst of 2, want 0", tokens)
+	}
+	if s := a.stats(); s.Admitted != 1 || s.RejectedPerIP != 1 {
+		t.Errorf("got %+v", s)
+	}
+}
+
+func TestAdmissionReject(t *testing.T) {
+	a := newAdmission(AdmissionConfig{MaxConns: 1, Policy: AdmissionReject})
+	if reason := a.admit(testIP1); reason != "" {
+		t.Fatalf("got %q, want the first connection admitted", reason)
+	}
+	if reason := a.admit(testIP2); reason != "max_conns" {
+		t.Fatalf("got %q over MaxConns, want max_conns", reason)
+	}
+	a.release(testIP1)
+	if reason := a.admit(testIP2); reason != "" {
+		t.Fatalf("got %q after a release, want admitted", reason)
+	}
+
+	a = newAdmission(AdmissionConfig{Rate: 0.001, Policy: AdmissionReject})
+	if reason := a.admit(testIP1); reason != "" {
+		t.Fatalf("got %q, want the first connection admitted", reason)
+	}
+	if reason := a.admit(testIP1); reason != "rate" {
+		t.Fatalf("got %q over the rate, want rate", reason)
+	}
+	if s := a.stats(); s.Admitted != 1 || s.RejectedRate != 1 {
+		t.Errorf("got %+v", s)
+	}
+}
+
+func TestAdmissionReleaseOnClose(t *testing.T) {
+	a := newAdmission(AdmissionConfig{MaxConnsPerIP: 1, Policy: AdmissionReject})
+	if reason := a.admit(testIP1); reason != "" {
+		t.Fatalf("got %q, want the first connection admitted", reason)
+	}
+	if reason := a.admit(testIP1); reason != "max_conns_per_ip" {
+		t.Fatalf("got %q, want max_conns_per_ip", reason)
+	}
+
+	// Close releases the source IP whatever closing the socket returns
+	metrics.active.Add(1)
+	c := &TCPConn{fd: -1, admission: a, remoteAddr: &net.TCPAddr{IP: testIP1, Port: 1}}
+	c.Close()
+	c.Close()
+	if n := len(a.perIP); n != 0 {
+		t.Fatalf("got %d source IPs after Close, want 0", n)
+	}
+	if reason := a.admit(testIP1); reason != "" {
+		t.Fatalf("got %q after Close, want admitted", reason)
+	}
+}
+
+func TestListenerAdmissionPerIP(t *testing.T) {
+	ln, addr := testListener(t, WithAdmission(AdmissionConfig{MaxConnsPerIP: 1, Policy: AdmissionReject}))
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	first, err := DialTCP(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	server := <-accepted
+
+	// the second connection from the same IP is accepted and closed
+	second, err := DialTCP(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("got %v reading a rejected connection, want io.EOF", err)
+	}
+
+	server.Close()
+	third, err := DialTCP(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer third.Close()
+	if conn := <-accepted; conn == nil {
+		t.Fatal("accept failed after the first connection was closed")
+	} else {
+		conn.Close()
+	}
+	if s := ln.AdmissionStats(); s.Admitted != 2 || s.RejectedPerIP != 1 {
+		t.Errorf("got %+v", s)
+	}
+}
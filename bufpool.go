@@ -0,0 +1,162 @@
+package rsocket
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// BufferPool pools byte buffers in size classes. Get returns a buffer from
+// the smallest class that fits, Put returns it to its class. Buffers larger
+// than the largest class are allocated and left to the GC.
+//
+// A BufferPool is safe for concurrent use.
+type BufferPool struct {
+	classes []int
+	pools   []sync.Pool
+
+	gets     atomic.Uint64
+	puts     atomic.Uint64
+	allocs   atomic.Uint64
+	oversize atomic.Uint64
+	drops    atomic.Uint64
+}
+
+// BufferPoolStats counts the operations of a BufferPool. Allocs stops growing
+// once the pool holds enough buffers for the steady state.
+type BufferPoolStats struct {
+	Gets     uint64 // buffers handed out
+	Puts     uint64 // buffers returned to a class
+	Allocs   uint64 // buffers allocated because their class was empty
+	Oversize uint64 // buffers allocated because no class was large enough
+	Drops    uint64 // buffers passed to Put that fit no class
+}
+
+// DefaultBufferPool is the pool of connections without their own, and of
+// MsgConn and MuxSession buffers. Its classes are the powers of two from
+// 64B, the default rsocket inline size, to 1MB.
+var DefaultBufferPool = NewBufferPool(BufferSizeClasses(64, 1<<20)...)
+
+// NewBufferPool returns a pool with the given buffer capacities.
+// Non-positive sizes are ignored, without sizes the DefaultBufferPool
+// classes are used.
+func NewBufferPool(sizes ...int) *BufferPool {
+	classes := make([]int, 0, len(sizes))
+	for _, size := range sizes {
+		if size > 0 {
+			classes = append(classes, size)
+		}
+	}
+	if len(classes) == 0 {
+		classes = BufferSizeClasses(64, 1<<20)
+	}
+	slices.Sort(classes)
+	classes = slices.Compact(classes)
+
+	return &BufferPool{
+		classes: classes,
+		pools:   make([]sync.Pool, len(classes)),
+	}
+}
+
+// BufferSizeClasses returns size classes aligned to the transport: the inline
+// size, so that small messages sent inline get exactly fitting buffers, then
+// the powers of two above it up to the receive buffer size, which is the most
+// a single read can return. Use the RDMA_INLINE and SO_RCVBUF values of the
+// connections, e.g. the ones passed to SetRDMAInline and SetRecvBuffer.
+func BufferSizeClasses(inline, rcvbuf int) []int {
+	var classes []int
+	if inline > 0 {
+		classes = append(classes, inline)
+	}
+	size := 64
+	for size <= inline {
+		size <<= 1
+	}
+	for ; size < rcvbuf; size <<= 1 {
+		classes = append(classes, size)
+	}
+	if rcvbuf > 0 {
+		classes = append(classes, rcvbuf)
+	}
+	return classes
+}
+
+// Classes returns the buffer capacities of the pool.
+func (p *BufferPool) Classes() []int {
+	return slices.Clone(p.classes)
+}
+
+// MaxSize returns the capacity of the largest class.
+func (p *BufferPool) MaxSize() int {
+	return p.classes[len(p.classes)-1]
+}
+
+// class returns the index of the smallest class holding n bytes, or -1.
+func (p *BufferPool) class(n int) int {
+	i, _ := slices.BinarySearch(p.classes, n)
+	if i == len(p.classes) {
+		return -1
+	}
+	return i
+}
+
+// Get returns a buffer of length n.
+func (p *BufferPool) Get(n int) []byte {
+	p.gets.Add(1)
+	i := p.class(n)
+	if i < 0 {
+		p.oversize.Add(1)
+		return make([]byte, n)
+	}
+	// buffers are pooled as a pointer to their first byte, which fits in an
+	// interface without the allocation that pooling a slice would need
+	if ptr, ok := p.pools[i].Get().(unsafe.Pointer); ok {
+		return unsafe.Slice((*byte)(ptr), p.classes[i])[:n]
+	}
+	p.allocs.Add(1)
+	return make([]byte, n, p.classes[i])
+}
+
+// Put returns a buffer obtained from Get to the pool. The buffer must not be
+// used afterwards. Buffers whose capacity is not one of the classes are dropped.
+func (p *BufferPool) Put(b []byte) {
+	i := p.class(cap(b))
+	if i < 0 || p.classes[i] != cap(b) {
+		p.drops.Add(1)
+		return
+	}
+	p.puts.Add(1)
+	p.pools[i].Put(unsafe.Pointer(unsafe.SliceData(b[:1])))
+}
+
+// Stats returns the counters of the pool.
+func (p *BufferPool) Stats() BufferPoolStats {
+	return BufferPoolStats{
+		Gets:     p.gets.Load(),
+		Puts:     p.puts.Load(),
+		Allocs:   p.allocs.Load(),
+		Oversize: p.oversize.Load(),
+		Drops:    p.drops.Load(),
+	}
+}
+
+// WithBufferPool makes the dialed connection, or the connections accepted by
+// the listener, use pool for ReadPooled instead of DefaultBufferPool.
+func WithBufferPool(pool *BufferPool) OptionSocketFn {
+	return func(fd int) error {
+		if s := lookupSetup(fd); s != nil {
+			s.pool = pool
+		}
+		return nil
+	}
+}
+
+// bufferPoolOr returns pool, or DefaultBufferPool if pool is nil.
+func bufferPoolOr(pool *BufferPool) *BufferPool {
+	if pool != nil {
+		return pool
+	}
+	return DefaultBufferPool
+}
@@ -0,0 +1,76 @@
+package rsocket
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestBufferSizeClasses(t *testing.T) {
+	tests := []struct {
+		inline, rcvbuf int
+		want           []int
+	}{
+		{64, 1024, []int{64, 128, 256, 512, 1024}},
+		{100, 1000, []int{100, 128, 256, 512, 1000}},
+		{128, 300, []int{128, 256, 300}},
+		{0, 256, []int{64, 128, 256}},
+		{0, 0, nil},
+	}
+	for _, tt := range tests {
+		if got := BufferSizeClasses(tt.inline, tt.rcvbuf); !slices.Equal(got, tt.want) {
+			t.Errorf("BufferSizeClasses(%d, %d) = %v, want %v", tt.inline, tt.rcvbuf, got, tt.want)
+		}
+	}
+}
+
+func TestBufferPoolClasses(t *testing.T) {
+	p := NewBufferPool(1024, 0, 64, -1, 256, 64)
+	if got := p.Classes(); !slices.Equal(got, []int{64, 256, 1024}) {
+		t.Fatalf("got classes %v, want [64 256 1024]", got)
+	}
+	if n := p.MaxSize(); n != 1024 {
+		t.Errorf("got MaxSize %d, want 1024", n)
+	}
+	if got := NewBufferPool().Classes(); !slices.Equal(got, DefaultBufferPool.Classes()) {
+		t.Errorf("got classes %v without sizes, want the default ones", got)
+	}
+
+	// the smallest class that fits
+	for _, tt := range []struct{ n, cap int }{
+		{0, 64}, {1, 64}, {64, 64}, {65, 256}, {256, 256}, {257, 1024}, {1024, 1024}, {1025, 1025},
+	} {
+		b := p.Get(tt.n)
+		if len(b) != tt.n || cap(b) != tt.cap {
+			t.Errorf("Get(%d) returned len %d cap %d, want cap %d", tt.n, len(b), cap(b), tt.cap)
+		}
+		p.Put(b)
+	}
+}
+
+func TestBufferPoolStats(t *testing.T) {
+	p := NewBufferPool(64, 256)
+
+	b := p.Get(100)
+	p.Put(b)
+	// over the largest class
+	p.Put(p.Get(1000))
+	// capacities that are not a class are dropped, whatever their length
+	p.Put(make([]byte, 64, 100))
+	p.Put(make([]byte, 10, 512))
+	p.Put(nil)
+
+	s := p.Stats()
+	if s.Gets != 2 || s.Puts != 1 || s.Oversize != 1 || s.Drops != 4 || s.Allocs != 1 {
+		t.Fatalf("got %+v", s)
+	}
+
+	// the class is refilled by Put, so a Get only allocates when the pool
+	// let the buffer go
+	b = p.Get(200)
+	if len(b) != 200 || cap(b) != 256 {
+		t.Fatalf("got len %d cap %d, want 200 and 256", len(b), cap(b))
+	}
+	if s := p.Stats(); s.Gets != 3 || s.Allocs > 2 {
+		t.Errorf("got %+v", s)
+	}
+}
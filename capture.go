@@ -0,0 +1,518 @@
+package rsocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// pcapng block types and the raw IP link type, see
+// https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-01.html
+const (
+	pcapngSectionHeader   = 0x0A0D0D0A
+	pcapngInterfaceDesc   = 0x00000001
+	pcapngEnhancedPacket  = 0x00000006
+	pcapngByteOrderMagic  = 0x1A2B3C4D
+	pcapngLinkTypeRaw     = 101
+	pcapngOptEnd          = 0
+	pcapngOptIfTsresol    = 9
+	captureMaxSegmentSize = 65535 - 60 // IP and TCP headers must fit the 16-bit IP length
+
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+)
+
+// CaptureConfig configures a Capture.
+type CaptureConfig struct {
+	// Path is the file to write. Rotated files get the suffix .1 for the most
+	// recent one, .2 and so on, like with tcpdump -C.
+	Path string
+	// SnapLen is the number of bytes kept of each packet, headers included.
+	// 0 keeps whole packets.
+	SnapLen int
+	// MaxFileSize rotates the file before it grows beyond MaxFileSize bytes.
+	// 0 never rotates.
+	MaxFileSize int64
+	// MaxFiles is the number of files kept, the current one included. 0 keeps
+	// all of them.
+	MaxFiles int
+}
+
+// Capture writes the payloads of connections to a pcapng file, as packets
+// with synthesized IP and TCP or UDP headers. tcpdump cannot see rsocket
+// traffic since it bypasses the kernel stack; a capture lets Wireshark
+// dissect it anyway. Enable it with WithCapture, TCPConn.SetCapture or
+// UDPConn.SetCapture.
+//
+// Each connection starts with a synthesized handshake and sequence numbers
+// follow the bytes read and written, so that Wireshark reassembles the
+// streams. Timestamps are those of the Read and Write calls.
+type Capture struct {
+	cfg  CaptureConfig
+	mu   sync.Mutex
+	f    *os.File // nil if writing to w
+	w    *bufio.Writer
+	size int64 // bytes written to the current file
+	// headerSize is the size of a file without packets.
+	headerSize int64
+	// files is the number of rotated files on disk.
+	files  int
+	ipID   uint16
+	buf    []byte
+	err    error // first error, stops the capture
+	closed bool
+}
+
+// NewCapture creates the capture file of cfg.
+func NewCapture(cfg CaptureConfig) (*Capture, error) {
+	c := &Capture{cfg: cfg}
+	if err := c.open(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewCaptureWriter returns a capture writing to w, without rotation.
+func NewCaptureWriter(w io.Writer, snapLen int) (*Capture, error) {
+	c := &Capture{cfg: CaptureConfig{SnapLen: snapLen}, w: bufio.NewWriter(w)}
+	if err := c.writeHeader(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close flushes and closes the capture. It returns the first error that
+// occurred while capturing, if any.
+func (c *Capture) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return c.err
+	}
+	c.closed = true
+	c.flush()
+	if c.f != nil {
+		if err := c.f.Close(); err != nil && c.err == nil {
+			c.err = err
+		}
+	}
+	return c.err
+}
+
+// Flush writes buffered packets to the file.
+func (c *Capture) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.flush()
+	}
+	return c.err
+}
+
+func (c *Capture) flush() {
+	if c.err == nil {
+		c.err = c.w.Flush()
+	}
+}
+
+// WriteUDP captures a datagram from src to dst, e.g. one sent or received on
+// an rsocket datagram socket.
+func (c *Capture) WriteUDP(src, dst *net.UDPAddr, payload []byte) {
+	var hdr [8]byte
+	binary.BigEndian.PutUint16(hdr[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(hdr[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint16(hdr[4:], uint16(8+len(payload)))
+	c.writePacket(time.Now(), src.IP, dst.IP, syscall.IPPROTO_UDP, hdr[:], 6, payload)
+}
+
+func (c *Capture) open() error {
+	f, err := os.Create(c.cfg.Path)
+	if err != nil {
+		return err
+	}
+	c.f, c.size = f, 0
+	if c.w == nil {
+		c.w = bufio.NewWriterSize(f, 64<<10)
+	} else {
+		c.w.Reset(f)
+	}
+	err = c.writeHeader()
+	c.headerSize = c.size
+	return err
+}
+
+// rotate moves the current file to .1, shifting older files, and opens a new one.
+func (c *Capture) rotate() error {
+	c.flush()
+	if err := c.f.Close(); err != nil && c.err == nil {
+		c.err = err
+	}
+	if c.err != nil {
+		return c.err
+	}
+
+	keep := c.files + 1
+	if c.cfg.MaxFiles > 0 {
+		keep = min(keep, c.cfg.MaxFiles-1)
+	}
+	name := func(i int) string { return c.cfg.Path + "." + strconv.Itoa(i) }
+	for i := keep - 1; i >= 1; i-- {
+		os.Rename(name(i), name(i+1))
+	}
+	if keep >= 1 {
+		if c.err = os.Rename(c.cfg.Path, name(1)); c.err != nil {
+			return c.err
+		}
+	}
+	c.files = keep
+	if err := c.open(); err != nil && c.err == nil {
+		c.err = err
+	}
+	return c.err
+}
+
+// writeHeader writes the section header and the interface description.
+func (c *Capture) writeHeader() error {
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[4:], 1) // major version
+	binary.LittleEndian.PutUint16(shb[6:], 0) // minor version
+	binary.LittleEndian.PutUint64(shb[8:], ^uint64(0))
+	c.writeBlock(pcapngSectionHeader, shb)
+
+	idb := make([]byte, 8, 20)
+	binary.LittleEndian.PutUint16(idb[0:], pcapngLinkTypeRaw)
+	binary.LittleEndian.PutUint32(idb[4:], uint32(c.cfg.SnapLen))
+	// nanosecond timestamps
+	idb = binary.LittleEndian.AppendUint16(idb, pcapngOptIfTsresol)
+	idb = binary.LittleEndian.AppendUint16(idb, 1)
+	idb = append(idb, 9, 0, 0, 0)
+	idb = binary.LittleEndian.AppendUint32(idb, pcapngOptEnd)
+	c.writeBlock(pcapngInterfaceDesc, idb)
+	if c.err == nil {
+		c.err = c.w.Flush()
+	}
+	return c.err
+}
+
+// writeBlock writes a pcapng block of type typ around body, which must be
+// padded to 32 bits.
+func (c *Capture) writeBlock(typ uint32, body []byte) {
+	if c.err != nil {
+		return
+	}
+	var hdr [8]byte
+	total := uint32(12 + len(body))
+	binary.LittleEndian.PutUint32(hdr[0:], typ)
+	binary.LittleEndian.PutUint32(hdr[4:], total)
+	c.w.Write(hdr[:])
+	c.w.Write(body)
+	_, c.err = c.w.Write(hdr[4:8])
+	c.size += int64(total)
+}
+
+// writePacket writes an IP packet from src to dst carrying the transport
+// header hdr, whose checksum is at csumOff, and payload.
+func (c *Capture) writePacket(t time.Time, src, dst net.IP, proto byte, hdr []byte, csumOff int, payload []byte) {
+	src4, dst4 := src.To4(), dst.To4()
+	v4 := src4 != nil && dst4 != nil
+	if v4 {
+		src, dst = src4, dst4
+	} else {
+		src, dst = src.To16(), dst.To16()
+	}
+	l4len := len(hdr) + len(payload)
+
+	// transport checksum over the pseudo header
+	var sum uint32
+	sum = checksumAdd(sum, src)
+	sum = checksumAdd(sum, dst)
+	sum += uint32(proto) + uint32(l4len)
+	hdr[csumOff], hdr[csumOff+1] = 0, 0
+	sum = checksumAdd(sum, hdr)
+	sum = checksumAdd(sum, payload)
+	csum := checksumFold(sum)
+	if proto == syscall.IPPROTO_UDP && csum == 0 {
+		csum = 0xffff
+	}
+	binary.BigEndian.PutUint16(hdr[csumOff:], csum)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil || c.closed {
+		return
+	}
+
+	b := c.buf[:0]
+	if v4 {
+		c.ipID++
+		b = append(b, 0x45, 0)
+		b = binary.BigEndian.AppendUint16(b, uint16(20+l4len))
+		b = binary.BigEndian.AppendUint16(b, c.ipID)
+		b = append(b, 0x40, 0, 64, proto, 0, 0) // don't fragment, TTL 64
+		b = append(b, src...)
+		b = append(b, dst...)
+		binary.BigEndian.PutUint16(b[10:], checksumFold(checksumAdd(0, b[:20])))
+	} else {
+		b = append(b, 0x60, 0, 0, 0)
+		b = binary.BigEndian.AppendUint16(b, uint16(l4len))
+		b = append(b, proto, 64)
+		b = append(b, src...)
+		b = append(b, dst...)
+	}
+	b = append(b, hdr...)
+	origLen := len(b) + len(payload)
+	capLen := origLen
+	if c.cfg.SnapLen > 0 {
+		capLen = min(capLen, c.cfg.SnapLen)
+	}
+	b = append(b, payload[:max(0, capLen-len(b))]...)
+	b = b[:capLen]
+
+	// enhanced packet block
+	epbLen := 20 + (capLen+3)&^3
+	if c.f != nil && c.cfg.MaxFileSize > 0 && c.size > c.headerSize && c.size+int64(12+epbLen) > c.cfg.MaxFileSize {
+		if c.rotate() != nil {
+			return
+		}
+	}
+	epb := make([]byte, 20, epbLen)
+	ts := uint64(t.UnixNano())
+	binary.LittleEndian.PutUint32(epb[0:], 0) // interface
+	binary.LittleEndian.PutUint32(epb[4:], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(epb[8:], uint32(ts))
+	binary.LittleEndian.PutUint32(epb[12:], uint32(capLen))
+	binary.LittleEndian.PutUint32(epb[16:], uint32(origLen))
+	epb = append(epb, b...)
+	epb = epb[:epbLen]
+	c.writeBlock(pcapngEnhancedPacket, epb)
+	c.buf = b[:0]
+}
+
+func checksumAdd(sum uint32, b []byte) uint32 {
+	for len(b) >= 2 {
+		sum += uint32(b[0])<<8 | uint32(b[1])
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+func checksumFold(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// captureStream tracks the sequence numbers of a captured connection.
+type captureStream struct {
+	capture       *Capture
+	local, remote *net.TCPAddr
+	mu            sync.Mutex
+	sndNxt        uint32 // next sequence number sent by the local end
+	rcvNxt        uint32 // next sequence number sent by the remote end
+	finSent       bool
+	finRcvd       bool
+}
+
+// newCaptureStream starts the capture of a connection between local and
+// remote with a synthesized handshake, initiated by the dialing end.
+func newCaptureStream(capture *Capture, local, remote *net.TCPAddr, dialed bool) *captureStream {
+	s := &captureStream{
+		capture: capture,
+		local:   local,
+		remote:  remote,
+		sndNxt:  rand.Uint32(),
+		rcvNxt:  rand.Uint32(),
+	}
+	if dialed {
+		s.segment(true, tcpFlagSYN, nil)
+		s.segment(false, tcpFlagSYN|tcpFlagACK, nil)
+		s.segment(true, tcpFlagACK, nil)
+	} else {
+		s.segment(false, tcpFlagSYN, nil)
+		s.segment(true, tcpFlagSYN|tcpFlagACK, nil)
+		s.segment(false, tcpFlagACK, nil)
+	}
+	return s
+}
+
+// segment writes a TCP segment, from the local end if out, and advances the
+// sequence number of the sender.
+func (s *captureStream) segment(out bool, flags byte, payload []byte) {
+	src, dst, seq, ack := s.local, s.remote, &s.sndNxt, s.rcvNxt
+	if !out {
+		src, dst, seq, ack = s.remote, s.local, &s.rcvNxt, s.sndNxt
+	}
+	if flags&tcpFlagSYN != 0 && flags&tcpFlagACK == 0 {
+		ack = 0
+	}
+	var hdr [20]byte
+	binary.BigEndian.PutUint16(hdr[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(hdr[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint32(hdr[4:], *seq)
+	binary.BigEndian.PutUint32(hdr[8:], ack)
+	hdr[12] = 5 << 4
+	hdr[13] = flags
+	binary.BigEndian.PutUint16(hdr[14:], 0xffff) // window
+	s.capture.writePacket(time.Now(), src.IP, dst.IP, syscall.IPPROTO_TCP, hdr[:], 16, payload)
+
+	*seq += uint32(len(payload))
+	if flags&(tcpFlagSYN|tcpFlagFIN) != 0 {
+		*seq++
+	}
+}
+
+// data captures p, written by the local end if out or read from the remote.
+func (s *captureStream) data(out bool, p []byte) {
+	if s == nil || len(p) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(p) > 0 {
+		n := min(len(p), captureMaxSegmentSize)
+		s.segment(out, tcpFlagPSH|tcpFlagACK, p[:n])
+		p = p[n:]
+	}
+}
+
+// dataIovecs captures the first n bytes of iovs, written by the local end.
+func (s *captureStream) dataIovecs(iovs []syscall.Iovec, n int) {
+	if s == nil {
+		return
+	}
+	for _, iov := range iovs {
+		if n <= 0 {
+			return
+		}
+		l := min(n, int(iov.Len))
+		s.data(true, unsafe.Slice(iov.Base, l))
+		n -= l
+	}
+}
+
+// fin captures the end of the stream of the local end if out, or of the
+// remote end, once.
+func (s *captureStream) fin(out bool) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	done := &s.finRcvd
+	if out {
+		done = &s.finSent
+	}
+	if !*done {
+		*done = true
+		s.segment(out, tcpFlagFIN|tcpFlagACK, nil)
+	}
+}
+
+// WithCapture captures the payloads of the connection, or of every connection
+// accepted by a listener, to c.
+func WithCapture(c *Capture) OptionSocketFn {
+	return func(fd int) error {
+		if s := lookupSetup(fd); s != nil {
+			s.capture = c
+		}
+		return nil
+	}
+}
+
+// SetCapture starts capturing the payloads of the connection to capture, or
+// stops if capture is nil.
+func (c *TCPConn) SetCapture(capture *Capture) {
+	if capture == nil {
+		c.capture.Store(nil)
+		return
+	}
+	local, remote := c.localAddr, c.remoteAddr
+	if sa, err := GetSockName(c.fd); err == nil {
+		if addr := sockaddrToTCPAddr(sa); addr != nil {
+			local = addr
+		}
+	}
+	if local == nil {
+		local = &net.TCPAddr{IP: net.IPv4zero}
+	}
+	if remote == nil {
+		remote = &net.TCPAddr{IP: net.IPv4zero}
+	}
+	c.capture.Store(newCaptureStream(capture, local, remote, c.listener == nil))
+}
+
+// udpCapture is the capture of a UDPConn.
+type udpCapture struct {
+	capture *Capture
+
+	mu    sync.Mutex
+	local *net.UDPAddr // port 0 until the socket is bound
+}
+
+// datagram captures p, sent to peer by fd if out or received from it.
+func (s *udpCapture) datagram(fd int, out bool, peer syscall.Sockaddr, p []byte) {
+	if s == nil {
+		return
+	}
+	remote := sockaddrToUDPAddr(peer)
+	if remote == nil {
+		remote = &net.UDPAddr{IP: net.IPv4zero}
+	}
+	s.mu.Lock()
+	if s.local.Port == 0 {
+		// a dialed socket is bound by its first send
+		if sa, err := GetSockName(fd); err == nil {
+			if addr := sockaddrToUDPAddr(sa); addr != nil {
+				s.local = addr
+			}
+		}
+	}
+	local := s.local
+	s.mu.Unlock()
+	if out {
+		s.capture.WriteUDP(local, remote, p)
+	} else {
+		s.capture.WriteUDP(remote, local, p)
+	}
+}
+
+// SetCapture starts capturing the datagrams the connection sends and
+// receives to capture, or stops if capture is nil. The local address is the
+// one the socket is bound to, the any address unless bound to an IP.
+func (c *UDPConn) SetCapture(capture *Capture) {
+	if capture == nil {
+		c.capture.Store(nil)
+		return
+	}
+	local := &net.UDPAddr{IP: net.IPv4zero}
+	if sa, err := GetSockName(c.fd); err == nil {
+		if addr := sockaddrToUDPAddr(sa); addr != nil {
+			local = addr
+		}
+	}
+	c.capture.Store(&udpCapture{capture: capture, local: local})
+}
+
+// captureRead captures the bytes p of a read that returned err.
+func (c *TCPConn) captureRead(p []byte, err error) {
+	s := c.capture.Load()
+	s.data(false, p)
+	if err == io.EOF {
+		s.fin(false)
+	}
+}
@@ -0,0 +1,339 @@
+package rsocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+type pcapngBlock struct {
+	typ  uint32
+	body []byte
+}
+
+// readPcapng splits a capture into its blocks, checking their lengths and
+// that the first two are the section header and interface description.
+func readPcapng(t *testing.T, data []byte) []pcapngBlock {
+	t.Helper()
+	var blocks []pcapngBlock
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatalf("got a truncated block of %d bytes", len(data))
+		}
+		typ := binary.LittleEndian.Uint32(data)
+		total := binary.LittleEndian.Uint32(data[4:])
+		if total%4 != 0 || total < 12 || int(total) > len(data) {
+			t.Fatalf("block %#x: got a total length of %d with %d bytes left", typ, total, len(data))
+		}
+		if trailer := binary.LittleEndian.Uint32(data[total-4:]); trailer != total {
+			t.Fatalf("block %#x: got a trailing length of %d, want %d", typ, trailer, total)
+		}
+		blocks = append(blocks, pcapngBlock{typ, data[8 : total-4]})
+		data = data[total:]
+	}
+
+	if len(blocks) < 2 || blocks[0].typ != pcapngSectionHeader || blocks[1].typ != pcapngInterfaceDesc {
+		t.Fatalf("got %d blocks, want a section header and an interface description first", len(blocks))
+	}
+	shb := blocks[0].body
+	if binary.LittleEndian.Uint32(shb) != pcapngByteOrderMagic || binary.LittleEndian.Uint16(shb[4:]) != 1 {
+		t.Fatalf("got section header %x", shb)
+	}
+	idb := blocks[1].body
+	if binary.LittleEndian.Uint16(idb) != pcapngLinkTypeRaw {
+		t.Fatalf("got link type %d, want raw IP", binary.LittleEndian.Uint16(idb))
+	}
+	// if_tsresol of 9, nanoseconds
+	if opt := idb[8:]; binary.LittleEndian.Uint16(opt) != pcapngOptIfTsresol || opt[4] != 9 {
+		t.Fatalf("got interface options %x, want if_tsresol 9", opt)
+	}
+	return blocks
+}
+
+// capturedPacket is an enhanced packet block split into its fields.
+type capturedPacket struct {
+	capLen, origLen int
+	ip              []byte // IP header
+	l4              []byte // transport header and payload
+}
+
+// readPackets returns the packets of a capture, checking the padding of
+// their blocks and the IP header.
+func readPackets(t *testing.T, data []byte) []capturedPacket {
+	t.Helper()
+	var packets []capturedPacket
+	for _, b := range readPcapng(t, data)[2:] {
+		if b.typ != pcapngEnhancedPacket {
+			t.Fatalf("got block type %#x, want enhanced packets", b.typ)
+		}
+		capLen := int(binary.LittleEndian.Uint32(b.body[12:]))
+		origLen := int(binary.LittleEndian.Uint32(b.body[16:]))
+		if len(b.body) != 20+(capLen+3)&^3 {
+			t.Fatalf("got a packet block body of %d bytes for %d captured, want it padded to 32 bits", len(b.body), capLen)
+		}
+		if pad := b.body[20+capLen:]; bytes.Count(pad, []byte{0}) != len(pad) {
+			t.Fatalf("got padding %x, want zeros", pad)
+		}
+
+		pkt := b.body[20 : 20+capLen]
+		p := capturedPacket{capLen: capLen, origLen: origLen}
+		switch pkt[0] >> 4 {
+		case 4:
+			p.ip, p.l4 = pkt[:20], pkt[20:]
+			if checksumFold(checksumAdd(0, p.ip)) != 0 {
+				t.Fatalf("got a bad IPv4 header checksum in %x", p.ip)
+			}
+			if n := int(binary.BigEndian.Uint16(p.ip[2:])); n != origLen {
+				t.Fatalf("got an IPv4 total length of %d, want %d", n, origLen)
+			}
+		case 6:
+			p.ip, p.l4 = pkt[:40], pkt[40:]
+			if n := int(binary.BigEndian.Uint16(p.ip[4:])); n != origLen-40 {
+				t.Fatalf("got an IPv6 payload length of %d, want %d", n, origLen-40)
+			}
+		default:
+			t.Fatalf("got IP version %d", pkt[0]>>4)
+		}
+		packets = append(packets, p)
+	}
+	return packets
+}
+
+// proto returns the transport protocol of p.
+func (p capturedPacket) proto() byte {
+	if len(p.ip) == 20 {
+		return p.ip[9]
+	}
+	return p.ip[6]
+}
+
+// checksumOK verifies the transport checksum of p over its pseudo header.
+func (p capturedPacket) checksumOK() bool {
+	var sum uint32
+	if len(p.ip) == 20 {
+		sum = checksumAdd(sum, p.ip[12:20])
+	} else {
+		sum = checksumAdd(sum, p.ip[8:40])
+	}
+	sum += uint32(p.proto()) + uint32(len(p.l4))
+	return checksumFold(checksumAdd(sum, p.l4)) == 0
+}
+
+func TestCaptureUDP(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		src, dst string
+	}{
+		{"IPv4", "10.0.0.1", "10.0.0.2"},
+		{"IPv6", "2001:db8::1", "2001:db8::2"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			c, err := NewCaptureWriter(&buf, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			src := &net.UDPAddr{IP: net.ParseIP(tt.src), Port: 4791}
+			dst := &net.UDPAddr{IP: net.ParseIP(tt.dst), Port: 53}
+			// odd lengths need padding
+			for _, payload := range []string{"hello", "hi", ""} {
+				c.WriteUDP(src, dst, []byte(payload))
+			}
+			if err := c.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			packets := readPackets(t, buf.Bytes())
+			if len(packets) != 3 {
+				t.Fatalf("got %d packets, want 3", len(packets))
+			}
+			for i, payload := range []string{"hello", "hi", ""} {
+				p := packets[i]
+				if p.proto() != syscall.IPPROTO_UDP || !p.checksumOK() {
+					t.Fatalf("packet %d: got protocol %d, checksum ok %v", i, p.proto(), p.checksumOK())
+				}
+				hdr := p.l4[:8]
+				if binary.BigEndian.Uint16(hdr) != 4791 || binary.BigEndian.Uint16(hdr[2:]) != 53 || int(binary.BigEndian.Uint16(hdr[4:])) != 8+len(payload) {
+					t.Errorf("packet %d: got UDP header %x", i, hdr)
+				}
+				if string(p.l4[8:]) != payload {
+					t.Errorf("packet %d: got payload %q, want %q", i, p.l4[8:], payload)
+				}
+			}
+		})
+	}
+}
+
+func TestCaptureTCP(t *testing.T) {
+	for _, tt := range []struct {
+		name          string
+		local, remote string
+	}{
+		{"IPv4", "10.0.0.1", "10.0.0.2"},
+		{"IPv6", "2001:db8::1", "2001:db8::2"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			c, err := NewCaptureWriter(&buf, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			local := &net.TCPAddr{IP: net.ParseIP(tt.local), Port: 40000}
+			remote := &net.TCPAddr{IP: net.ParseIP(tt.remote), Port: 7471}
+			s := newCaptureStream(c, local, remote, true)
+			s.data(true, []byte("ping"))
+			s.data(false, []byte("pong!"))
+			s.fin(true)
+			s.fin(true)
+			if err := c.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// handshake, data both ways, one FIN
+			want := []struct {
+				out     bool
+				flags   byte
+				payload string
+			}{
+				{true, tcpFlagSYN, ""},
+				{false, tcpFlagSYN | tcpFlagACK, ""},
+				{true, tcpFlagACK, ""},
+				{true, tcpFlagPSH | tcpFlagACK, "ping"},
+				{false, tcpFlagPSH | tcpFlagACK, "pong!"},
+				{true, tcpFlagFIN | tcpFlagACK, ""},
+			}
+			packets := readPackets(t, buf.Bytes())
+			if len(packets) != len(want) {
+				t.Fatalf("got %d packets, want %d", len(packets), len(want))
+			}
+			var isn [2]uint32 // of the local and remote ends
+			for i, w := range want {
+				p := packets[i]
+				if p.proto() != syscall.IPPROTO_TCP || !p.checksumOK() {
+					t.Fatalf("packet %d: got protocol %d, checksum ok %v", i, p.proto(), p.checksumOK())
+				}
+				hdr := p.l4[:20]
+				srcPort, dstPort := 40000, 7471
+				end := 0
+				if !w.out {
+					srcPort, dstPort, end = 7471, 40000, 1
+				}
+				if int(binary.BigEndian.Uint16(hdr)) != srcPort || int(binary.BigEndian.Uint16(hdr[2:])) != dstPort {
+					t.Errorf("packet %d: got ports %x, want %d to %d", i, hdr[:4], srcPort, dstPort)
+				}
+				if hdr[12] != 5<<4 || hdr[13] != w.flags {
+					t.Errorf("packet %d: got data offset %#x flags %#x, want flags %#x", i, hdr[12], hdr[13], w.flags)
+				}
+				if string(p.l4[20:]) != w.payload {
+					t.Errorf("packet %d: got payload %q, want %q", i, p.l4[20:], w.payload)
+				}
+				if i < 2 {
+					isn[end] = binary.BigEndian.Uint32(hdr[4:])
+				}
+			}
+
+			// sequence numbers follow the bytes of each end
+			seq := func(i int) uint32 { return binary.BigEndian.Uint32(packets[i].l4[4:]) }
+			ack := func(i int) uint32 { return binary.BigEndian.Uint32(packets[i].l4[8:]) }
+			if seq(3) != isn[0]+1 || ack(3) != isn[1]+1 {
+				t.Errorf("got seq %d ack %d for ping, want %d and %d", seq(3), ack(3), isn[0]+1, isn[1]+1)
+			}
+			if seq(4) != isn[1]+1 || ack(4) != isn[0]+5 {
+				t.Errorf("got seq %d ack %d for pong, want %d and %d", seq(4), ack(4), isn[1]+1, isn[0]+5)
+			}
+			if seq(5) != isn[0]+5 || ack(5) != isn[1]+6 {
+				t.Errorf("got seq %d ack %d for the FIN, want %d and %d", seq(5), ack(5), isn[0]+5, isn[1]+6)
+			}
+		})
+	}
+}
+
+func TestCaptureSnapLen(t *testing.T) {
+	var buf bytes.Buffer
+	c, err := NewCaptureWriter(&buf, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1}
+	dst := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 2}
+	c.WriteUDP(src, dst, bytes.Repeat([]byte("x"), 100))
+	c.WriteUDP(src, dst, []byte("x"))
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	packets := readPackets(t, buf.Bytes())
+	if p := packets[0]; p.capLen != 30 || p.origLen != 128 || string(p.l4[8:]) != "xx" {
+		t.Errorf("got %d of %d bytes with payload %q, want 30 of 128", p.capLen, p.origLen, p.l4[8:])
+	}
+	if p := packets[1]; p.capLen != 29 || p.origLen != 29 || !p.checksumOK() {
+		t.Errorf("got %d of %d bytes, want the whole 29", p.capLen, p.origLen)
+	}
+	if binary.LittleEndian.Uint32(readPcapng(t, buf.Bytes())[1].body[4:]) != 30 {
+		t.Error("the interface description does not carry the snap length")
+	}
+}
+
+func TestCaptureRotation(t *testing.T) {
+	// the header blocks are 28 and 32 bytes, each packet 68: two packets
+	// fill a file
+	const maxFileSize = 60 + 2*68
+
+	for _, tt := range []struct {
+		maxFiles int
+		want     [][]string // packets of the file, then of .1, .2, ...
+	}{
+		{0, [][]string{{"packet 7"}, {"packet 5", "packet 6"}, {"packet 3", "packet 4"}, {"packet 1", "packet 2"}}},
+		{1, [][]string{{"packet 7"}}},
+		{2, [][]string{{"packet 7"}, {"packet 5", "packet 6"}}},
+		{3, [][]string{{"packet 7"}, {"packet 5", "packet 6"}, {"packet 3", "packet 4"}}},
+	} {
+		t.Run("MaxFiles="+strconv.Itoa(tt.maxFiles), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "rsocket.pcapng")
+			c, err := NewCapture(CaptureConfig{Path: path, MaxFileSize: maxFileSize, MaxFiles: tt.maxFiles})
+			if err != nil {
+				t.Fatal(err)
+			}
+			src := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1}
+			dst := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 2}
+			for i := 1; i <= 7; i++ {
+				c.WriteUDP(src, dst, []byte("packet "+strconv.Itoa(i)))
+			}
+			if err := c.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			for i, want := range tt.want {
+				name := path
+				if i > 0 {
+					name += "." + strconv.Itoa(i)
+				}
+				data, err := os.ReadFile(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(data) > maxFileSize {
+					t.Errorf("%s: got %d bytes, want at most %d", name, len(data), maxFileSize)
+				}
+				packets := readPackets(t, data)
+				var got []string
+				for _, p := range packets {
+					got = append(got, string(p.l4[8:]))
+				}
+				if !slices.Equal(got, want) {
+					t.Errorf("%s: got packets %q, want %q", name, got, want)
+				}
+			}
+			extra := path + "." + strconv.Itoa(len(tt.want))
+			if _, err := os.Stat(extra); !os.IsNotExist(err) {
+				t.Errorf("got %s with MaxFiles %d, want it removed", extra, tt.maxFiles)
+			}
+		})
+	}
+}
@@ -0,0 +1,353 @@
+// rcat is a netcat-like tool that speaks rsocket.
+//
+// It connects to or listens on an rsocket TCP or UDP endpoint and pipes the
+// connection to stdin/stdout, or to a subprocess with -e.
+//
+// Usage:
+//
+//	rcat [options] host port
+//	rcat -l [options] [host] port
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/smallnest/rsocket"
+)
+
+var (
+	listen   = flag.Bool("l", false, "listen for an incoming connection instead of connecting")
+	udp      = flag.Bool("u", false, "use UDP instead of TCP")
+	keepOpen = flag.Bool("k", false, "keep listening for new connections after the current one is closed")
+	zeroIO   = flag.Bool("z", false, "only probe the given port or port range (lo-hi) without sending data")
+	timeout  = flag.Duration("w", 0, "timeout for connects and idle connections, 0 means no timeout")
+	execProg = flag.String("e", "", "program to exec after connect, wired to the connection")
+	source   = flag.String("s", "", "local source address to bind")
+	verbose  = flag.Bool("v", false, "verbose output on stderr")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: rcat [options] host port\n       rcat -l [options] [host] port\n\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	var host, port string
+	args := flag.Args()
+	switch {
+	case *listen && len(args) == 1:
+		host, port = "0.0.0.0", args[0]
+	case len(args) == 2:
+		host, port = args[0], args[1]
+	default:
+		usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch {
+	case *zeroIO && (*listen || *udp):
+		err = errors.New("-z can only be used to probe TCP ports")
+	case *execProg != "" && len(strings.Fields(*execProg)) == 0:
+		err = errors.New("-e needs a program")
+	case *keepOpen && *listen && *udp:
+		err = errors.New("-k cannot be used with -u, a UDP listener serves a single peer")
+	case *zeroIO:
+		err = probe(host, port)
+	case *listen && *udp:
+		err = listenUDP(host, port)
+	case *listen:
+		err = listenTCP(host, port)
+	default:
+		var conn io.ReadWriteCloser
+		conn, err = dial(host, port)
+		if err == nil {
+			err = handle(conn)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rcat: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func logf(format string, args ...interface{}) {
+	if *verbose {
+		fmt.Fprintf(os.Stderr, format+"\n", args...)
+	}
+}
+
+// listenTCP accepts rsocket TCP connections and serves them one at a time,
+// or concurrently when each connection gets its own -e subprocess.
+func listenTCP(host, port string) error {
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	ip, err := resolveListen(host)
+	if err != nil {
+		return err
+	}
+	ln, err := rsocket.NewTCPListener(ip, p, 128)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	logf("listening on %s", ln.Addr())
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		logf("connection from %s", conn.RemoteAddr())
+
+		if !*keepOpen {
+			return handle(conn)
+		}
+		if *execProg != "" {
+			go func() {
+				if err := handle(conn); err != nil {
+					logf("%s: %v", conn.RemoteAddr(), err)
+				}
+			}()
+			continue
+		}
+		if err := handle(conn); err != nil {
+			logf("%s: %v", conn.RemoteAddr(), err)
+		}
+	}
+}
+
+// listenUDP binds an rsocket UDP socket and talks to the first peer that
+// sends a datagram.
+func listenUDP(host, port string) error {
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	ip, err := resolveListen(host)
+	if err != nil {
+		return err
+	}
+	conn, err := rsocket.ListenUDP(ip, p)
+	if err != nil {
+		return err
+	}
+	logf("listening on %s:%s (udp)", host, port)
+
+	return handle(conn)
+}
+
+// resolveListen returns the IPv4 address to listen on for host, which may be
+// a name: the listeners only take IP literals.
+func resolveListen(host string) (string, error) {
+	if net.ParseIP(host) != nil {
+		return host, nil
+	}
+	ips, err := net.DefaultResolver.LookupIP(context.Background(), "ip4", host)
+	if err != nil {
+		return "", err
+	}
+	return ips[0].String(), nil
+}
+
+// dial connects to host:port over rsocket, honoring -u, -s and -w.
+func dial(host, port string) (io.ReadWriteCloser, error) {
+	if *udp {
+		return dialUDP(host, port)
+	}
+
+	var optFns []rsocket.OptionSocketFn
+	if *source != "" {
+		optFns = append(optFns, rsocket.WithLocalAddr(*source, 0))
+	}
+	address := net.JoinHostPort(host, port)
+	d := &rsocket.Dialer{Timeout: *timeout, Options: optFns}
+	conn, err := d.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*rsocket.TCPConn), nil
+}
+
+func dialUDP(host, port string) (io.ReadWriteCloser, error) {
+	var optFns []rsocket.OptionSocketFn
+	if *source != "" {
+		optFns = append(optFns, rsocket.WithLocalAddr(*source, 0))
+	}
+	return rsocket.DialUDP(net.JoinHostPort(host, port), optFns...)
+}
+
+// probe connects to each port in a port or lo-hi range and closes the
+// connection right away. It succeeds if any port accepted the connection.
+func probe(host, ports string) error {
+	lo, hi, err := parsePortRange(ports)
+	if err != nil {
+		return err
+	}
+
+	open := 0
+	for p := lo; p <= hi; p++ {
+		conn, err := dial(host, strconv.Itoa(p))
+		if err != nil {
+			logf("connect to %s port %d (tcp) failed: %v", host, p, err)
+			continue
+		}
+		conn.Close()
+		open++
+		logf("Connection to %s %d port [tcp/rdma] succeeded!", host, p)
+	}
+	if open == 0 {
+		return fmt.Errorf("no open port on %s in %s", host, ports)
+	}
+	return nil
+}
+
+func parsePortRange(s string) (int, int, error) {
+	loStr, hiStr, isRange := strings.Cut(s, "-")
+	lo, err := strconv.Atoi(loStr)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port %q", s)
+	}
+	hi := lo
+	if isRange {
+		if hi, err = strconv.Atoi(hiStr); err != nil || hi < lo {
+			return 0, 0, fmt.Errorf("invalid port range %q", s)
+		}
+	}
+	return lo, hi, nil
+}
+
+// handle wires an established connection to stdin/stdout or to the -e
+// program and returns when the connection is done.
+func handle(conn io.ReadWriteCloser) error {
+	if *timeout > 0 {
+		conn = newIdleConn(conn, *timeout)
+	}
+	if *execProg != "" {
+		return runProg(conn)
+	}
+	return pipe(conn)
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// pipe copies stdin to the connection and the connection to stdout.
+// On stdin EOF the write side is shut down so the peer sees EOF too.
+func pipe(conn io.ReadWriteCloser) error {
+	defer conn.Close()
+
+	go func() {
+		if _, err := io.Copy(conn, os.Stdin); err != nil {
+			logf("write: %v", err)
+		}
+		if cw, ok := conn.(closeWriter); ok {
+			cw.CloseWrite()
+		}
+	}()
+
+	_, err := io.Copy(os.Stdout, conn)
+	return err
+}
+
+// runProg runs the -e program with its stdin and stdout on the connection.
+func runProg(conn io.ReadWriteCloser) error {
+	defer conn.Close()
+
+	args := strings.Fields(*execProg)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = conn
+	cmd.Stdout = conn
+	cmd.Stderr = os.Stderr
+	// the stdin copier may be blocked in rread after the program exits
+	cmd.WaitDelay = time.Second
+
+	if err := cmd.Run(); err != nil && !errors.Is(err, exec.ErrWaitDelay) {
+		return err
+	}
+	return nil
+}
+
+// idleConn shuts the wrapped connection down when no data has been read or
+// written for the configured timeout. TCPConn deadlines are not implemented,
+// so this is the only way to bound an idle rsocket connection. The reads and
+// writes in flight then fail, and handle closes the connection once they
+// returned.
+type idleConn struct {
+	io.ReadWriteCloser
+	timeout time.Duration
+	timer   *time.Timer
+	once    sync.Once
+}
+
+func newIdleConn(conn io.ReadWriteCloser, timeout time.Duration) *idleConn {
+	c := &idleConn{ReadWriteCloser: conn, timeout: timeout}
+	c.timer = time.AfterFunc(timeout, func() {
+		logf("idle timeout after %v", timeout)
+		c.shutdown()
+	})
+	return c
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	c.timer.Reset(c.timeout)
+	return n, err
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	c.timer.Reset(c.timeout)
+	return n, err
+}
+
+func (c *idleConn) CloseWrite() error {
+	if cw, ok := c.ReadWriteCloser.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+type closeReader interface {
+	CloseRead() error
+}
+
+// shutdown shuts down both directions of the connection without closing the
+// fd under the goroutines using it. A connection that cannot, like a UDP
+// socket, is closed.
+func (c *idleConn) shutdown() {
+	cr, ok1 := c.ReadWriteCloser.(closeReader)
+	cw, ok2 := c.ReadWriteCloser.(closeWriter)
+	if !ok1 || !ok2 {
+		c.Close()
+		return
+	}
+	cr.CloseRead()
+	cw.CloseWrite()
+}
+
+func (c *idleConn) Close() error {
+	var err error
+	c.once.Do(func() {
+		c.timer.Stop()
+		err = c.ReadWriteCloser.Close()
+	})
+	return err
+}
@@ -0,0 +1,68 @@
+// rcp copies files and directories between hosts over rsocket.
+//
+// The receiver listens and stores what it receives under a directory; the
+// sender walks its sources and sends them over parallel connections, large
+// files split in chunks. Each chunk is verified with CRC-32C. When the
+// receiver can map a buffer with riomap, chunks are written into it with
+// riowrite instead of being streamed.
+//
+// Usage:
+//
+//	rcp -l [options] [host] port
+//	rcp [options] source... host:port
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+var (
+	listen  = flag.Bool("l", false, "receive files instead of sending them")
+	dir     = flag.String("d", ".", "directory the receiver stores files in")
+	dest    = flag.String("dest", "", "directory on the receiver to copy the sources to, relative to its -d")
+	streams = flag.Int("p", 4, "number of parallel connections")
+	chunk   = flag.Int64("chunk", 64<<20, "size of the chunks large files are split in")
+	resume  = flag.Bool("resume", false, "skip chunks the receiver already has")
+	iomap   = flag.Bool("iomap", true, "use riowrite into the receiver's mapped buffers when available")
+	window  = flag.Int64("window", 4<<20, "size of the buffer the receiver maps for riowrite")
+	timeout = flag.Duration("w", 10*time.Second, "connect timeout")
+	quiet   = flag.Bool("q", false, "do not print progress")
+	verbose = flag.Bool("v", false, "verbose output on stderr")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: rcp -l [options] [host] port\n       rcp [options] source... host:port\n\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	var err error
+	switch {
+	case *listen && len(args) == 1:
+		err = receive("0.0.0.0", args[0])
+	case *listen && len(args) == 2:
+		err = receive(args[0], args[1])
+	case !*listen && len(args) >= 2:
+		err = send(args[:len(args)-1], args[len(args)-1])
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rcp: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func logf(format string, args ...interface{}) {
+	if *verbose {
+		fmt.Fprintf(os.Stderr, format+"\n", args...)
+	}
+}
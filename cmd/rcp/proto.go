@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"hash/crc32"
+	"io/fs"
+
+	"github.com/smallnest/rsocket"
+)
+
+// The receiver greets every connection with a hello. The sender then sends
+// a request for every directory and file chunk. The receiver answers a
+// directory with a reply. It answers a chunk with a reply telling whether it
+// already has it, and unless it does, the sender sends the data and the
+// receiver replies with its CRC.
+//
+// The data of a chunk is either streamed on the connection, or written with
+// riowrite into the window the receiver mapped with riomap, one piece at a
+// time: the sender announces each piece and waits for the receiver to store
+// it before it overwrites the window with the next one.
+
+// hello is sent by the receiver when it accepts a connection.
+type hello struct {
+	IomapOffset int64 `json:"iomap_offset"` // -1 if no window is mapped
+	IomapSize   int64 `json:"iomap_size"`
+}
+
+// request is sent by the sender for a directory or a chunk of a file.
+type request struct {
+	Path   string      `json:"path"` // slash separated, relative to the receiver's directory
+	Dir    bool        `json:"dir,omitempty"`
+	Mode   fs.FileMode `json:"mode"`
+	Size   int64       `json:"size"` // of the whole file
+	Offset int64       `json:"offset"`
+	Length int64       `json:"length"`
+	CRC    uint32      `json:"crc"` // CRC-32C of the chunk
+	Resume bool        `json:"resume,omitempty"`
+	Iomap  bool        `json:"iomap,omitempty"` // the data comes in pieces
+}
+
+// piece announces Length bytes written at the start of the iomap window.
+type piece struct {
+	Length int64 `json:"length"`
+}
+
+// reply answers a request, or acknowledges a piece.
+type reply struct {
+	Skip  bool   `json:"skip,omitempty"` // the receiver already has the chunk
+	CRC   uint32 `json:"crc"`            // CRC-32C of the data received
+	Error string `json:"error,omitempty"`
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func writeJSON(mc *rsocket.MsgConn, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return mc.WriteMsg(b)
+}
+
+func readJSON(mc *rsocket.MsgConn, v any) error {
+	b, err := mc.ReadMsg()
+	if err != nil {
+		return err
+	}
+	defer mc.Release(b)
+	return json.Unmarshal(b, v)
+}
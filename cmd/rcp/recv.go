@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"github.com/smallnest/rsocket"
+)
+
+// receive accepts connections on host:port and stores the files sent on
+// them under -d.
+func receive(host, port string) error {
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	var optFns []rsocket.OptionSocketFn
+	if *iomap {
+		optFns = append(optFns, rsocket.WithIOMapSize(1))
+	}
+	ln, err := rsocket.NewTCPListener(host, p, 128, optFns...)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	logf("receiving into %s on %s", *dir, ln.Addr())
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := serve(conn.(*rsocket.TCPConn)); err != nil && err != io.EOF {
+				fmt.Fprintf(os.Stderr, "rcp: %s: %v\n", conn.RemoteAddr(), err)
+			}
+			conn.Close()
+		}()
+	}
+}
+
+// receiver is the state of a connection of the receiver.
+type receiver struct {
+	conn   *rsocket.TCPConn
+	mc     *rsocket.MsgConn
+	window []byte // mapped with riomap, nil if unavailable
+}
+
+func serve(conn *rsocket.TCPConn) error {
+	mc, err := rsocket.NewMsgConn(conn, rsocket.MsgConfig{})
+	if err != nil {
+		return err
+	}
+	r := &receiver{conn: conn, mc: mc}
+
+	h := hello{IomapOffset: -1}
+	if *iomap {
+		if off, err := r.mapWindow(); err != nil {
+			logf("%s: riomap: %v, streaming instead", conn.RemoteAddr(), err)
+		} else {
+			h.IomapOffset, h.IomapSize = off, int64(len(r.window))
+		}
+	}
+	defer r.unmapWindow()
+	if err := writeJSON(mc, h); err != nil {
+		return err
+	}
+
+	for {
+		var req request
+		if err := readJSON(mc, &req); err != nil {
+			return err
+		}
+		if err := r.handle(&req); err != nil {
+			// the data of the chunk may be left on the connection, give up on it
+			writeJSON(mc, reply{Error: err.Error()})
+			return fmt.Errorf("%s: %w", req.Path, err)
+		}
+	}
+}
+
+// mapWindow maps a buffer outside of the Go heap, since rsocket keeps
+// writing to it, and returns its offset for riowrite.
+func (r *receiver) mapWindow() (int64, error) {
+	buf, err := syscall.Mmap(-1, 0, int(*window), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+	if err != nil {
+		return 0, err
+	}
+	off, err := rsocket.Iomap(r.conn.File(), buf, syscall.PROT_WRITE, 0, -1)
+	if err != nil {
+		syscall.Munmap(buf)
+		return 0, err
+	}
+	r.window = buf
+	return off, nil
+}
+
+func (r *receiver) unmapWindow() {
+	if r.window != nil {
+		rsocket.Iounmap(r.conn.File(), r.window)
+		syscall.Munmap(r.window)
+	}
+}
+
+// handle serves a request. A directory gets a reply. A chunk gets a first
+// reply telling whether to skip it, then one with the CRC of its data.
+func (r *receiver) handle(req *request) error {
+	path := filepath.FromSlash(req.Path)
+	if !filepath.IsLocal(path) {
+		return errors.New("path escapes the destination directory")
+	}
+	path = filepath.Join(*dir, path)
+	if req.Dir {
+		if err := os.MkdirAll(path, req.Mode.Perm()|0o700); err != nil {
+			return err
+		}
+		// a chunk of a file inside may have been handled first and created
+		// the directory with the default mode
+		if err := os.Chmod(path, req.Mode.Perm()|0o700); err != nil {
+			return err
+		}
+		return writeJSON(r.mc, reply{})
+	}
+	if req.Iomap && r.window == nil {
+		return errors.New("no iomap window")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, req.Mode.Perm())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if req.Resume {
+		if crc, ok := rangeCRC(f, req.Offset, req.Length); ok && crc == req.CRC {
+			logf("%s: have %d bytes at %d", req.Path, req.Length, req.Offset)
+			if err := f.Truncate(req.Size); err != nil {
+				return err
+			}
+			return writeJSON(r.mc, reply{Skip: true, CRC: crc})
+		}
+	}
+	if fi, err := f.Stat(); err != nil {
+		return err
+	} else if fi.Size() != req.Size {
+		if err := f.Truncate(req.Size); err != nil {
+			return err
+		}
+	}
+	if err := writeJSON(r.mc, reply{}); err != nil {
+		return err
+	}
+
+	var crc uint32
+	if req.Iomap {
+		crc, err = r.receivePieces(f, req.Offset, req.Length)
+	} else {
+		crc, err = r.receiveStream(f, req.Offset, req.Length)
+	}
+	if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	logf("%s: received %d bytes at %d", req.Path, req.Length, req.Offset)
+	return writeJSON(r.mc, reply{CRC: crc})
+}
+
+// receiveStream copies n bytes from the connection to f at off.
+func (r *receiver) receiveStream(f *os.File, off, n int64) (uint32, error) {
+	buf := r.conn.GetBuffer(1 << 20)
+	defer r.conn.Release(buf)
+
+	var crc uint32
+	for n > 0 {
+		m, err := io.ReadFull(r.conn, buf[:min(int64(len(buf)), n)])
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		if _, err := f.WriteAt(buf[:m], off); err != nil {
+			return 0, err
+		}
+		crc = crc32.Update(crc, castagnoli, buf[:m])
+		off += int64(m)
+		n -= int64(m)
+	}
+	return crc, nil
+}
+
+// receivePieces stores n bytes written into the window, one piece at a time,
+// to f at off.
+func (r *receiver) receivePieces(f *os.File, off, n int64) (uint32, error) {
+	var crc uint32
+	for n > 0 {
+		var p piece
+		if err := readJSON(r.mc, &p); err != nil {
+			return 0, err
+		}
+		if p.Length <= 0 || p.Length > n || p.Length > int64(len(r.window)) {
+			return 0, fmt.Errorf("invalid piece of %d bytes", p.Length)
+		}
+		data := r.window[:p.Length]
+		if _, err := f.WriteAt(data, off); err != nil {
+			return 0, err
+		}
+		crc = crc32.Update(crc, castagnoli, data)
+		if err := writeJSON(r.mc, reply{}); err != nil {
+			return 0, err
+		}
+		off += p.Length
+		n -= p.Length
+	}
+	return crc, nil
+}
+
+// rangeCRC returns the CRC-32C of n bytes of f at off, if f holds them.
+func rangeCRC(f *os.File, off, n int64) (uint32, bool) {
+	h := crc32.New(castagnoli)
+	m, err := io.Copy(h, io.NewSectionReader(f, off, n))
+	if err != nil || m != n {
+		return 0, false
+	}
+	return h.Sum32(), true
+}
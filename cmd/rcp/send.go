@@ -0,0 +1,316 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/smallnest/rsocket"
+)
+
+// streamStep is the amount of a chunk streamed per ReadFrom, so that the
+// progress moves during large chunks.
+const streamStep = 8 << 20
+
+// job is a request to send, with the local file of a chunk.
+type job struct {
+	req  request
+	file string
+}
+
+// send copies sources to the receiver at address.
+func send(sources []string, address string) error {
+	jobs, total, err := plan(sources)
+	if err != nil {
+		return err
+	}
+
+	var done atomic.Int64
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+	var firstErr error
+	fail := func(err error) {
+		stopOnce.Do(func() {
+			firstErr = err
+			close(stop)
+		})
+	}
+
+	queue := make(chan job)
+	go func() {
+		defer close(queue)
+		for _, j := range jobs {
+			select {
+			case queue <- j:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	progressDone := make(chan struct{})
+	if !*quiet {
+		go progress(&done, total, progressDone)
+	}
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for range max(1, min(*streams, len(jobs))) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := worker(address, queue, &done); err != nil {
+				fail(err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(progressDone)
+	if firstErr != nil {
+		return firstErr
+	}
+	if !*quiet {
+		elapsed := time.Since(start)
+		fmt.Fprintf(os.Stderr, "\r%s sent in %v, %s/s\n", bytesString(total),
+			elapsed.Round(time.Millisecond), bytesString(int64(float64(total)/elapsed.Seconds())))
+	}
+	return nil
+}
+
+// plan walks sources and returns the requests to send and the number of
+// bytes to transfer. Sources are copied under -dest by their base name.
+func plan(sources []string) ([]job, int64, error) {
+	if *chunk <= 0 {
+		return nil, 0, errors.New("-chunk must be positive")
+	}
+	var jobs []job
+	var total int64
+	for _, src := range sources {
+		root := filepath.Clean(src)
+		base := filepath.Base(root)
+		err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, p)
+			if err != nil {
+				return err
+			}
+			name := path.Join(*dest, base, filepath.ToSlash(rel))
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+
+			switch {
+			case fi.IsDir():
+				jobs = append(jobs, job{req: request{Path: name, Dir: true, Mode: fi.Mode()}})
+			case fi.Mode().IsRegular():
+				// an empty file still needs a chunk to be created
+				size := fi.Size()
+				for off := int64(0); off == 0 || off < size; off += *chunk {
+					req := request{Path: name, Mode: fi.Mode(), Size: size, Offset: off, Length: min(*chunk, size-off), Resume: *resume}
+					jobs = append(jobs, job{req: req, file: p})
+				}
+				total += size
+			default:
+				fmt.Fprintf(os.Stderr, "rcp: skipping %s: not a regular file or directory\n", p)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	return jobs, total, nil
+}
+
+// sender is the state of a connection of the sender.
+type sender struct {
+	conn  *rsocket.TCPConn
+	mc    *rsocket.MsgConn
+	hello hello
+	done  *atomic.Int64
+}
+
+// worker sends the jobs of queue on a connection of its own.
+func worker(address string, queue <-chan job, done *atomic.Int64) error {
+	d := &rsocket.Dialer{Timeout: *timeout}
+	if *iomap {
+		d.Options = append(d.Options, rsocket.WithIOMapSize(1))
+	}
+	c, err := d.Dial("tcp", address)
+	if err != nil {
+		return err
+	}
+	conn := c.(*rsocket.TCPConn)
+	defer conn.Close()
+	mc, err := rsocket.NewMsgConn(conn, rsocket.MsgConfig{})
+	if err != nil {
+		return err
+	}
+
+	s := &sender{conn: conn, mc: mc, done: done}
+	if err := readJSON(mc, &s.hello); err != nil {
+		return err
+	}
+	if *iomap && s.hello.IomapOffset >= 0 {
+		logf("%s: riowrite into a %d-byte window", conn.RemoteAddr(), s.hello.IomapSize)
+	}
+	for j := range queue {
+		if err := s.send(j); err != nil {
+			return fmt.Errorf("%s: %w", j.req.Path, err)
+		}
+	}
+	return nil
+}
+
+func (s *sender) send(j job) error {
+	if j.req.Dir {
+		return s.roundTrip(j.req, nil)
+	}
+
+	f, err := os.Open(j.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	crc, ok := rangeCRC(f, j.req.Offset, j.req.Length)
+	if !ok {
+		return errors.New("file changed while copying")
+	}
+	j.req.CRC = crc
+	j.req.Iomap = *iomap && s.hello.IomapOffset >= 0 && s.hello.IomapSize > 0 && j.req.Length > 0
+
+	var rep reply
+	if err := s.roundTrip(j.req, &rep); err != nil {
+		return err
+	}
+	if rep.Skip {
+		s.done.Add(j.req.Length)
+		return nil
+	}
+
+	if j.req.Iomap {
+		err = s.sendPieces(f, j.req.Offset, j.req.Length)
+	} else {
+		err = s.sendStream(f, j.req.Offset, j.req.Length)
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.readReply(&rep); err != nil {
+		return err
+	}
+	if rep.CRC != crc {
+		return fmt.Errorf("checksum mismatch at %d: sent %08x, received %08x", j.req.Offset, crc, rep.CRC)
+	}
+	return nil
+}
+
+// roundTrip sends req and reads the reply into rep, if not nil.
+func (s *sender) roundTrip(req request, rep *reply) error {
+	if err := writeJSON(s.mc, req); err != nil {
+		return err
+	}
+	if rep == nil {
+		rep = new(reply)
+	}
+	return s.readReply(rep)
+}
+
+func (s *sender) readReply(rep *reply) error {
+	if err := readJSON(s.mc, rep); err != nil {
+		return err
+	}
+	if rep.Error != "" {
+		return fmt.Errorf("receiver: %s", rep.Error)
+	}
+	return nil
+}
+
+// sendStream streams n bytes of f at off on the connection.
+func (s *sender) sendStream(f *os.File, off, n int64) error {
+	for n > 0 {
+		step := min(n, streamStep)
+		m, err := s.conn.ReadFrom(io.NewSectionReader(f, off, step))
+		s.done.Add(m)
+		if err != nil {
+			return err
+		}
+		if m < step {
+			return errors.New("file changed while copying")
+		}
+		off += m
+		n -= m
+	}
+	return nil
+}
+
+// sendPieces writes n bytes of f at off into the receiver's window with
+// riowrite, waiting for the receiver to store each piece.
+func (s *sender) sendPieces(f *os.File, off, n int64) error {
+	for n > 0 {
+		size := min(n, s.hello.IomapSize)
+		m, err := s.conn.IowriteFile(f, off, size, s.hello.IomapOffset)
+		if err != nil {
+			return err
+		}
+		if err := writeJSON(s.mc, piece{Length: m}); err != nil {
+			return err
+		}
+		var ack reply
+		if err := s.readReply(&ack); err != nil {
+			return err
+		}
+		s.done.Add(m)
+		off += m
+		n -= m
+	}
+	return nil
+}
+
+// progress prints the transferred bytes every second until done is closed.
+func progress(done *atomic.Int64, total int64, stop <-chan struct{}) {
+	start := time.Now()
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		n := done.Load()
+		rate := float64(n) / time.Since(start).Seconds()
+		eta := "-"
+		if rate > 0 {
+			eta = time.Duration(float64(total-n) / rate * float64(time.Second)).Round(time.Second).String()
+		}
+		pct := 100.0
+		if total > 0 {
+			pct = 100 * float64(n) / float64(total)
+		}
+		fmt.Fprintf(os.Stderr, "\r%s / %s (%.1f%%)  %s/s  ETA %s   ", bytesString(n), bytesString(total), pct, bytesString(int64(rate)), eta)
+	}
+}
+
+func bytesString(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
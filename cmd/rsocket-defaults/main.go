@@ -0,0 +1,204 @@
+// rsocket-defaults shows and changes the defaults librdmacm reads from
+// /etc/rdma/rsocket when a process opens its first rsocket.
+//
+// Usage:
+//
+//	rsocket-defaults [-dir dir] show
+//	rsocket-defaults [-dir dir] check
+//	rsocket-defaults [-dir dir] explain [name...]
+//	rsocket-defaults [-dir dir] set name=value...
+//	rsocket-defaults [-dir dir] unset name...
+//	rsocket-defaults [-dir dir] compare host:port
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/smallnest/rsocket"
+)
+
+var (
+	dir     = flag.String("dir", rsocket.DefaultsDir, "directory of the defaults files")
+	timeout = flag.Duration("w", 5*time.Second, "connect timeout of compare")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: rsocket-defaults [options] command [args]
+
+commands:
+  show                  print the configured and effective defaults
+  check                 validate the defaults files, exit 1 if one is invalid
+  explain [name...]     describe what the defaults do
+  set name=value...     write defaults atomically
+  unset name...         remove defaults, restoring the builtin values
+  compare host:port     connect and compare the defaults with the connection
+
+`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch cmd, args := args[0], args[1:]; {
+	case cmd == "show" && len(args) == 0:
+		err = show()
+	case cmd == "check" && len(args) == 0:
+		err = check()
+	case cmd == "explain":
+		err = explain(args)
+	case cmd == "set" && len(args) > 0:
+		err = set(args)
+	case cmd == "unset" && len(args) > 0:
+		err = unset(args)
+	case cmd == "compare" && len(args) == 1:
+		err = compare(args[0])
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rsocket-defaults: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func show() error {
+	d, err := rsocket.ReadDefaults(*dir)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tFILE\tEFFECTIVE\tBUILTIN\tUNIT")
+	for _, s := range rsocket.DefaultSettings {
+		file := "-"
+		if err := d.Errors[s.Name]; err != nil {
+			file = "invalid"
+		} else if v, ok := d.Values[s.Name]; ok {
+			file = strconv.Itoa(v)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\n", s.Name, file, d.Effective(s.Name), s.Builtin, s.Unit)
+	}
+	w.Flush()
+	return d.Validate()
+}
+
+func check() error {
+	d, err := rsocket.ReadDefaults(*dir)
+	if err != nil {
+		return err
+	}
+	if err := d.Validate(); err != nil {
+		return err
+	}
+	fmt.Printf("%s: ok\n", d.Dir)
+	return nil
+}
+
+func explain(names []string) error {
+	if len(names) == 0 {
+		for _, s := range rsocket.DefaultSettings {
+			names = append(names, s.Name)
+		}
+	}
+	for i, name := range names {
+		s, ok := rsocket.LookupDefaultSetting(name)
+		if !ok {
+			return fmt.Errorf("unknown default %q", name)
+		}
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("%s (%s, builtin %d, range %d-%d)\n  %s\n", s.Name, s.Unit, s.Builtin, s.Min, s.Max, s.Help)
+	}
+	return nil
+}
+
+func set(args []string) error {
+	// validate all values before writing any
+	values := make([]int, len(args))
+	names := make([]string, len(args))
+	for i, arg := range args {
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return fmt.Errorf("expected name=value, got %q", arg)
+		}
+		s, ok := rsocket.LookupDefaultSetting(name)
+		if !ok {
+			return fmt.Errorf("unknown default %q", name)
+		}
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s: invalid value %q", name, value)
+		}
+		if err := s.Validate(v); err != nil {
+			return err
+		}
+		if e := s.Effective(v); e != v {
+			fmt.Fprintf(os.Stderr, "rsocket-defaults: %s: librdmacm will use %d\n", name, e)
+		}
+		names[i], values[i] = name, v
+	}
+	for i, name := range names {
+		if err := rsocket.WriteDefault(*dir, name, values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func unset(names []string) error {
+	for _, name := range names {
+		if err := rsocket.RemoveDefault(*dir, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func compare(address string) error {
+	d, err := rsocket.ReadDefaults(*dir)
+	if err != nil {
+		return err
+	}
+	conn, err := (&rsocket.Dialer{Timeout: *timeout}).Dial("tcp", address)
+	if err != nil {
+		return err
+	}
+	info := conn.(*rsocket.TCPConn).Info()
+	conn.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tEXPECTED\tACTUAL\t")
+	mismatches := 0
+	for _, diff := range d.Compare(info) {
+		switch {
+		case diff.Err != nil:
+			fmt.Fprintf(w, "%s\t%d\t-\t%v\n", diff.Name, diff.Expected, diff.Err)
+		case diff.Match():
+			fmt.Fprintf(w, "%s\t%d\t%d\t\n", diff.Name, diff.Expected, diff.Actual)
+		default:
+			mismatches++
+			fmt.Fprintf(w, "%s\t%d\t%d\tdiffers\n", diff.Name, diff.Expected, diff.Actual)
+		}
+	}
+	w.Flush()
+	if mismatches > 0 {
+		return errors.New("the connection does not use all defaults, the device or the peer may have lowered some")
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	networkTCP     = "tcp"
+	networkRSocket = "rsocket"
+)
+
+// Config is the proxy configuration file.
+type Config struct {
+	// MaxConns limits the number of proxied connections across all routes, 0 means no limit.
+	MaxConns int64 `json:"max_conns"`
+	// Routes are the listeners of the proxy and where they forward to.
+	Routes []RouteConfig `json:"routes"`
+}
+
+// RouteConfig describes one listener and the backend it forwards to.
+type RouteConfig struct {
+	Name string `json:"name"`
+
+	// Listen is the host:port to accept connections on.
+	Listen string `json:"listen"`
+	// ListenNetwork is "tcp" (kernel TCP) or "rsocket", default is "tcp".
+	ListenNetwork string `json:"listen_network"`
+
+	// Target is the host:port of the backend.
+	Target string `json:"target"`
+	// TargetNetwork is "tcp" (kernel TCP) or "rsocket", default is "rsocket".
+	TargetNetwork string `json:"target_network"`
+
+	// MaxConns limits the number of connections of this route, 0 means no limit.
+	MaxConns int64 `json:"max_conns"`
+	// IdleTimeout closes a connection when no bytes flowed in either direction for this long.
+	IdleTimeout Duration `json:"idle_timeout"`
+	// DialTimeout bounds connecting to the target.
+	DialTimeout Duration `json:"dial_timeout"`
+	// Backlog is the listen backlog of rsocket listeners, default is 128.
+	Backlog int `json:"backlog"`
+}
+
+// Duration is a time.Duration that is written as a string like "30s" in JSON.
+type Duration time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// loadConfig reads, defaults and validates the config file at path.
+func loadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+func (cfg *Config) validate() error {
+	if len(cfg.Routes) == 0 {
+		return fmt.Errorf("no routes")
+	}
+
+	names := make(map[string]bool)
+	listens := make(map[string]bool)
+	for i := range cfg.Routes {
+		r := &cfg.Routes[i]
+		if r.Name == "" {
+			return fmt.Errorf("route #%d: missing name", i)
+		}
+		if names[r.Name] {
+			return fmt.Errorf("route %q: duplicate name", r.Name)
+		}
+		names[r.Name] = true
+
+		if r.ListenNetwork == "" {
+			r.ListenNetwork = networkTCP
+		}
+		if r.TargetNetwork == "" {
+			r.TargetNetwork = networkRSocket
+		}
+		if r.Backlog == 0 {
+			r.Backlog = 128
+		}
+		if err := checkNetwork(r.ListenNetwork); err != nil {
+			return fmt.Errorf("route %q: listen_network: %w", r.Name, err)
+		}
+		if err := checkNetwork(r.TargetNetwork); err != nil {
+			return fmt.Errorf("route %q: target_network: %w", r.Name, err)
+		}
+		if err := checkHostPort(r.Listen); err != nil {
+			return fmt.Errorf("route %q: listen: %w", r.Name, err)
+		}
+		if err := checkHostPort(r.Target); err != nil {
+			return fmt.Errorf("route %q: target: %w", r.Name, err)
+		}
+		if listens[r.ListenNetwork+"/"+r.Listen] {
+			return fmt.Errorf("route %q: %s %s is already used by another route", r.Name, r.ListenNetwork, r.Listen)
+		}
+		listens[r.ListenNetwork+"/"+r.Listen] = true
+
+		if r.MaxConns < 0 || r.IdleTimeout < 0 || r.DialTimeout < 0 || r.Backlog < 0 {
+			return fmt.Errorf("route %q: limits and timeouts must not be negative", r.Name)
+		}
+	}
+	if cfg.MaxConns < 0 {
+		return fmt.Errorf("max_conns must not be negative")
+	}
+	return nil
+}
+
+func checkNetwork(network string) error {
+	if network != networkTCP && network != networkRSocket {
+		return fmt.Errorf("unknown network %q, want %q or %q", network, networkTCP, networkRSocket)
+	}
+	return nil
+}
+
+func checkHostPort(address string) error {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if _, err := strconv.Atoi(port); err != nil {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+// rsocket-proxy bridges kernel TCP and rsocket.
+//
+// Each route of the config file listens on kernel TCP or rsocket and forwards
+// every accepted connection to a target on the other (or the same) transport,
+// so clients without rsocket bindings can reach RDMA-only services and the
+// other way around.
+//
+// Signals:
+//
+//	SIGHUP           reload the config file, routes that did not change keep running
+//	SIGUSR1          log the per-route counters
+//	SIGINT, SIGTERM  stop listening, wait up to -drain for connections, then exit
+//
+// An example config file:
+//
+//	{
+//	  "max_conns": 10000,
+//	  "routes": [
+//	    {
+//	      "name": "redis",
+//	      "listen": "0.0.0.0:6379",
+//	      "listen_network": "tcp",
+//	      "target": "192.168.10.2:6379",
+//	      "target_network": "rsocket",
+//	      "max_conns": 1000,
+//	      "idle_timeout": "5m",
+//	      "dial_timeout": "3s"
+//	    }
+//	  ]
+//	}
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	configFile = flag.String("c", "rsocket-proxy.json", "config file")
+	drain      = flag.Duration("drain", 30*time.Second, "how long to wait for connections to finish on shutdown")
+)
+
+// proxy owns the running routes.
+type proxy struct {
+	mu     sync.Mutex
+	routes map[string]*route
+	stats  map[string]*routeStats
+	global limiter
+	old    sync.WaitGroup // routes that were removed or replaced and are draining
+}
+
+func main() {
+	flag.Parse()
+
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	p := &proxy{
+		routes: make(map[string]*route),
+		stats:  make(map[string]*routeStats),
+	}
+	if err := p.apply(cfg); err != nil {
+		log.Fatal(err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGINT, syscall.SIGTERM)
+	for sig := range signals {
+		switch sig {
+		case syscall.SIGHUP:
+			cfg, err := loadConfig(*configFile)
+			if err != nil {
+				log.Printf("reload: %v, keeping the current config", err)
+				continue
+			}
+			if err := p.apply(cfg); err != nil {
+				log.Printf("reload: %v", err)
+				continue
+			}
+			log.Printf("reloaded %s", *configFile)
+		case syscall.SIGUSR1:
+			p.logStats()
+		default:
+			p.shutdown(*drain)
+			p.logStats()
+			return
+		}
+	}
+}
+
+// apply starts routes that are new or changed and stops routes that are gone
+// or changed. Stopped routes stop listening while their connections drain.
+func (p *proxy) apply(cfg *Config) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.global.max.Store(cfg.MaxConns)
+
+	wanted := make(map[string]RouteConfig, len(cfg.Routes))
+	for _, rc := range cfg.Routes {
+		wanted[rc.Name] = rc
+	}
+
+	// stop first so a changed route can listen on its old address again
+	for name, r := range p.routes {
+		if rc, ok := wanted[name]; ok && reflect.DeepEqual(rc, r.cfg) {
+			continue
+		}
+		p.retire(r)
+		delete(p.routes, name)
+	}
+
+	var firstErr error
+	for _, rc := range cfg.Routes {
+		if _, ok := p.routes[rc.Name]; ok {
+			continue
+		}
+
+		stats := p.stats[rc.Name]
+		if stats == nil {
+			stats = &routeStats{}
+			p.stats[rc.Name] = stats
+		}
+		r := newRoute(rc, stats, &p.global)
+		if err := r.listen(); err != nil {
+			log.Printf("route %s: listen %s %s: %v", rc.Name, rc.ListenNetwork, rc.Listen, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		p.routes[rc.Name] = r
+		go r.serve()
+		log.Printf("route %s: %s %s -> %s %s", rc.Name, rc.ListenNetwork, rc.Listen, rc.TargetNetwork, rc.Target)
+	}
+	return firstErr
+}
+
+// retire stops the listener of r and lets its connections finish.
+func (p *proxy) retire(r *route) {
+	r.stop()
+	p.old.Add(1)
+	go func() {
+		defer p.old.Done()
+		r.wg.Wait()
+	}()
+	log.Printf("route %s: stopped listening on %s %s", r.cfg.Name, r.cfg.ListenNetwork, r.cfg.Listen)
+}
+
+// shutdown stops all routes and waits up to timeout for their connections
+// to finish before closing the remaining ones.
+func (p *proxy) shutdown(timeout time.Duration) {
+	p.mu.Lock()
+	routes := p.routes
+	p.routes = make(map[string]*route)
+	for _, r := range routes {
+		p.retire(r)
+	}
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.old.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Printf("drain timeout, closing remaining connections")
+		for _, r := range routes {
+			r.closeConns()
+		}
+	}
+}
+
+func (p *proxy) logStats() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	names := make([]string, 0, len(p.stats))
+	for name := range p.stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		s := p.stats[name]
+		log.Printf("route %s: accepted=%d rejected=%d failed=%d active=%d bytes_in=%d bytes_out=%d",
+			name, s.Accepted.Load(), s.Rejected.Load(), s.Failed.Load(), s.Active.Load(),
+			s.BytesIn.Load(), s.BytesOut.Load())
+	}
+}
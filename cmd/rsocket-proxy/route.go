@@ -0,0 +1,257 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/smallnest/rsocket"
+)
+
+// routeStats are the counters of a route. They survive config reloads as
+// long as the route keeps its name.
+type routeStats struct {
+	Accepted atomic.Int64 // connections accepted
+	Rejected atomic.Int64 // connections closed because of connection limits
+	Failed   atomic.Int64 // connections whose target could not be dialed
+	Active   atomic.Int64 // connections currently proxied
+	BytesIn  atomic.Int64 // bytes from clients to the target
+	BytesOut atomic.Int64 // bytes from the target to clients
+}
+
+// route accepts connections on one listener and forwards them to its target.
+type route struct {
+	cfg    RouteConfig
+	stats  *routeStats
+	global *limiter
+	ln     net.Listener
+	wg     sync.WaitGroup // proxied connections
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+func newRoute(cfg RouteConfig, stats *routeStats, global *limiter) *route {
+	return &route{
+		cfg:    cfg,
+		stats:  stats,
+		global: global,
+		conns:  make(map[net.Conn]struct{}),
+	}
+}
+
+// listen opens the listener of the route.
+func (r *route) listen() error {
+	if r.cfg.ListenNetwork == networkTCP {
+		ln, err := net.Listen("tcp", r.cfg.Listen)
+		if err != nil {
+			return err
+		}
+		r.ln = ln
+		return nil
+	}
+
+	host, port, _ := net.SplitHostPort(r.cfg.Listen)
+	p, _ := strconv.Atoi(port)
+	ln, err := rsocket.NewTCPListener(host, p, r.cfg.Backlog)
+	if err != nil {
+		return err
+	}
+	r.ln = ln
+	return nil
+}
+
+// serve accepts connections until the listener is closed.
+func (r *route) serve() {
+	for {
+		conn, err := r.ln.Accept()
+		if err != nil {
+			if r.isClosed() {
+				return
+			}
+			log.Printf("route %s: accept: %v", r.cfg.Name, err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		r.stats.Accepted.Add(1)
+
+		if !r.admit() {
+			r.stats.Rejected.Add(1)
+			conn.Close()
+			continue
+		}
+
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			defer r.global.release()
+			defer r.stats.Active.Add(-1)
+			r.proxy(conn)
+		}()
+	}
+}
+
+// admit reserves a slot for a new connection under the route and global limits.
+func (r *route) admit() bool {
+	if n := r.stats.Active.Add(1); r.cfg.MaxConns > 0 && n > r.cfg.MaxConns {
+		r.stats.Active.Add(-1)
+		return false
+	}
+	if !r.global.acquire() {
+		r.stats.Active.Add(-1)
+		return false
+	}
+	return true
+}
+
+// stop closes the listener. Established connections keep running.
+func (r *route) stop() {
+	r.mu.Lock()
+	r.closed = true
+	r.mu.Unlock()
+	r.ln.Close()
+}
+
+// closeConns shuts down all established connections of the route. They are
+// closed by their proxy goroutine.
+func (r *route) closeConns() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for conn := range r.conns {
+		shutdown(conn)
+	}
+}
+
+func (r *route) isClosed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closed
+}
+
+func (r *route) track(conn net.Conn, add bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if add {
+		r.conns[conn] = struct{}{}
+	} else {
+		delete(r.conns, conn)
+	}
+}
+
+func (r *route) dial() (net.Conn, error) {
+	if r.cfg.TargetNetwork == networkTCP {
+		return net.DialTimeout("tcp", r.cfg.Target, time.Duration(r.cfg.DialTimeout))
+	}
+	d := &rsocket.Dialer{Timeout: time.Duration(r.cfg.DialTimeout)}
+	return d.Dial("tcp", r.cfg.Target)
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+type closeReader interface {
+	CloseRead() error
+}
+
+// shutdown shuts down both directions of conn, which ends the copies of its
+// proxy goroutine without closing the fd under them.
+func shutdown(conn net.Conn) {
+	cr, ok1 := conn.(closeReader)
+	cw, ok2 := conn.(closeWriter)
+	if !ok1 || !ok2 {
+		conn.Close()
+		return
+	}
+	cr.CloseRead()
+	cw.CloseWrite()
+}
+
+// proxy dials the target and copies bytes both ways until both sides are done.
+func (r *route) proxy(client net.Conn) {
+	defer client.Close()
+
+	target, err := r.dial()
+	if err != nil {
+		r.stats.Failed.Add(1)
+		log.Printf("route %s: %s: %v", r.cfg.Name, client.RemoteAddr(), err)
+		return
+	}
+	defer target.Close()
+
+	r.track(client, true)
+	r.track(target, true)
+	defer r.track(client, false)
+	defer r.track(target, false)
+
+	// TCPConn deadlines are not implemented, so idleness is enforced by
+	// shutting down both sides from a timer that every copied chunk resets.
+	// The deferred Close calls above are the only ones.
+	touch := func() {}
+	if d := time.Duration(r.cfg.IdleTimeout); d > 0 {
+		timer := time.AfterFunc(d, func() {
+			shutdown(client)
+			shutdown(target)
+		})
+		defer timer.Stop()
+		touch = func() { timer.Reset(d) }
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		copyHalf(target, client, &r.stats.BytesIn, touch)
+	}()
+	go func() {
+		defer wg.Done()
+		copyHalf(client, target, &r.stats.BytesOut, touch)
+	}()
+	wg.Wait()
+}
+
+// copyHalf copies src to dst and then half-closes dst so the other side
+// sees EOF while the opposite direction keeps flowing.
+func copyHalf(dst, src net.Conn, counter *atomic.Int64, touch func()) {
+	io.Copy(&countingWriter{w: dst, n: counter, touch: touch}, src)
+	if cw, ok := dst.(closeWriter); ok {
+		cw.CloseWrite()
+	}
+}
+
+type countingWriter struct {
+	w     io.Writer
+	n     *atomic.Int64
+	touch func()
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n.Add(int64(n))
+	w.touch()
+	return n, err
+}
+
+// limiter bounds the number of connections across routes.
+type limiter struct {
+	max    atomic.Int64
+	active atomic.Int64
+}
+
+func (l *limiter) acquire() bool {
+	max := l.max.Load()
+	if n := l.active.Add(1); max > 0 && n > max {
+		l.active.Add(-1)
+		return false
+	}
+	return true
+}
+
+func (l *limiter) release() {
+	l.active.Add(-1)
+}
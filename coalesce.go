@@ -0,0 +1,244 @@
+package rsocket
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// CoalesceConfig configures a CoalescingWriter.
+type CoalesceConfig struct {
+	// MaxBatch is the number of bytes buffered before they are sent, default
+	// 4096, the largest InfiniBand MTU. Set it to the Inline size of
+	// TCPConn.Info to keep every send inline.
+	MaxBatch int
+	// MaxDelay bounds how long a write waits in the buffer for others to join
+	// it, default 100µs. A negative MaxDelay waits for a full batch or Flush.
+	MaxDelay time.Duration
+}
+
+func (cfg *CoalesceConfig) setDefaults() {
+	if cfg.MaxBatch <= 0 {
+		cfg.MaxBatch = 4096
+	}
+	if cfg.MaxDelay == 0 {
+		cfg.MaxDelay = 100 * time.Microsecond
+	}
+}
+
+// CoalesceStats reports how well a CoalescingWriter batches writes.
+type CoalesceStats struct {
+	Writes uint64 // Write and WriteNow calls
+	Bytes  uint64 // bytes written
+	Sends  uint64 // writes to the underlying writer
+
+	// why batches were sent
+	FullFlushes     uint64 // the batch was full
+	DelayFlushes    uint64 // MaxDelay expired
+	ExplicitFlushes uint64 // Flush, WriteNow or Close
+}
+
+// WritesPerSend returns the average number of writes coalesced in a send.
+func (s CoalesceStats) WritesPerSend() float64 {
+	if s.Sends == 0 {
+		return 0
+	}
+	return float64(s.Writes) / float64(s.Sends)
+}
+
+// BytesPerSend returns the average size of a send.
+func (s CoalesceStats) BytesPerSend() float64 {
+	if s.Sends == 0 {
+		return 0
+	}
+	return float64(s.Bytes) / float64(s.Sends)
+}
+
+// CoalescingWriter batches small writes into larger sends. rsocket ignores
+// TCP_NODELAY and turns every TCPConn.Write into its own RDMA send, so a
+// chatty protocol gets a fraction of the throughput of the link. Writes are
+// buffered until MaxBatch bytes are pending, MaxDelay expires or Flush is
+// called, like Nagle's algorithm with a bounded delay. WriteNow sends right
+// away for latency sensitive messages.
+//
+// An error of the underlying writer, including one from a delayed flush, is
+// returned by all later calls.
+type CoalescingWriter struct {
+	w     io.Writer
+	cfg   CoalesceConfig
+	mu    sync.Mutex
+	buf   []byte
+	timer *time.Timer // nil until the first delayed flush
+	err   error
+	stats CoalesceStats
+}
+
+// NewCoalescingWriter returns a writer coalescing writes to w, typically a
+// *TCPConn. When w has a Writev method, like TCPConn, a large write is sent
+// together with the pending batch in one call.
+func NewCoalescingWriter(w io.Writer, cfg CoalesceConfig) *CoalescingWriter {
+	cfg.setDefaults()
+	return &CoalescingWriter{w: w, cfg: cfg, buf: make([]byte, 0, cfg.MaxBatch)}
+}
+
+// Write buffers p, and sends the batch once it is full. A write of MaxBatch
+// bytes or more is sent right away with the pending batch.
+func (w *CoalescingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.stats.Writes++
+
+	if len(p) >= w.cfg.MaxBatch {
+		return w.send(p, &w.stats.FullFlushes)
+	}
+	if len(w.buf)+len(p) > w.cfg.MaxBatch {
+		if err := w.flush(&w.stats.FullFlushes); err != nil {
+			return 0, err
+		}
+	}
+	w.buf = append(w.buf, p...)
+	w.stats.Bytes += uint64(len(p))
+	if len(w.buf) >= w.cfg.MaxBatch {
+		if err := w.flush(&w.stats.FullFlushes); err != nil {
+			return len(p), err
+		}
+	} else if len(w.buf) == len(p) && w.cfg.MaxDelay > 0 {
+		w.armTimer()
+	}
+	return len(p), nil
+}
+
+// WriteNow sends the pending batch and p right away.
+func (w *CoalescingWriter) WriteNow(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.stats.Writes++
+	return w.send(p, &w.stats.ExplicitFlushes)
+}
+
+// Flush sends the pending batch.
+func (w *CoalescingWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	return w.flush(&w.stats.ExplicitFlushes)
+}
+
+// Close flushes the pending batch. Later writes fail with net.ErrClosed.
+// It does not close the underlying writer.
+func (w *CoalescingWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		if w.err == net.ErrClosed {
+			return nil
+		}
+		return w.err
+	}
+	err := w.flush(&w.stats.ExplicitFlushes)
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	if err == nil {
+		w.err = net.ErrClosed
+	}
+	return err
+}
+
+// Buffered returns the number of bytes pending.
+func (w *CoalescingWriter) Buffered() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.buf)
+}
+
+// Stats returns the batching counters.
+func (w *CoalescingWriter) Stats() CoalesceStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.stats
+}
+
+func (w *CoalescingWriter) armTimer() {
+	if w.timer == nil {
+		w.timer = time.AfterFunc(w.cfg.MaxDelay, w.delayFlush)
+		return
+	}
+	w.timer.Reset(w.cfg.MaxDelay)
+}
+
+func (w *CoalescingWriter) delayFlush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		w.flush(&w.stats.DelayFlushes)
+	}
+}
+
+// flush sends the pending batch and counts it in reason.
+func (w *CoalescingWriter) flush(reason *uint64) error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	n, err := w.w.Write(w.buf)
+	if err == nil && n < len(w.buf) {
+		err = io.ErrShortWrite
+	}
+	w.stats.Sends++
+	*reason++
+	w.buf = w.buf[:0]
+	w.err = err
+	return err
+}
+
+// send sends the pending batch followed by p and returns how much of p was
+// written.
+func (w *CoalescingWriter) send(p []byte, reason *uint64) (int, error) {
+	pending := len(w.buf)
+	if v, ok := w.w.(interface{ Writev([][]byte) (int, error) }); ok && pending > 0 && len(p) > 0 {
+		if w.timer != nil {
+			w.timer.Stop()
+		}
+		n, err := v.Writev([][]byte{w.buf, p})
+		if err == nil && n < pending+len(p) {
+			err = io.ErrShortWrite
+		}
+		w.stats.Sends++
+		*reason++
+		w.buf = w.buf[:0]
+		w.err = err
+		n = max(n-pending, 0)
+		w.stats.Bytes += uint64(n)
+		return n, err
+	}
+
+	if err := w.flush(reason); err != nil {
+		return 0, err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	n, err := w.w.Write(p)
+	if err == nil && n < len(p) {
+		err = io.ErrShortWrite
+	}
+	w.stats.Sends++
+	if pending == 0 {
+		*reason++
+	}
+	w.stats.Bytes += uint64(n)
+	w.err = err
+	return n, err
+}
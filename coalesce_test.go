@@ -0,0 +1,224 @@
+package rsocket
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sendRecorder records every write it gets as one send, or fails it with
+// fail when set.
+type sendRecorder struct {
+	mu    sync.Mutex
+	sends [][]byte
+	fail  error
+}
+
+func (r *sendRecorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.fail != nil {
+		return 0, r.fail
+	}
+	r.sends = append(r.sends, bytes.Clone(p))
+	return len(p), nil
+}
+
+func (r *sendRecorder) Sends() [][]byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sends
+}
+
+// writevRecorder is a sendRecorder with a Writev method, like TCPConn.
+type writevRecorder struct {
+	sendRecorder
+}
+
+func (r *writevRecorder) Writev(bufs [][]byte) (int, error) {
+	return r.Write(bytes.Join(bufs, nil))
+}
+
+func TestCoalescingWriterBatches(t *testing.T) {
+	var r sendRecorder
+	w := NewCoalescingWriter(&r, CoalesceConfig{MaxBatch: 64, MaxDelay: -1})
+	for _, s := range []string{"GET ", "/ ", "HTTP/1.1", "\r\n"} {
+		if n, err := w.Write([]byte(s)); n != len(s) || err != nil {
+			t.Fatalf("got %d, %v writing %q", n, err, s)
+		}
+	}
+	if n := len(r.Sends()); n != 0 {
+		t.Fatalf("got %d sends before a full batch or Flush, want 0", n)
+	}
+	if n := w.Buffered(); n != 16 {
+		t.Fatalf("got %d bytes buffered, want 16", n)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	sends := r.Sends()
+	if len(sends) != 1 || string(sends[0]) != "GET / HTTP/1.1\r\n" {
+		t.Fatalf("got sends %q, want the four writes in one", sends)
+	}
+	s := w.Stats()
+	if s.Writes != 4 || s.Bytes != 16 || s.Sends != 1 || s.ExplicitFlushes != 1 || s.WritesPerSend() != 4 || s.BytesPerSend() != 16 {
+		t.Errorf("got %+v", s)
+	}
+}
+
+func TestCoalescingWriterFullFlush(t *testing.T) {
+	var r sendRecorder
+	w := NewCoalescingWriter(&r, CoalesceConfig{MaxBatch: 16, MaxDelay: -1})
+	// the third write does not fit: the first two are sent without it, the
+	// fourth fills the batch
+	for _, s := range []string{"aaaaaa", "bbbbbb", "cccccc", "dddddddddd"} {
+		if _, err := w.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sends := r.Sends()
+	if len(sends) != 2 || string(sends[0]) != "aaaaaabbbbbb" || string(sends[1]) != "ccccccdddddddddd" {
+		t.Fatalf("got sends %q", sends)
+	}
+	if n := w.Buffered(); n != 0 {
+		t.Errorf("got %d bytes buffered after a full batch, want 0", n)
+	}
+	if s := w.Stats(); s.Sends != 2 || s.FullFlushes != 2 || s.ExplicitFlushes != 0 {
+		t.Errorf("got %+v", s)
+	}
+}
+
+func TestCoalescingWriterDelayFlush(t *testing.T) {
+	var r sendRecorder
+	w := NewCoalescingWriter(&r, CoalesceConfig{MaxBatch: 64, MaxDelay: 10 * time.Millisecond})
+	defer w.Close()
+	w.Write([]byte("ping"))
+	w.Write([]byte("pong"))
+
+	deadline := time.Now().Add(time.Second)
+	for len(r.Sends()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("batch still pending after MaxDelay")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if sends := r.Sends(); len(sends) != 1 || string(sends[0]) != "pingpong" {
+		t.Fatalf("got sends %q, want both writes in one", sends)
+	}
+	if s := w.Stats(); s.Sends != 1 || s.DelayFlushes != 1 {
+		t.Errorf("got %+v", s)
+	}
+}
+
+func TestCoalescingWriterLargeWrite(t *testing.T) {
+	large := bytes.Repeat([]byte("x"), 100)
+
+	// without Writev the pending batch goes first
+	var r sendRecorder
+	w := NewCoalescingWriter(&r, CoalesceConfig{MaxBatch: 16, MaxDelay: -1})
+	w.Write([]byte("hdr"))
+	if n, err := w.Write(large); n != len(large) || err != nil {
+		t.Fatalf("got %d, %v writing %d bytes", n, err, len(large))
+	}
+	if sends := r.Sends(); len(sends) != 2 || string(sends[0]) != "hdr" || !bytes.Equal(sends[1], large) {
+		t.Fatalf("got sends %q, want the batch then the large write", sends)
+	}
+	if s := w.Stats(); s.Writes != 2 || s.Bytes != 103 || s.Sends != 2 || s.FullFlushes != 1 {
+		t.Errorf("got %+v", s)
+	}
+
+	// with Writev both go in one call
+	var v writevRecorder
+	w = NewCoalescingWriter(&v, CoalesceConfig{MaxBatch: 16, MaxDelay: -1})
+	w.Write([]byte("hdr"))
+	if n, err := w.Write(large); n != len(large) || err != nil {
+		t.Fatalf("got %d, %v writing %d bytes", n, err, len(large))
+	}
+	if sends := v.Sends(); len(sends) != 1 || !bytes.Equal(sends[0], append([]byte("hdr"), large...)) {
+		t.Fatalf("got sends %q, want the batch and the large write in one", sends)
+	}
+	if s := w.Stats(); s.Bytes != 103 || s.Sends != 1 || s.FullFlushes != 1 {
+		t.Errorf("got %+v", s)
+	}
+
+	// WriteNow sends a small write right away
+	if _, err := w.WriteNow([]byte("now")); err != nil {
+		t.Fatal(err)
+	}
+	if sends := v.Sends(); len(sends) != 2 || string(sends[1]) != "now" {
+		t.Fatalf("got sends %q, want the WriteNow sent", sends)
+	}
+}
+
+func TestCoalescingWriterErrors(t *testing.T) {
+	boom := errors.New("boom")
+	r := sendRecorder{fail: boom}
+	w := NewCoalescingWriter(&r, CoalesceConfig{MaxBatch: 64, MaxDelay: -1})
+	if _, err := w.Write([]byte("lost")); err != nil {
+		t.Fatalf("got %v buffering a write, want no error", err)
+	}
+	if err := w.Flush(); err != boom {
+		t.Fatalf("got %v from Flush, want %v", err, boom)
+	}
+	// the error sticks
+	if _, err := w.Write([]byte("x")); err != boom {
+		t.Fatalf("got %v writing after a failed flush, want %v", err, boom)
+	}
+	if err := w.Close(); err != boom {
+		t.Fatalf("got %v from Close, want %v", err, boom)
+	}
+
+	// a short write is an error
+	w = NewCoalescingWriter(shortWriter{}, CoalesceConfig{MaxBatch: 64, MaxDelay: -1})
+	w.Write([]byte("abcd"))
+	if err := w.Close(); err != io.ErrShortWrite {
+		t.Fatalf("got %v closing over a short write, want io.ErrShortWrite", err)
+	}
+
+	// a failed delayed flush is returned by the next call
+	w = NewCoalescingWriter(&sendRecorder{fail: boom}, CoalesceConfig{MaxBatch: 64, MaxDelay: time.Millisecond})
+	w.Write([]byte("late"))
+	deadline := time.Now().Add(time.Second)
+	for w.Buffered() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("batch still pending after MaxDelay")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := w.Write([]byte("x")); err != boom {
+		t.Fatalf("got %v after a failed delayed flush, want %v", err, boom)
+	}
+}
+
+// shortWriter writes half of every buffer without an error.
+type shortWriter struct{}
+
+func (shortWriter) Write(p []byte) (int, error) { return len(p) / 2, nil }
+
+func TestCoalescingWriterClose(t *testing.T) {
+	var r sendRecorder
+	w := NewCoalescingWriter(&r, CoalesceConfig{MaxBatch: 64, MaxDelay: time.Hour})
+	w.Write([]byte("bye"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if sends := r.Sends(); len(sends) != 1 || string(sends[0]) != "bye" {
+		t.Fatalf("got sends %q, want the batch flushed by Close", sends)
+	}
+	if _, err := w.Write([]byte("x")); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("got %v writing after Close, want net.ErrClosed", err)
+	}
+	if err := w.Flush(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("got %v flushing after Close, want net.ErrClosed", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("got %v from a second Close, want nil", err)
+	}
+}
@@ -0,0 +1,268 @@
+package rsocket
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// DefaultsDir is the directory librdmacm reads the rsocket defaults from when
+// a process creates its first rsocket. Each default is a file holding a
+// single integer.
+const DefaultsDir = "/etc/rdma/rsocket"
+
+// rsSndLowat is RS_SNDLOWAT, the lowest send buffer librdmacm accepts.
+const rsSndLowat = 2048
+
+// DefaultSetting describes a file of the defaults directory.
+type DefaultSetting struct {
+	Name    string // file name, e.g. sqsize_default
+	Builtin int    // value used when the file is missing
+	Min     int
+	Max     int
+	Unit    string
+	Help    string
+}
+
+// DefaultSettings lists the files librdmacm reads from the defaults directory.
+var DefaultSettings = []DefaultSetting{
+	{"mem_default", 1 << 17, 1, math.MaxInt32, "bytes",
+		"Size of the receive buffer registered for each connection (SO_RCVBUF). Larger buffers let the peer send more before waiting for credits, at the cost of pinned memory per connection."},
+	{"wmem_default", 1 << 17, rsSndLowat, math.MaxInt32, "bytes",
+		"Size of the send buffer registered for each connection (SO_SNDBUF). Writes are copied into it before being sent with RDMA writes. librdmacm raises values below 2048 (RS_SNDLOWAT) to 4096."},
+	{"sqsize_default", 384, 1, 1<<16 - 1, "work requests",
+		"Depth of the send queue (RDMA_SQSIZE). Bounds the number of sends in flight; the device may lower it to its maximum."},
+	{"rqsize_default", 384, 1, 1<<16 - 1, "work requests",
+		"Depth of the receive queue (RDMA_RQSIZE). Bounds the number of receive credits granted to the peer; the device may lower it to its maximum."},
+	{"inline_default", 64, 0, 1<<16 - 1, "bytes",
+		"Largest send copied inline into the work request (RDMA_INLINE), which saves a DMA read for small messages. The device may lower it."},
+	{"iomap_size", 0, 0, 1<<16 - 1, "buffers",
+		"Number of buffers that can be mapped with riomap (RDMA_IOMAPSIZE). Stored on 8 bits: values up to 128 are kept, 129 to 255 become 128 and 256 to 32767 are rounded down to a multiple of 256. 0 disables riomap."},
+	{"polling_time", 10, 0, math.MaxInt32, "microseconds",
+		"Time a blocking call polls the completion queue before it waits for an event. Longer polling lowers latency and costs CPU."},
+}
+
+// LookupDefaultSetting returns the setting of the defaults file name.
+func LookupDefaultSetting(name string) (DefaultSetting, bool) {
+	i := slices.IndexFunc(DefaultSettings, func(s DefaultSetting) bool { return s.Name == name })
+	if i < 0 {
+		return DefaultSetting{}, false
+	}
+	return DefaultSettings[i], true
+}
+
+// Validate checks that value is within the range librdmacm reads for s.
+func (s DefaultSetting) Validate(value int) error {
+	if value < s.Min || value > s.Max {
+		return fmt.Errorf("rsocket: %s: %d out of range [%d, %d]", s.Name, value, s.Min, s.Max)
+	}
+	return nil
+}
+
+// Effective returns the value librdmacm uses when the file holds value.
+func (s DefaultSetting) Effective(value int) int {
+	switch s.Name {
+	case "mem_default":
+		return max(value, 1)
+	case "wmem_default":
+		if value < rsSndLowat {
+			return rsSndLowat << 1
+		}
+	case "iomap_size":
+		return int(rsScaleToValue(rsValueToScale(uint16(value), 8), 8))
+	}
+	return value
+}
+
+// rsValueToScale is rs_value_to_scale of librdmacm, which stores value on
+// bits bits: small values as is, larger ones as a count of 1<<bits units.
+func rsValueToScale(value uint16, bits uint) uint8 {
+	if value <= 1<<(bits-1) {
+		return uint8(value)
+	}
+	return uint8(1<<(bits-1) | value>>bits)
+}
+
+// rsScaleToValue is rs_scale_to_value of librdmacm, the inverse of
+// rsValueToScale.
+func rsScaleToValue(value uint8, bits uint) uint16 {
+	if value <= 1<<(bits-1) {
+		return uint16(value)
+	}
+	return uint16(value&^(1<<(bits-1))) << bits
+}
+
+// Defaults holds the values of a defaults directory.
+type Defaults struct {
+	Dir string
+	// Values maps the name of each file present to its value.
+	Values map[string]int
+	// Errors maps the name of each file that could not be read or parsed
+	// to the error.
+	Errors map[string]error
+}
+
+// ReadDefaults reads the known files of dir, DefaultsDir if empty. Missing
+// files and a missing dir are not errors, librdmacm uses its builtin values
+// then.
+func ReadDefaults(dir string) (*Defaults, error) {
+	if dir == "" {
+		dir = DefaultsDir
+	}
+	d := &Defaults{Dir: dir, Values: make(map[string]int)}
+	if _, err := os.Stat(dir); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, s := range DefaultSettings {
+		b, err := os.ReadFile(filepath.Join(dir, s.Name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err == nil {
+			var v int
+			v, err = strconv.Atoi(strings.TrimSpace(string(b)))
+			if err == nil {
+				d.Values[s.Name] = v
+				continue
+			}
+		}
+		if d.Errors == nil {
+			d.Errors = make(map[string]error)
+		}
+		d.Errors[s.Name] = err
+	}
+	return d, nil
+}
+
+// Get returns the value of the file name and whether it is set, or the
+// builtin value if it is not.
+func (d *Defaults) Get(name string) (int, bool) {
+	if v, ok := d.Values[name]; ok {
+		return v, true
+	}
+	s, _ := LookupDefaultSetting(name)
+	return s.Builtin, false
+}
+
+// Effective returns the value librdmacm uses for name.
+func (d *Defaults) Effective(name string) int {
+	s, _ := LookupDefaultSetting(name)
+	v, _ := d.Get(name)
+	return s.Effective(v)
+}
+
+// Validate returns the read errors and out of range values of d, joined.
+func (d *Defaults) Validate() error {
+	var errs []error
+	for _, s := range DefaultSettings {
+		if err := d.Errors[s.Name]; err != nil {
+			errs = append(errs, fmt.Errorf("rsocket: %s: %w", s.Name, err))
+		} else if v, ok := d.Values[s.Name]; ok {
+			errs = append(errs, s.Validate(v))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// WriteDefault validates value and writes it to the file name of dir,
+// DefaultsDir if empty. The file is replaced atomically so that a process
+// starting concurrently reads either the old or the new value.
+func WriteDefault(dir, name string, value int) error {
+	s, ok := LookupDefaultSetting(name)
+	if !ok {
+		return fmt.Errorf("rsocket: unknown default %q", name)
+	}
+	if err := s.Validate(value); err != nil {
+		return err
+	}
+	if dir == "" {
+		dir = DefaultsDir
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(dir, "."+name+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(strconv.Itoa(value) + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0o644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(dir, name))
+}
+
+// RemoveDefault removes the file name of dir, DefaultsDir if empty, so that
+// librdmacm uses its builtin value.
+func RemoveDefault(dir, name string) error {
+	if _, ok := LookupDefaultSetting(name); !ok {
+		return fmt.Errorf("rsocket: unknown default %q", name)
+	}
+	if dir == "" {
+		dir = DefaultsDir
+	}
+	err := os.Remove(filepath.Join(dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// DefaultDiff compares a default with the value a connection reports.
+type DefaultDiff struct {
+	Name     string
+	Expected int // the effective default
+	Actual   int
+	Err      error // set if the connection did not report the value
+}
+
+// Match reports whether the connection uses the default.
+func (d DefaultDiff) Match() bool {
+	return d.Err == nil && d.Expected == d.Actual
+}
+
+// Compare compares the defaults with the values reported by info, e.g. from
+// TCPConn.Info. A mismatch is expected when the connection was tuned with
+// options, the device capped a value, or the process read the defaults
+// before they were changed. polling_time is not reported and is skipped.
+func (d *Defaults) Compare(info ConnInfo) []DefaultDiff {
+	fields := []struct {
+		name, field string
+		actual      int
+	}{
+		{"mem_default", "RecvBuffer", info.RecvBuffer},
+		{"wmem_default", "SendBuffer", info.SendBuffer},
+		{"sqsize_default", "SQSize", info.SQSize},
+		{"rqsize_default", "RQSize", info.RQSize},
+		{"inline_default", "Inline", info.Inline},
+		{"iomap_size", "IOMapSize", info.IOMapSize},
+	}
+	diffs := make([]DefaultDiff, len(fields))
+	for i, f := range fields {
+		diffs[i] = DefaultDiff{
+			Name:     f.name,
+			Expected: d.Effective(f.name),
+			Actual:   f.actual,
+			Err:      info.Errors[f.field],
+		}
+	}
+	return diffs
+}
@@ -0,0 +1,97 @@
+package rsocket
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDefaultsReadWrite(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "rsocket")
+
+	// a missing directory means the builtin values
+	d, err := ReadDefaults(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := d.Get("sqsize_default"); ok || v != 384 {
+		t.Fatalf("got sqsize_default %d, %v without a directory, want the builtin 384", v, ok)
+	}
+
+	if err := WriteDefault(dir, "wmem_default", rsSndLowat); err != nil {
+		t.Fatalf("writing wmem_default %d: %v", rsSndLowat, err)
+	}
+	if err := WriteDefault(dir, "wmem_default", rsSndLowat-1); err == nil {
+		t.Fatalf("got no error writing wmem_default %d", rsSndLowat-1)
+	}
+	if err := WriteDefault(dir, "sqsize_default", 1024); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteDefault(dir, "no_such_default", 1); err == nil {
+		t.Fatal("got no error writing an unknown default")
+	}
+	if err := os.WriteFile(filepath.Join(dir, "rqsize_default"), []byte("many\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err = ReadDefaults(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := d.Get("wmem_default"); !ok || v != rsSndLowat {
+		t.Errorf("got wmem_default %d, %v, want %d", v, ok, rsSndLowat)
+	}
+	if v := d.Effective("wmem_default"); v != rsSndLowat {
+		t.Errorf("got effective wmem_default %d, want %d", v, rsSndLowat)
+	}
+	if v, ok := d.Get("sqsize_default"); !ok || v != 1024 {
+		t.Errorf("got sqsize_default %d, %v, want 1024", v, ok)
+	}
+	if d.Errors["rqsize_default"] == nil || d.Validate() == nil {
+		t.Errorf("got no error for an unparsable rqsize_default")
+	}
+
+	if err := RemoveDefault(dir, "sqsize_default"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveDefault(dir, "sqsize_default"); err != nil {
+		t.Fatalf("removing a missing file: %v", err)
+	}
+	d, _ = ReadDefaults(dir)
+	if v, ok := d.Get("sqsize_default"); ok || v != 384 {
+		t.Errorf("got sqsize_default %d, %v after removing it, want the builtin 384", v, ok)
+	}
+}
+
+func TestDefaultSettingEffective(t *testing.T) {
+	tests := []struct {
+		name        string
+		value, want int
+	}{
+		{"wmem_default", 1, 2 * rsSndLowat},
+		{"wmem_default", rsSndLowat - 1, 2 * rsSndLowat},
+		{"wmem_default", rsSndLowat, rsSndLowat},
+		{"mem_default", 0, 1},
+		{"iomap_size", 0, 0},
+		{"iomap_size", 100, 100},
+		{"iomap_size", 128, 128},
+		{"iomap_size", 129, 128},
+		{"iomap_size", 200, 128},
+		{"iomap_size", 255, 128},
+		{"iomap_size", 256, 256},
+		{"iomap_size", 1000, 768},
+		{"iomap_size", 32767, 32512},
+		{"iomap_size", 32768, 128},
+		{"iomap_size", 65535, 32512},
+		{"sqsize_default", 10, 10},
+	}
+	for _, tt := range tests {
+		s, ok := LookupDefaultSetting(tt.name)
+		if !ok {
+			t.Fatalf("no setting %s", tt.name)
+		}
+		if got := s.Effective(tt.value); got != tt.want {
+			t.Errorf("%s %d: got effective %d, want %d", tt.name, tt.value, got, tt.want)
+		}
+	}
+}
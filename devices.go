@@ -0,0 +1,272 @@
+package rsocket
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Device is an RDMA device found in sysfs.
+type Device struct {
+	Name      string // e.g. mlx5_0
+	NodeType  string // e.g. CA
+	NodeGUID  string
+	FWVersion string
+	NUMANode  int // -1 if unknown
+	Ports     []DevicePort
+	Netdevs   []Netdev
+}
+
+// DevicePort is a port of an RDMA device.
+type DevicePort struct {
+	Number    int
+	State     string  // e.g. ACTIVE, DOWN
+	PhysState string  // e.g. LinkUp, Disabled
+	Rate      string  // e.g. "100 Gb/sec (4X EDR)"
+	RateGbps  float64 // 0 if the rate could not be parsed
+	LinkLayer string  // InfiniBand or Ethernet
+	LID       uint16  // 0 on RoCE ports
+	GIDs      []GID
+}
+
+// GID is a valid entry of a port's GID table.
+type GID struct {
+	Index  int
+	GID    net.IP
+	Type   string // e.g. "IB/RoCE v1" or "RoCE v2", empty on InfiniBand
+	Netdev string // the network device of a RoCE GID
+}
+
+// Netdev is a network device associated with an RDMA device.
+type Netdev struct {
+	Name string
+	IPs  []net.IP
+}
+
+// IsRoCE reports whether the port runs over Ethernet.
+func (p *DevicePort) IsRoCE() bool {
+	return p.LinkLayer == "Ethernet"
+}
+
+// Active reports whether the port is up.
+func (p *DevicePort) Active() bool {
+	return p.State == "ACTIVE"
+}
+
+// LocalIP returns an address to bind to, e.g. with WithLocalAddr, so that
+// connections use this device: the first IPv4 address of its network
+// devices, or else the first IPv6 one. It returns nil if the device has no
+// active port or no address.
+func (d *Device) LocalIP() net.IP {
+	if !slices.ContainsFunc(d.Ports, func(p DevicePort) bool { return p.Active() }) {
+		return nil
+	}
+	var v6 net.IP
+	for _, nd := range d.Netdevs {
+		for _, ip := range nd.IPs {
+			if ip.To4() != nil {
+				return ip
+			}
+			if v6 == nil {
+				v6 = ip
+			}
+		}
+	}
+	return v6
+}
+
+// Devices returns the RDMA devices of the host, read from /sys/class/infiniband
+// and /sys/class/net, with the addresses of the live network interfaces. It
+// returns no devices and no error if there is no RDMA support.
+func Devices() ([]Device, error) {
+	return DevicesFrom("/sys", InterfaceAddrs)
+}
+
+// DevicesFrom is like Devices but reads the sysfs tree mounted at root, e.g.
+// a test fixture, and gets the addresses of network devices from addrs.
+// sysfs does not hold addresses, so with a nil addrs only those encoded in
+// RoCE v2 GIDs are found.
+func DevicesFrom(root string, addrs func(netdev string) []net.IP) ([]Device, error) {
+	classDir := filepath.Join(root, "class", "infiniband")
+	entries, err := os.ReadDir(classDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	netdevs := netdevsByDevice(root)
+	var devices []Device
+	for _, entry := range entries {
+		dev, err := readDevice(filepath.Join(classDir, entry.Name()), entry.Name(), netdevs, addrs)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, dev)
+	}
+	return devices, nil
+}
+
+// InterfaceAddrs returns the addresses of the live network interface name,
+// nil if it does not exist.
+func InterfaceAddrs(name string) []net.IP {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil
+	}
+	addrs, _ := ifi.Addrs()
+	var ips []net.IP
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			ips = append(ips, ipnet.IP)
+		}
+	}
+	return ips
+}
+
+// netdevsByDevice maps the device, e.g. the PCI function, of every network
+// device in root/class/net to their names. Virtual devices have none.
+func netdevsByDevice(root string) map[string][]string {
+	dir := filepath.Join(root, "class", "net")
+	entries, _ := os.ReadDir(dir)
+	netdevs := make(map[string][]string)
+	for _, entry := range entries {
+		device, err := filepath.EvalSymlinks(filepath.Join(dir, entry.Name(), "device"))
+		if err != nil {
+			continue
+		}
+		netdevs[device] = append(netdevs[device], entry.Name())
+	}
+	return netdevs
+}
+
+func readDevice(dir, name string, netdevs map[string][]string, addrs func(string) []net.IP) (Device, error) {
+	dev := Device{
+		Name:      name,
+		NodeType:  afterColon(readSysfs(dir, "node_type")),
+		NodeGUID:  readSysfs(dir, "node_guid"),
+		FWVersion: readSysfs(dir, "fw_ver"),
+		NUMANode:  -1,
+	}
+	if n, err := strconv.Atoi(readSysfs(dir, "device", "numa_node")); err == nil {
+		dev.NUMANode = n
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dir, "ports"))
+	if err != nil && !os.IsNotExist(err) {
+		return dev, err
+	}
+	for _, entry := range entries {
+		number, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		dev.Ports = append(dev.Ports, readPort(filepath.Join(dir, "ports", entry.Name()), number))
+	}
+	slices.SortFunc(dev.Ports, func(a, b DevicePort) int { return a.Number - b.Number })
+
+	// network devices of the same PCI function, e.g. ib0 or the Ethernet
+	// port, and those RoCE GIDs are bound to, e.g. VLANs and bonds
+	var names []string
+	if device, err := filepath.EvalSymlinks(filepath.Join(dir, "device")); err == nil {
+		names = append(names, netdevs[device]...)
+	}
+	for _, port := range dev.Ports {
+		for _, gid := range port.GIDs {
+			if gid.Netdev != "" {
+				names = append(names, gid.Netdev)
+			}
+		}
+	}
+	slices.Sort(names)
+	for _, name := range slices.Compact(names) {
+		dev.Netdevs = append(dev.Netdevs, Netdev{Name: name, IPs: netdevIPs(name, dev.Ports, addrs)})
+	}
+	return dev, nil
+}
+
+func readPort(dir string, number int) DevicePort {
+	port := DevicePort{
+		Number:    number,
+		State:     afterColon(readSysfs(dir, "state")),
+		PhysState: afterColon(readSysfs(dir, "phys_state")),
+		Rate:      readSysfs(dir, "rate"),
+		LinkLayer: readSysfs(dir, "link_layer"),
+	}
+	if f := strings.Fields(port.Rate); len(f) > 0 {
+		port.RateGbps, _ = strconv.ParseFloat(f[0], 64)
+	}
+	if lid, err := strconv.ParseUint(readSysfs(dir, "lid"), 0, 16); err == nil {
+		port.LID = uint16(lid)
+	}
+
+	entries, _ := os.ReadDir(filepath.Join(dir, "gids"))
+	for _, entry := range entries {
+		index, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		// unused entries are all zeros, or fail to read on RoCE ports
+		ip := net.ParseIP(readSysfs(dir, "gids", entry.Name()))
+		if ip == nil || ip.IsUnspecified() {
+			continue
+		}
+		port.GIDs = append(port.GIDs, GID{
+			Index:  index,
+			GID:    ip,
+			Type:   readSysfs(dir, "gid_attrs", "types", entry.Name()),
+			Netdev: readSysfs(dir, "gid_attrs", "ndevs", entry.Name()),
+		})
+	}
+	slices.SortFunc(port.GIDs, func(a, b GID) int { return a.Index - b.Index })
+	return port
+}
+
+// netdevIPs returns the addresses of the network device name: those from
+// addrs, if not nil, and those encoded in RoCE v2 GIDs.
+func netdevIPs(name string, ports []DevicePort, addrs func(string) []net.IP) []net.IP {
+	var ips []net.IP
+	add := func(ip net.IP) {
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		if !slices.ContainsFunc(ips, ip.Equal) {
+			ips = append(ips, ip)
+		}
+	}
+
+	if addrs != nil {
+		for _, ip := range addrs(name) {
+			add(ip)
+		}
+	}
+	for _, port := range ports {
+		for _, gid := range port.GIDs {
+			if gid.Netdev == name && gid.Type == "RoCE v2" && !gid.GID.IsLinkLocalUnicast() {
+				add(gid.GID)
+			}
+		}
+	}
+	return ips
+}
+
+// readSysfs returns the trimmed content of a sysfs attribute, or "".
+func readSysfs(elem ...string) string {
+	b, err := os.ReadFile(filepath.Join(elem...))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// afterColon strips the numeric prefix of values like "4: ACTIVE".
+func afterColon(s string) string {
+	if _, after, ok := strings.Cut(s, ":"); ok {
+		return strings.TrimSpace(after)
+	}
+	return s
+}
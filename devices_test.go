@@ -0,0 +1,104 @@
+package rsocket
+
+import (
+	"net"
+	"testing"
+)
+
+func TestDevicesFrom(t *testing.T) {
+	addrs := func(netdev string) []net.IP {
+		switch netdev {
+		case "ens1f0":
+			return []net.IP{net.ParseIP("fe80::bace:f6ff:fea1:2b3c"), net.ParseIP("2001:db8::10")}
+		case "ib0":
+			return []net.IP{net.ParseIP("10.0.0.5")}
+		}
+		return nil
+	}
+	devices, err := DevicesFrom("testdata/sysfs", addrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2 {
+		t.Fatalf("got %d devices, want 2", len(devices))
+	}
+
+	roce := devices[0]
+	if roce.Name != "mlx5_0" || roce.NodeType != "CA" || roce.FWVersion != "22.36.1010" || roce.NUMANode != 0 {
+		t.Errorf("mlx5_0: got %+v", roce)
+	}
+	if len(roce.Ports) != 1 {
+		t.Fatalf("mlx5_0: got %d ports, want 1", len(roce.Ports))
+	}
+	port := roce.Ports[0]
+	if !port.Active() || !port.IsRoCE() || port.PhysState != "LinkUp" || port.RateGbps != 100 || port.LID != 0 {
+		t.Errorf("mlx5_0 port: got %+v", port)
+	}
+	// the all-zero entry 4 is unused
+	if len(port.GIDs) != 4 {
+		t.Fatalf("mlx5_0 port: got %d GIDs, want 4", len(port.GIDs))
+	}
+	if gid := port.GIDs[3]; gid.Index != 3 || gid.Type != "RoCE v2" || gid.Netdev != "ens1f0.100" {
+		t.Errorf("mlx5_0 GID 3: got %+v", gid)
+	}
+	// ens1f0 shares the PCI function, the VLAN only appears in GIDs, lo in
+	// class/net belongs to neither
+	wantNetdevs := map[string][]string{
+		"ens1f0":     {"fe80::bace:f6ff:fea1:2b3c", "2001:db8::10"},
+		"ens1f0.100": {"192.168.100.10"},
+	}
+	checkNetdevs(t, roce, wantNetdevs)
+	if ip := roce.LocalIP(); !ip.Equal(net.ParseIP("192.168.100.10")) {
+		t.Errorf("mlx5_0: got local IP %v, want 192.168.100.10", ip)
+	}
+
+	ib := devices[1]
+	if ib.Name != "mlx5_1" || ib.NUMANode != 1 || len(ib.Ports) != 1 {
+		t.Fatalf("mlx5_1: got %+v", ib)
+	}
+	if port := ib.Ports[0]; port.Active() || port.IsRoCE() || port.LID != 0x12 || port.RateGbps != 10 || len(port.GIDs) != 1 {
+		t.Errorf("mlx5_1 port: got %+v", port)
+	}
+	checkNetdevs(t, ib, map[string][]string{"ib0": {"10.0.0.5"}})
+	if ip := ib.LocalIP(); ip != nil {
+		t.Errorf("mlx5_1: got local IP %v with the port down, want nil", ip)
+	}
+}
+
+func TestDevicesFromNoLookup(t *testing.T) {
+	devices, err := DevicesFrom("testdata/sysfs", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the addresses of RoCE v2 GIDs, link-local ones left out
+	checkNetdevs(t, devices[0], map[string][]string{"ens1f0": nil, "ens1f0.100": {"192.168.100.10"}})
+	checkNetdevs(t, devices[1], map[string][]string{"ib0": nil})
+}
+
+func TestDevicesFromNoRDMA(t *testing.T) {
+	devices, err := DevicesFrom(t.TempDir(), nil)
+	if err != nil || devices != nil {
+		t.Fatalf("got %v, %v without class/infiniband, want no devices and no error", devices, err)
+	}
+}
+
+func checkNetdevs(t *testing.T, dev Device, want map[string][]string) {
+	t.Helper()
+	if len(dev.Netdevs) != len(want) {
+		t.Errorf("%s: got netdevs %+v, want %d", dev.Name, dev.Netdevs, len(want))
+		return
+	}
+	for _, nd := range dev.Netdevs {
+		ips, ok := want[nd.Name]
+		if !ok || len(nd.IPs) != len(ips) {
+			t.Errorf("%s: got netdev %s with %v, want %v", dev.Name, nd.Name, nd.IPs, ips)
+			continue
+		}
+		for i, ip := range ips {
+			if !nd.IPs[i].Equal(net.ParseIP(ip)) {
+				t.Errorf("%s: got netdev %s with %v, want %v", dev.Name, nd.Name, nd.IPs, ips)
+				break
+			}
+		}
+	}
+}
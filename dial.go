@@ -0,0 +1,369 @@
+package rsocket
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Dialer dials rsocket connections. It resolves every address of a host and
+// tries them in order, or all at once, so that a host with addresses on
+// several fabric rails is reachable while one of them is down.
+// The zero value dials like DialTCP.
+type Dialer struct {
+	// Timeout bounds the whole dial, resolution included. With several
+	// addresses, each sequential attempt gets a share of what remains, as
+	// with net.Dialer. Zero means no timeout besides the context's.
+	Timeout time.Duration
+	// Parallel dials all addresses at once and keeps the first connection
+	// established, instead of trying them in order.
+	Parallel bool
+	// Resolver resolves host names, default is net.DefaultResolver.
+	Resolver *net.Resolver
+	// Options are applied to the socket of every attempt.
+	Options []OptionSocketFn
+}
+
+// DialError is returned when a dial tried several addresses and none of them
+// could be connected. A dial with a single address returns its error as is.
+type DialError struct {
+	Address  string
+	Attempts []DialAttempt
+}
+
+// DialAttempt is a failed attempt of a dial.
+type DialAttempt struct {
+	Addr *net.TCPAddr
+	Err  error
+}
+
+func (e *DialError) Error() string {
+	var b strings.Builder
+	b.WriteString("rsocket: dial ")
+	b.WriteString(e.Address)
+	for i, a := range e.Attempts {
+		if i == 0 {
+			b.WriteString(": ")
+		} else {
+			b.WriteString("; ")
+		}
+		b.WriteString(a.Addr.String())
+		b.WriteString(": ")
+		b.WriteString(a.Err.Error())
+	}
+	return b.String()
+}
+
+// Unwrap returns the errors of the attempts, for errors.Is and errors.As.
+func (e *DialError) Unwrap() []error {
+	errs := make([]error, len(e.Attempts))
+	for i, a := range e.Attempts {
+		errs[i] = a.Err
+	}
+	return errs
+}
+
+// Dial connects to address on network, which is "tcp", "tcp4" or "tcp6".
+// The returned connection is a *TCPConn.
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext is like Dial but gives up when ctx is done and reports the
+// stages of the dial to the ConnTrace of ctx, if any.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.dialTCP(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (d *Dialer) dialTCP(ctx context.Context, network, address string) (*TCPConn, error) {
+	start := time.Now()
+	conn, err := d.dial(ctx, network, address)
+	recordDial(start, err)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (d *Dialer) dial(ctx context.Context, network, address string) (*TCPConn, error) {
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+
+	trace := ContextConnTrace(ctx)
+	trace.dnsStart(address)
+	start := trace.now()
+	addrs, err := d.resolve(ctx, network, address)
+	var first *net.TCPAddr
+	if len(addrs) > 0 {
+		first = addrs[0]
+	}
+	trace.dnsDone(first, err, start)
+	if err != nil {
+		if logger := loggerOr(nil); debugEnabled(logger) {
+			logDebug(logger, "rsocket: resolve", appendErr([]slog.Attr{slog.String("address", address)}, err)...)
+		}
+		return nil, err
+	}
+
+	if d.Parallel && len(addrs) > 1 {
+		return d.dialParallel(ctx, address, addrs)
+	}
+	return d.dialSerial(ctx, address, addrs)
+}
+
+// resolve returns all addresses of address usable on network, in the order
+// of the resolver.
+func (d *Dialer) resolve(ctx context.Context, network, address string) ([]*net.TCPAddr, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+	host, service, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	port, err := resolver.LookupPort(ctx, "tcp", service)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" {
+		return []*net.TCPAddr{{IP: net.IPv4(127, 0, 0, 1), Port: port}}, nil
+	}
+	ips, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []*net.TCPAddr
+	for _, ip := range ips {
+		is4 := ip.IP.To4() != nil
+		if network == "tcp4" && !is4 || network == "tcp6" && is4 {
+			continue
+		}
+		addrs = append(addrs, &net.TCPAddr{IP: ip.IP, Port: port, Zone: ip.Zone})
+	}
+	if len(addrs) == 0 {
+		return nil, &net.AddrError{Err: "no suitable address found", Addr: host}
+	}
+	return addrs, nil
+}
+
+func (d *Dialer) dialSerial(ctx context.Context, address string, addrs []*net.TCPAddr) (*TCPConn, error) {
+	var attempts []DialAttempt
+	for i, addr := range addrs {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if deadline, ok := ctx.Deadline(); ok && len(addrs)-i > 1 {
+			attemptCtx, cancel = context.WithDeadline(ctx, partialDeadline(time.Now(), deadline, len(addrs)-i))
+		}
+		conn, err := d.dialAddr(attemptCtx, addr)
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+		attempts = append(attempts, DialAttempt{Addr: addr, Err: err})
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, dialError(address, attempts)
+}
+
+func (d *Dialer) dialParallel(ctx context.Context, address string, addrs []*net.TCPAddr) (*TCPConn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		i    int
+		conn *TCPConn
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	for i, addr := range addrs {
+		go func() {
+			conn, err := d.dialAddr(ctx, addr)
+			results <- result{i, conn, err}
+		}()
+	}
+
+	errs := make([]error, len(addrs))
+	for n := range addrs {
+		r := <-results
+		if r.err == nil {
+			// the other attempts are canceled, close those that won anyway
+			go func(remaining int) {
+				for ; remaining > 0; remaining-- {
+					if r := <-results; r.err == nil {
+						r.conn.Close()
+					}
+				}
+			}(len(addrs) - n - 1)
+			return r.conn, nil
+		}
+		errs[r.i] = r.err
+	}
+
+	attempts := make([]DialAttempt, len(addrs))
+	for i, addr := range addrs {
+		attempts[i] = DialAttempt{Addr: addr, Err: errs[i]}
+	}
+	return nil, dialError(address, attempts)
+}
+
+func dialError(address string, attempts []DialAttempt) error {
+	if len(attempts) == 1 {
+		return attempts[0].Err
+	}
+	return &DialError{Address: address, Attempts: attempts}
+}
+
+// partialDeadline returns the deadline of one of addrsRemaining sequential
+// attempts, which share what remains until deadline like in net.Dialer.
+func partialDeadline(now, deadline time.Time, addrsRemaining int) time.Time {
+	remaining := deadline.Sub(now)
+	timeout := remaining / time.Duration(addrsRemaining)
+	// do not give an attempt less than 2s, if there is that much left
+	const saneMinimum = 2 * time.Second
+	if timeout < saneMinimum {
+		timeout = min(remaining, saneMinimum)
+	}
+	return now.Add(timeout)
+}
+
+// dialAddr creates a socket and connects it to addr.
+func (d *Dialer) dialAddr(ctx context.Context, addr *net.TCPAddr) (*TCPConn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	family, sa := AF_INET, syscall.Sockaddr(nil)
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		sa4 := &syscall.SockaddrInet4{Port: addr.Port}
+		copy(sa4.Addr[:], ip4)
+		sa = sa4
+	} else {
+		sa6 := &syscall.SockaddrInet6{Port: addr.Port}
+		copy(sa6.Addr[:], addr.IP.To16())
+		if addr.Zone != "" {
+			if ifi, err := net.InterfaceByName(addr.Zone); err == nil {
+				sa6.ZoneId = uint32(ifi.Index)
+			}
+		}
+		family, sa = AF_INET6, sa6
+	}
+
+	setup := &socketSetup{trace: ContextConnTrace(ctx)}
+	fd, err := newSocket(setup, family, SOCK_STREAM, d.Options)
+	if err != nil {
+		return nil, err
+	}
+	trace, logger := setup.trace, loggerOr(setup.logger)
+	if err := setup.runStage(fd, StagePreConnect); err != nil {
+		Close(fd)
+		return nil, err
+	}
+
+	trace.connectStart(fd, addr)
+	start := trace.now()
+	err = connectContext(ctx, fd, sa, setup.nonblock)
+	trace.connectDone(fd, addr, err, start)
+	if debugEnabled(logger) {
+		logDebug(logger, "rsocket: connect", appendErr([]slog.Attr{slog.Int("fd", fd), addrAttr("remote", addr)}, err)...)
+	}
+	if err == nil {
+		err = setup.runStage(fd, StagePostAccept)
+	}
+	if err != nil {
+		Close(fd)
+		return nil, err
+	}
+
+	conn := &TCPConn{
+		created:    time.Now(),
+		fd:         fd,
+		remoteAddr: addr,
+		trace:      trace,
+		logger:     setup.logger,
+		pool:       setup.pool,
+	}
+	metrics.active.Add(1)
+	if setup.capture != nil {
+		conn.SetCapture(setup.capture)
+	}
+	return conn, nil
+}
+
+// connectContext connects fd to sa. If ctx can be canceled the connect is
+// made nonblocking so that it can be abandoned. A socket in nonblocking
+// mode is left connecting when ctx cannot be canceled, see WaitConnect.
+func connectContext(ctx context.Context, fd int, sa syscall.Sockaddr, nonblock bool) error {
+	if ctx.Done() == nil {
+		err := Connect(fd, sa)
+		if err == syscall.EINPROGRESS && nonblock {
+			err = nil
+		}
+		return err
+	}
+
+	if !nonblock {
+		if err := SetNonblock(fd, true); err != nil {
+			return err
+		}
+	}
+	err := Connect(fd, sa)
+	if err == syscall.EINPROGRESS {
+		err = waitConnect(ctx, fd)
+	}
+	if err == nil && !nonblock {
+		err = SetNonblock(fd, false)
+	}
+	return err
+}
+
+// waitConnect waits for the nonblocking connect of fd to complete and
+// returns its SO_ERROR, or ctx.Err() if ctx is done first.
+func waitConnect(ctx context.Context, fd int) error {
+	pfd := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLOUT}}
+	for {
+		// wake up regularly to notice cancellation
+		ms := 100
+		if deadline, ok := ctx.Deadline(); ok {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				return context.DeadlineExceeded
+			}
+			ms = min(ms, int((remaining+time.Millisecond-1)/time.Millisecond))
+		}
+
+		n, err := Poll(pfd, ms)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return GetSocketError(fd)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
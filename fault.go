@@ -0,0 +1,318 @@
+package rsocket
+
+import (
+	"context"
+	"io"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// FaultOp is an operation a fault is injected into.
+type FaultOp int
+
+const (
+	FaultRead FaultOp = iota
+	FaultWrite
+	FaultAccept
+	FaultDial
+	numFaultOps
+)
+
+func (op FaultOp) String() string {
+	switch op {
+	case FaultRead:
+		return "read"
+	case FaultWrite:
+		return "write"
+	case FaultAccept:
+		return "accept"
+	case FaultDial:
+		return "dial"
+	default:
+		return "unknown"
+	}
+}
+
+// Fault describes a fault to inject into an operation. Operations are counted
+// per connection for reads and writes, and per FaultInjector for accepts and
+// dials. For example the fourth write of every connection is reset with
+//
+//	Fault{Op: FaultWrite, After: 3, Count: 1, Err: syscall.ECONNRESET, Break: true}
+//
+// and a connect timeout is
+//
+//	Fault{Op: FaultDial, Probability: 0.1, Delay: time.Second, Err: os.ErrDeadlineExceeded}
+type Fault struct {
+	Op FaultOp
+	// Probability is the chance that the fault fires on an operation,
+	// 0 means always.
+	Probability float64
+	// After skips the first After operations.
+	After int
+	// Count limits the number of times the fault fires, 0 means no limit.
+	Count int
+
+	// Delay, plus a random duration up to Jitter, is waited before the
+	// operation.
+	Delay  time.Duration
+	Jitter time.Duration
+	// Short makes a read or write transfer only part of the buffer. A short
+	// write returns io.ErrShortWrite unless Err is set.
+	Short bool
+	// Err fails the operation, after the partial transfer if Short is set.
+	Err error
+	// Break shuts the connection down after the operation and fails every
+	// later read and write with Err, or ECONNRESET if Err is nil. The
+	// connection is still closed by its owner's Close.
+	Break bool
+}
+
+// FaultStats counts the faults fired per operation.
+type FaultStats struct {
+	Reads   uint64
+	Writes  uint64
+	Accepts uint64
+	Dials   uint64
+}
+
+// FaultInjector injects faults into the connections, listeners and dialers
+// it wraps. Its random choices derive from a seed: given the same seed and
+// the same sequence of operations, the same faults fire. Each wrapped
+// connection gets its own random source, so that the faults of a connection
+// do not depend on the scheduling of the others.
+type FaultInjector struct {
+	state *faultState // accepts and dials
+	stats [numFaultOps]atomic.Uint64
+}
+
+// NewFaultInjector returns an injector of faults seeded with seed.
+func NewFaultInjector(seed uint64, faults ...Fault) *FaultInjector {
+	return &FaultInjector{state: newFaultState(rand.New(rand.NewPCG(seed, seed)), faults)}
+}
+
+// Stats returns the number of faults fired so far.
+func (f *FaultInjector) Stats() FaultStats {
+	return FaultStats{
+		Reads:   f.stats[FaultRead].Load(),
+		Writes:  f.stats[FaultWrite].Load(),
+		Accepts: f.stats[FaultAccept].Load(),
+		Dials:   f.stats[FaultDial].Load(),
+	}
+}
+
+// WrapConn returns c with the read and write faults of f.
+func (f *FaultInjector) WrapConn(c net.Conn) *FaultConn {
+	s := f.state
+	s.mu.Lock()
+	rng := rand.New(rand.NewPCG(s.rng.Uint64(), s.rng.Uint64()))
+	s.mu.Unlock()
+	return &FaultConn{Conn: c, injector: f, state: newFaultState(rng, s.faults)}
+}
+
+// WrapListener returns l with the accept faults of f. Accepted connections
+// are wrapped with WrapConn.
+func (f *FaultInjector) WrapListener(l net.Listener) *FaultListener {
+	return &FaultListener{Listener: l, injector: f}
+}
+
+// WrapDialer returns d, a new Dialer if nil, with the dial faults of f.
+// Dialed connections are wrapped with WrapConn.
+func (f *FaultInjector) WrapDialer(d *Dialer) *FaultDialer {
+	if d == nil {
+		d = &Dialer{}
+	}
+	return &FaultDialer{Dialer: d, injector: f}
+}
+
+// inject decides the faults of the next op of s and waits their delay.
+func (f *FaultInjector) inject(ctx context.Context, s *faultState, op FaultOp) faultAction {
+	a := s.next(op)
+	if !a.fired {
+		return a
+	}
+	f.stats[op].Add(1)
+	if a.delay > 0 {
+		t := time.NewTimer(a.delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+		}
+	}
+	return a
+}
+
+// faultState holds the random source and counters of a set of faults.
+type faultState struct {
+	mu       sync.Mutex
+	rng      *rand.Rand
+	faults   []Fault
+	ops      [numFaultOps]int
+	injected []int // per fault
+}
+
+func newFaultState(rng *rand.Rand, faults []Fault) *faultState {
+	return &faultState{rng: rng, faults: faults, injected: make([]int, len(faults))}
+}
+
+// faultAction is the combined effect of the faults fired on an operation.
+type faultAction struct {
+	fired bool
+	delay time.Duration
+	short bool
+	err   error
+	brk   bool
+}
+
+func (s *faultState) next(op FaultOp) faultAction {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ops[op]++
+	var a faultAction
+	for i, fault := range s.faults {
+		if fault.Op != op || s.ops[op] <= fault.After {
+			continue
+		}
+		if fault.Count > 0 && s.injected[i] >= fault.Count {
+			continue
+		}
+		if fault.Probability > 0 && s.rng.Float64() >= fault.Probability {
+			continue
+		}
+		s.injected[i]++
+		a.fired = true
+		a.delay += fault.Delay
+		if fault.Jitter > 0 {
+			a.delay += time.Duration(s.rng.Int64N(int64(fault.Jitter)))
+		}
+		a.short = a.short || fault.Short
+		if a.err == nil {
+			a.err = fault.Err
+		}
+		a.brk = a.brk || fault.Break
+	}
+	return a
+}
+
+// shortLen returns a random length in [1, n) for a partial transfer of n bytes.
+func (s *faultState) shortLen(n int) int {
+	if n <= 1 {
+		return n
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return 1 + s.rng.IntN(n-1)
+}
+
+// FaultConn is a connection with injected read and write faults.
+type FaultConn struct {
+	net.Conn
+	injector *FaultInjector
+	state    *faultState
+	broken   atomic.Pointer[error]
+}
+
+// Read reads from the connection, unless a fault fires.
+func (c *FaultConn) Read(p []byte) (int, error) {
+	return c.do(FaultRead, p, c.Conn.Read)
+}
+
+// Write writes to the connection, unless a fault fires.
+func (c *FaultConn) Write(p []byte) (int, error) {
+	return c.do(FaultWrite, p, c.Conn.Write)
+}
+
+func (c *FaultConn) do(op FaultOp, p []byte, fn func([]byte) (int, error)) (int, error) {
+	if err := c.broken.Load(); err != nil {
+		return 0, *err
+	}
+	a := c.injector.inject(context.Background(), c.state, op)
+	if !a.fired {
+		return fn(p)
+	}
+
+	var n int
+	var err error
+	switch {
+	case a.short:
+		n, err = fn(p[:c.state.shortLen(len(p))])
+		if err == nil {
+			err = a.err
+		}
+		if err == nil && op == FaultWrite {
+			err = io.ErrShortWrite
+		}
+	case a.err != nil:
+		err = a.err
+	default:
+		n, err = fn(p)
+	}
+	if a.brk {
+		berr := a.err
+		if berr == nil {
+			berr = syscall.ECONNRESET
+		}
+		c.broken.CompareAndSwap(nil, &berr)
+		// shut down rather than close: the owner closes the conn later, and
+		// a second close could hit an fd reused by another socket
+		interruptConn(c.Conn)
+		if err == nil || err == io.ErrShortWrite {
+			err = berr
+		}
+	}
+	return n, err
+}
+
+// FaultListener is a listener with injected accept faults.
+type FaultListener struct {
+	net.Listener
+	injector *FaultInjector
+}
+
+// Accept waits for the next connection, unless a fault fires, and wraps it
+// with the faults of the injector.
+func (l *FaultListener) Accept() (net.Conn, error) {
+	a := l.injector.inject(context.Background(), l.injector.state, FaultAccept)
+	if a.err != nil {
+		return nil, a.err
+	}
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.injector.WrapConn(c), nil
+}
+
+// FaultDialer is a Dialer with injected dial faults.
+type FaultDialer struct {
+	Dialer   *Dialer
+	injector *FaultInjector
+}
+
+// Dial connects to address on network, unless a fault fires, and wraps the
+// connection with the faults of the injector.
+func (d *FaultDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext is like Dial but gives up when ctx is done. A fault's delay
+// is cut short by ctx as well.
+func (d *FaultDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	a := d.injector.inject(ctx, d.injector.state, FaultDial)
+	if a.err != nil {
+		return nil, a.err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c, err := d.Dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return d.injector.WrapConn(c), nil
+}
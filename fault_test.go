@@ -0,0 +1,52 @@
+package rsocket
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+)
+
+// closeCounter counts the Close calls reaching a connection.
+type closeCounter struct {
+	net.Conn
+	closes int
+}
+
+func (c *closeCounter) Close() error {
+	c.closes++
+	return c.Conn.Close()
+}
+
+func TestFaultConnBreak(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	go func() {
+		buf := make([]byte, 16)
+		for {
+			if _, err := b.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	conn := &closeCounter{Conn: a}
+	f := NewFaultInjector(1, Fault{Op: FaultWrite, After: 1, Count: 1, Break: true})
+	c := f.WrapConn(conn)
+	if _, err := c.Write([]byte("ok")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write([]byte("broken")); !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("got %v from the breaking write, want ECONNRESET", err)
+	}
+	if _, err := c.Read(make([]byte, 1)); !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("got %v reading a broken conn, want ECONNRESET", err)
+	}
+	if conn.closes != 0 {
+		t.Fatalf("Break closed the conn %d times, want it left to the owner", conn.closes)
+	}
+	c.Close()
+	if conn.closes != 1 {
+		t.Fatalf("got %d closes, want 1", conn.closes)
+	}
+}
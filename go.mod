@@ -3,3 +3,5 @@ module github.com/smallnest/rsocket
 go 1.23.0
 
 require golang.org/x/sys v0.27.0
+
+require golang.org/x/net v0.31.0
@@ -0,0 +1,498 @@
+package rsocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrPeerDead is returned by HeartbeatConn reads and writes once the peer
+// missed too many heartbeats.
+var ErrPeerDead = errors.New("rsocket: peer is dead")
+
+var _ net.Conn = (*HeartbeatConn)(nil)
+var _ net.Listener = (*HeartbeatListener)(nil)
+
+// HeartbeatConfig configures a HeartbeatConn.
+type HeartbeatConfig struct {
+	// Interval is how often a keepalive probe is sent, default is 1s.
+	Interval time.Duration
+	// MaxMissed is how many of the peer's probe intervals may pass without
+	// receiving anything before the peer is declared dead, default is 3.
+	MaxMissed int
+	// HandshakeTimeout bounds the negotiation, default is Interval * MaxMissed.
+	HandshakeTimeout time.Duration
+}
+
+func (cfg *HeartbeatConfig) setDefaults() {
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Second
+	}
+	if cfg.MaxMissed <= 0 {
+		cfg.MaxMissed = 3
+	}
+	if cfg.HandshakeTimeout <= 0 {
+		cfg.HandshakeTimeout = cfg.Interval * time.Duration(cfg.MaxMissed)
+	}
+}
+
+// heartbeat wire format
+//
+// Both sides start by sending a hello: the magic, the version and their
+// probe interval in milliseconds. After that every message is a frame with a
+// 1-byte type and a 4-byte big-endian payload length.
+const (
+	hbMagic   = "RSHB"
+	hbVersion = 1
+	hbHello   = len(hbMagic) + 1 + 4
+
+	hbFrameData = 0
+	hbFramePing = 1
+	hbHeader    = 5
+
+	// hbMaxPayload bounds a data frame, larger writes are split.
+	hbMaxPayload = 64 << 10
+)
+
+// HeartbeatConn wraps a connection so that both sides exchange keepalive
+// probes, and a peer that stops responding, for example because its node lost
+// power, is detected even though the RDMA queue pair never reports it.
+// Probes are framed apart from application data and never returned by Read.
+//
+// Both ends of the connection must use a HeartbeatConn.
+type HeartbeatConn struct {
+	conn         net.Conn
+	cfg          HeartbeatConfig
+	peerInterval time.Duration
+
+	// read side, filled by the reader goroutine
+	data     chan []byte
+	readErr  error // set before data is closed
+	readMu   sync.Mutex
+	pending  []byte
+	lastRecv atomic.Int64 // unix nanoseconds
+	blocked  atomic.Bool  // the reader waits for the application to consume data
+
+	// write side, drained by the writer goroutine
+	writes chan hbWrite
+
+	dead      chan struct{}
+	deadOnce  sync.Once
+	closed    chan struct{}
+	closeOnce sync.Once
+	loops     sync.WaitGroup // readLoop and writeLoop
+}
+
+type hbWrite struct {
+	frames *bytes.Buffer
+	done   chan error
+}
+
+var hbBufPool = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// NewHeartbeatConn negotiates heartbeats with the peer over conn and returns
+// the wrapped connection. The peer must call NewHeartbeatConn too, typically
+// the dialer right after DialTCP and the server through a HeartbeatListener.
+func NewHeartbeatConn(conn net.Conn, config HeartbeatConfig) (*HeartbeatConn, error) {
+	config.setDefaults()
+
+	peerInterval, err := hbHandshake(conn, config)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &HeartbeatConn{
+		conn:         conn,
+		cfg:          config,
+		peerInterval: peerInterval,
+		data:         make(chan []byte, 16),
+		writes:       make(chan hbWrite),
+		dead:         make(chan struct{}),
+		closed:       make(chan struct{}),
+	}
+	c.lastRecv.Store(time.Now().UnixNano())
+
+	c.loops.Add(2)
+	go c.readLoop()
+	go c.writeLoop()
+	go c.watch()
+
+	return c, nil
+}
+
+// hbHandshake exchanges hellos and returns the probe interval of the peer.
+// TCPConn deadlines are not implemented, so the timeout shuts the connection
+// down. Closing it is left to the caller.
+func hbHandshake(conn net.Conn, cfg HeartbeatConfig) (time.Duration, error) {
+	timer := time.AfterFunc(cfg.HandshakeTimeout, func() { interruptConn(conn) })
+	defer timer.Stop()
+
+	var hello [hbHello]byte
+	copy(hello[:], hbMagic)
+	hello[len(hbMagic)] = hbVersion
+	binary.BigEndian.PutUint32(hello[len(hbMagic)+1:], uint32(cfg.Interval/time.Millisecond))
+	if _, err := conn.Write(hello[:]); err != nil {
+		return 0, fmt.Errorf("rsocket: heartbeat handshake: %w", err)
+	}
+
+	var peer [hbHello]byte
+	if _, err := io.ReadFull(conn, peer[:]); err != nil {
+		if !timer.Stop() {
+			return 0, fmt.Errorf("rsocket: heartbeat handshake timed out after %v", cfg.HandshakeTimeout)
+		}
+		return 0, fmt.Errorf("rsocket: heartbeat handshake: %w", err)
+	}
+	if string(peer[:len(hbMagic)]) != hbMagic {
+		return 0, errors.New("rsocket: heartbeat handshake: peer does not speak the heartbeat protocol")
+	}
+	if peer[len(hbMagic)] != hbVersion {
+		return 0, fmt.Errorf("rsocket: heartbeat handshake: unsupported version %d", peer[len(hbMagic)])
+	}
+
+	ms := binary.BigEndian.Uint32(peer[len(hbMagic)+1:])
+	if ms == 0 {
+		return 0, errors.New("rsocket: heartbeat handshake: peer sent a zero interval")
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// readLoop reads frames, hands data to Read and drops probes.
+func (c *HeartbeatConn) readLoop() {
+	defer c.loops.Done()
+	var hdr [hbHeader]byte
+	for {
+		if _, err := io.ReadFull(c.conn, hdr[:]); err != nil {
+			c.readErr = err
+			close(c.data)
+			return
+		}
+		c.lastRecv.Store(time.Now().UnixNano())
+
+		n := binary.BigEndian.Uint32(hdr[1:])
+		if n > hbMaxPayload {
+			c.readErr = fmt.Errorf("rsocket: heartbeat frame of %d bytes exceeds %d", n, hbMaxPayload)
+			close(c.data)
+			return
+		}
+
+		switch hdr[0] {
+		case hbFramePing:
+			if n != 0 {
+				c.readErr = errors.New("rsocket: heartbeat probe with payload")
+				close(c.data)
+				return
+			}
+		case hbFrameData:
+			buf := make([]byte, n)
+			if _, err := io.ReadFull(c.conn, buf); err != nil {
+				c.readErr = err
+				close(c.data)
+				return
+			}
+			c.lastRecv.Store(time.Now().UnixNano())
+			c.deliver(buf)
+		default:
+			c.readErr = fmt.Errorf("rsocket: unknown heartbeat frame type %d", hdr[0])
+			close(c.data)
+			return
+		}
+	}
+}
+
+// deliver hands buf to Read. While the application does not consume data
+// the peer's probes queue up behind it, so that time does not count as missed.
+func (c *HeartbeatConn) deliver(buf []byte) {
+	select {
+	case c.data <- buf:
+		return
+	default:
+	}
+
+	c.blocked.Store(true)
+	select {
+	case c.data <- buf:
+	case <-c.closed:
+	}
+	c.lastRecv.Store(time.Now().UnixNano())
+	c.blocked.Store(false)
+}
+
+// writeLoop writes data frames and sends a probe every interval.
+func (c *HeartbeatConn) writeLoop() {
+	defer c.loops.Done()
+	ticker := time.NewTicker(c.cfg.Interval)
+	defer ticker.Stop()
+
+	var ping [hbHeader]byte
+	ping[0] = hbFramePing
+
+	for {
+		select {
+		case w := <-c.writes:
+			_, err := c.conn.Write(w.frames.Bytes())
+			w.done <- err
+		case <-ticker.C:
+			c.conn.Write(ping[:])
+		case <-c.closed:
+			return
+		case <-c.dead:
+			return
+		}
+	}
+}
+
+// watch declares the peer dead once nothing was received for MaxMissed of its intervals.
+func (c *HeartbeatConn) watch() {
+	ticker := time.NewTicker(c.peerInterval)
+	defer ticker.Stop()
+
+	limit := c.peerInterval * time.Duration(c.cfg.MaxMissed)
+	for {
+		select {
+		case <-ticker.C:
+			if c.blocked.Load() {
+				continue
+			}
+			if time.Since(time.Unix(0, c.lastRecv.Load())) > limit {
+				c.deadOnce.Do(func() {
+					close(c.dead)
+					// unblock the reader and writer, Close closes the connection
+					interruptConn(c.conn)
+				})
+				return
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// Read reads application data from the connection.
+// It returns ErrPeerDead once the peer is declared dead.
+func (c *HeartbeatConn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	if len(c.pending) == 0 {
+		select {
+		case <-c.dead:
+			return 0, ErrPeerDead
+		default:
+		}
+
+		select {
+		case buf, ok := <-c.data:
+			if !ok {
+				if c.isDead() {
+					return 0, ErrPeerDead
+				}
+				return 0, c.readErr
+			}
+			c.pending = buf
+		case <-c.dead:
+			return 0, ErrPeerDead
+		}
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write writes application data to the connection.
+// It returns ErrPeerDead once the peer is declared dead, also for a pending write.
+func (c *HeartbeatConn) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	frames := hbBufPool.Get().(*bytes.Buffer)
+	frames.Reset()
+	var hdr [hbHeader]byte
+	for rest := p; len(rest) > 0; {
+		chunk := rest
+		if len(chunk) > hbMaxPayload {
+			chunk = chunk[:hbMaxPayload]
+		}
+		hdr[0] = hbFrameData
+		binary.BigEndian.PutUint32(hdr[1:], uint32(len(chunk)))
+		frames.Write(hdr[:])
+		frames.Write(chunk)
+		rest = rest[len(chunk):]
+	}
+
+	w := hbWrite{frames: frames, done: make(chan error, 1)}
+	select {
+	case c.writes <- w:
+	case <-c.dead:
+		hbBufPool.Put(frames)
+		return 0, ErrPeerDead
+	case <-c.closed:
+		hbBufPool.Put(frames)
+		return 0, net.ErrClosed
+	}
+
+	select {
+	case err := <-w.done:
+		hbBufPool.Put(frames)
+		if err != nil {
+			if c.isDead() {
+				return 0, ErrPeerDead
+			}
+			return 0, err
+		}
+		return len(p), nil
+	case <-c.dead:
+		// the writer goroutine may still hold frames, leave it to the GC
+		return 0, ErrPeerDead
+	case <-c.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+func (c *HeartbeatConn) isDead() bool {
+	select {
+	case <-c.dead:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close closes the connection. The reader and writer goroutines are
+// interrupted and waited for first, so that none of them is still using the
+// connection when it is closed.
+func (c *HeartbeatConn) Close() error {
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		interruptConn(c.conn)
+		c.loops.Wait()
+		err = c.conn.Close()
+	})
+	return err
+}
+
+// PeerInterval returns the probe interval the peer announced.
+func (c *HeartbeatConn) PeerInterval() time.Duration {
+	return c.peerInterval
+}
+
+// LocalAddr returns the local network address.
+func (c *HeartbeatConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote network address.
+func (c *HeartbeatConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines of the wrapped connection.
+func (c *HeartbeatConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the wrapped connection.
+func (c *HeartbeatConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline of the wrapped connection.
+func (c *HeartbeatConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// HeartbeatListener wraps a listener so that accepted connections negotiate
+// heartbeats before they are returned. Each connection negotiates on its own
+// goroutine, so a client that never completes the handshake does not delay
+// the others.
+type HeartbeatListener struct {
+	net.Listener
+	cfg HeartbeatConfig
+
+	conns     chan *HeartbeatConn
+	errs      chan error
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewHeartbeatListener returns a listener whose Accept returns HeartbeatConns.
+func NewHeartbeatListener(ln net.Listener, config HeartbeatConfig) *HeartbeatListener {
+	config.setDefaults()
+	l := &HeartbeatListener{
+		Listener: ln,
+		cfg:      config,
+		conns:    make(chan *HeartbeatConn),
+		errs:     make(chan error),
+		closed:   make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+// acceptLoop accepts connections and starts their handshakes. An error of the
+// wrapped listener is handed to the next Accept before accepting again.
+func (l *HeartbeatListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+				continue
+			case <-l.closed:
+				return
+			}
+		}
+		go l.handshake(conn)
+	}
+}
+
+// handshake negotiates heartbeats with conn and queues it for Accept. Clients
+// that fail are closed and logged at debug level.
+func (l *HeartbeatListener) handshake(conn net.Conn) {
+	hc, err := NewHeartbeatConn(conn, l.cfg)
+	if err != nil {
+		conn.Close()
+		if logger := loggerOr(nil); debugEnabled(logger) {
+			logDebug(logger, "rsocket: heartbeat handshake", appendErr([]slog.Attr{addrAttr("remote", conn.RemoteAddr())}, err)...)
+		}
+		return
+	}
+	select {
+	case l.conns <- hc:
+	case <-l.closed:
+		hc.Close()
+	}
+}
+
+// Accept waits for the next connection that negotiated heartbeats.
+// The negotiation is bounded by HandshakeTimeout.
+func (l *HeartbeatListener) Accept() (net.Conn, error) {
+	select {
+	case hc := <-l.conns:
+		return hc, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the listener. Connections still negotiating are closed once
+// their handshake ends.
+func (l *HeartbeatListener) Close() error {
+	err := net.ErrClosed
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.Listener.Close()
+	})
+	return err
+}
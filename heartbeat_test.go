@@ -0,0 +1,176 @@
+package rsocket
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// hbPeer plays the remote end of a HeartbeatConn on the raw side of a pipe.
+// It reads the hello of the conn and answers with interval.
+func hbPeer(t *testing.T, raw net.Conn, interval time.Duration) {
+	t.Helper()
+	var hello [hbHello]byte
+	if _, err := io.ReadFull(raw, hello[:]); err != nil {
+		t.Fatal(err)
+	}
+	if string(hello[:len(hbMagic)]) != hbMagic || hello[len(hbMagic)] != hbVersion {
+		t.Fatalf("got hello %q", hello)
+	}
+	binary.BigEndian.PutUint32(hello[len(hbMagic)+1:], uint32(interval/time.Millisecond))
+	if _, err := raw.Write(hello[:]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testHeartbeatConn returns a HeartbeatConn and the raw other end of its
+// pipe, whose peer announced interval. What the conn writes after the
+// handshake is discarded.
+func testHeartbeatConn(t *testing.T, cfg HeartbeatConfig, interval time.Duration) (*HeartbeatConn, net.Conn) {
+	t.Helper()
+	a, raw := net.Pipe()
+	type result struct {
+		c   *HeartbeatConn
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		c, err := NewHeartbeatConn(a, cfg)
+		done <- result{c, err}
+	}()
+	hbPeer(t, raw, interval)
+	r := <-done
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	go io.Copy(io.Discard, raw)
+	t.Cleanup(func() {
+		r.c.Close()
+		raw.Close()
+	})
+	return r.c, raw
+}
+
+func hbFrame(typ byte, payload string) []byte {
+	frame := make([]byte, hbHeader, hbHeader+len(payload))
+	frame[0] = typ
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+	return append(frame, payload...)
+}
+
+func TestHeartbeatHandshake(t *testing.T) {
+	c, _ := testHeartbeatConn(t, HeartbeatConfig{Interval: time.Second}, 250*time.Millisecond)
+	if d := c.PeerInterval(); d != 250*time.Millisecond {
+		t.Fatalf("got peer interval %v, want 250ms", d)
+	}
+
+	a, raw := net.Pipe()
+	defer raw.Close()
+	go func() {
+		io.ReadFull(raw, make([]byte, hbHello))
+		raw.Write([]byte("HTTP/1.1 "))
+	}()
+	if _, err := NewHeartbeatConn(a, HeartbeatConfig{}); err == nil {
+		t.Fatal("got no error from a peer without the heartbeat protocol")
+	}
+
+	// a silent peer times the handshake out
+	a, raw = net.Pipe()
+	defer raw.Close()
+	go io.Copy(io.Discard, raw)
+	_, err := NewHeartbeatConn(a, HeartbeatConfig{HandshakeTimeout: 50 * time.Millisecond})
+	if err == nil {
+		t.Fatal("got no error from a silent peer")
+	}
+}
+
+func TestHeartbeatProbesNotRead(t *testing.T) {
+	c, raw := testHeartbeatConn(t, HeartbeatConfig{Interval: time.Second}, time.Second)
+
+	go func() {
+		for _, frame := range [][]byte{
+			hbFrame(hbFramePing, ""),
+			hbFrame(hbFrameData, "hello "),
+			hbFrame(hbFramePing, ""),
+			hbFrame(hbFramePing, ""),
+			hbFrame(hbFrameData, "world"),
+		} {
+			if _, err := raw.Write(frame); err != nil {
+				return
+			}
+		}
+	}()
+
+	got := make([]byte, 0, 11)
+	buf := make([]byte, 16)
+	for len(got) < 11 {
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if string(got) != "hello world" {
+		t.Fatalf("got %q, want the data frames only", got)
+	}
+}
+
+func TestHeartbeatPeerDead(t *testing.T) {
+	c, _ := testHeartbeatConn(t, HeartbeatConfig{Interval: time.Second, MaxMissed: 3}, 10*time.Millisecond)
+
+	// the peer sends nothing after its hello
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Read(make([]byte, 1))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrPeerDead) {
+			t.Fatalf("got %v, want ErrPeerDead", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Read still blocked after the peer missed its heartbeats")
+	}
+	if _, err := c.Write([]byte("x")); !errors.Is(err, ErrPeerDead) {
+		t.Fatalf("got %v writing to a dead peer, want ErrPeerDead", err)
+	}
+}
+
+func TestHeartbeatClose(t *testing.T) {
+	a, raw := net.Pipe()
+	defer raw.Close()
+	conn := &closeCounter{Conn: a}
+	done := make(chan *HeartbeatConn, 1)
+	go func() {
+		c, err := NewHeartbeatConn(conn, HeartbeatConfig{Interval: 10 * time.Millisecond})
+		if err != nil {
+			t.Error(err)
+		}
+		done <- c
+	}()
+	hbPeer(t, raw, time.Second)
+	c := <-done
+	if c == nil {
+		return
+	}
+
+	// the reader is blocked reading and the peer does not read the probes,
+	// so the writer is blocked writing one
+	time.Sleep(50 * time.Millisecond)
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if conn.closes != 1 {
+		t.Fatalf("got %d closes of the connection, want 1", conn.closes)
+	}
+	if err := c.Close(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("got %v from a second Close, want net.ErrClosed", err)
+	}
+	if conn.closes != 1 {
+		t.Fatalf("got %d closes after a second Close, want 1", conn.closes)
+	}
+}
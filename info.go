@@ -0,0 +1,152 @@
+package rsocket
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// ConnInfo describes a connection, see TCPConn.Info. Values the socket does
+// not report are left zero and the error is recorded in Errors.
+type ConnInfo struct {
+	Fd         int
+	LocalAddr  net.Addr // from rgetsockname
+	RemoteAddr net.Addr // from rgetpeername
+
+	// effective RDMA_* options
+	SQSize    int
+	RQSize    int
+	Inline    int
+	IOMapSize int
+
+	SendBuffer int // SO_SNDBUF
+	RecvBuffer int // SO_RCVBUF
+
+	// Route holds the path records set with RDMA_ROUTE, if any. librdmacm
+	// does not expose the device, port or QP number of a connection.
+	Route []RoutePath
+
+	Created      time.Time
+	Age          time.Duration
+	BytesRead    uint64
+	BytesWritten uint64
+
+	// Errors maps the name of each field that could not be read to the error.
+	Errors map[string]error
+}
+
+// RoutePath is an InfiniBand path record of a connection's route.
+type RoutePath struct {
+	SGID  net.IP
+	DGID  net.IP
+	SLID  uint16
+	DLID  uint16
+	PKey  uint16
+	SL    uint8
+	MTU   uint8 // IB MTU enum, 1 is 256 bytes up to 5 for 4096 bytes
+	Rate  uint8 // IB rate enum
+	Flags uint32
+}
+
+// Info returns the addresses, RDMA options, route, age and byte counters of
+// the connection.
+func (c *TCPConn) Info() ConnInfo {
+	info := ConnInfo{
+		Fd:           c.fd,
+		LocalAddr:    c.localAddr,
+		RemoteAddr:   c.remoteAddr,
+		Created:      c.created,
+		Age:          time.Since(c.created),
+		BytesRead:    c.bytesRead.Load(),
+		BytesWritten: c.bytesWritten.Load(),
+	}
+	fail := func(name string, err error) {
+		if info.Errors == nil {
+			info.Errors = make(map[string]error)
+		}
+		info.Errors[name] = err
+	}
+
+	if sa, err := GetSockName(c.fd); err != nil {
+		fail("LocalAddr", err)
+	} else if addr := sockaddrToTCPAddr(sa); addr != nil {
+		info.LocalAddr = addr
+	}
+	if sa, err := GetPeerName(c.fd); err != nil {
+		fail("RemoteAddr", err)
+	} else if addr := sockaddrToTCPAddr(sa); addr != nil {
+		info.RemoteAddr = addr
+	}
+
+	opts := []struct {
+		name       string
+		level, opt int
+		value      *int
+	}{
+		{"SQSize", SOL_RDMA, RDMA_SQSIZE, &info.SQSize},
+		{"RQSize", SOL_RDMA, RDMA_RQSIZE, &info.RQSize},
+		{"Inline", SOL_RDMA, RDMA_INLINE, &info.Inline},
+		{"IOMapSize", SOL_RDMA, RDMA_IOMAPSIZE, &info.IOMapSize},
+		{"SendBuffer", SOL_SOCKET, SO_SNDBUF, &info.SendBuffer},
+		{"RecvBuffer", SOL_SOCKET, SO_RCVBUF, &info.RecvBuffer},
+	}
+	for _, o := range opts {
+		v, err := GetSockOptInt(c.fd, o.level, o.opt)
+		if err != nil {
+			fail(o.name, err)
+			continue
+		}
+		*o.value = v
+	}
+
+	route, err := getRoute(c.fd)
+	if err != nil {
+		fail("Route", err)
+	}
+	info.Route = route
+	return info
+}
+
+// ibvPathDataSize is the size of struct ibv_path_data: flags, reserved and
+// a 64-byte struct ibv_path_record.
+const ibvPathDataSize = 72
+
+// getRoute reads the RDMA_ROUTE path records of fd.
+func getRoute(fd int) ([]RoutePath, error) {
+	var buf [8 * ibvPathDataSize]byte
+	n := uint32(len(buf))
+	if err := GetSockOpt(fd, SOL_RDMA, RDMA_ROUTE, unsafe.Pointer(&buf[0]), &n); err != nil {
+		return nil, err
+	}
+
+	var paths []RoutePath
+	for b := buf[:min(int(n), len(buf))]; len(b) >= ibvPathDataSize; b = b[ibvPathDataSize:] {
+		// path record fields are in network byte order
+		rec := b[8:]
+		paths = append(paths, RoutePath{
+			Flags: binary.NativeEndian.Uint32(b[0:4]),
+			DGID:  net.IP(append([]byte(nil), rec[8:24]...)),
+			SGID:  net.IP(append([]byte(nil), rec[24:40]...)),
+			DLID:  binary.BigEndian.Uint16(rec[40:42]),
+			SLID:  binary.BigEndian.Uint16(rec[42:44]),
+			PKey:  binary.BigEndian.Uint16(rec[50:52]),
+			SL:    uint8(binary.BigEndian.Uint16(rec[52:54]) & 0xf),
+			MTU:   rec[54] & 0x3f,
+			Rate:  rec[55] & 0x3f,
+		})
+	}
+	return paths, nil
+}
+
+// sockaddrToTCPAddr converts an IPv4 or IPv6 sockaddr, or returns nil.
+func sockaddrToTCPAddr(sa syscall.Sockaddr) *net.TCPAddr {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return &net.TCPAddr{IP: net.IP(append([]byte(nil), sa.Addr[:]...)), Port: sa.Port}
+	case *syscall.SockaddrInet6:
+		return &net.TCPAddr{IP: net.IP(append([]byte(nil), sa.Addr[:]...)), Port: sa.Port}
+	}
+	return nil
+}
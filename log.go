@@ -0,0 +1,76 @@
+package rsocket
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"syscall"
+)
+
+// packageLogger is the logger of listeners and connections without their own.
+var packageLogger atomic.Pointer[slog.Logger]
+
+// SetLogger sets the package-level logger used by listeners and connections
+// that were not given one with WithLogger. A nil logger restores slog.Default().
+//
+// The package only logs at debug level: socket creation, option application,
+// connect and accept outcomes and close, with the fd, addresses and errno.
+func SetLogger(logger *slog.Logger) {
+	packageLogger.Store(logger)
+}
+
+// WithLogger makes the dialed connection, or the listener and the connections
+// it accepts, log to logger instead of the package-level logger.
+// Put it first so it sees the other options.
+func WithLogger(logger *slog.Logger) OptionSocketFn {
+	return func(fd int) error {
+		if s := lookupSetup(fd); s != nil {
+			s.logger = logger
+		}
+		return nil
+	}
+}
+
+// loggerOr returns logger, or the package-level logger if logger is nil.
+func loggerOr(logger *slog.Logger) *slog.Logger {
+	if logger != nil {
+		return logger
+	}
+	if logger = packageLogger.Load(); logger != nil {
+		return logger
+	}
+	return slog.Default()
+}
+
+// logDebug logs msg at debug level. Callers on paths that matter should check
+// debugEnabled first so the attributes are not built for nothing.
+func logDebug(logger *slog.Logger, msg string, attrs ...slog.Attr) {
+	logger.LogAttrs(context.Background(), slog.LevelDebug, msg, attrs...)
+}
+
+func debugEnabled(logger *slog.Logger) bool {
+	return logger.Enabled(context.Background(), slog.LevelDebug)
+}
+
+// addrAttr returns an attribute for addr that tolerates nil addresses.
+func addrAttr(key string, addr net.Addr) slog.Attr {
+	if addr == nil {
+		return slog.String(key, "")
+	}
+	return slog.String(key, addr.String())
+}
+
+// appendErr appends the error and its errno name, if it has one, to attrs.
+func appendErr(attrs []slog.Attr, err error) []slog.Attr {
+	if err == nil {
+		return attrs
+	}
+	attrs = append(attrs, slog.String("error", err.Error()))
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		attrs = append(attrs, slog.String("errno", errnoName(errno)))
+	}
+	return attrs
+}
@@ -0,0 +1,338 @@
+package rsocket
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// metricsDisabled turns off metric collection on the I/O hot paths.
+var metricsDisabled atomic.Bool
+
+// SetMetricsEnabled enables or disables metric collection. It is enabled by default.
+// When disabled, Read/Write and the dial/accept paths skip all counters, but
+// the active connection gauges are still kept so they stay consistent.
+func SetMetricsEnabled(enabled bool) {
+	metricsDisabled.Store(!enabled)
+}
+
+// MetricsEnabled reports whether metric collection is enabled.
+func MetricsEnabled() bool {
+	return !metricsDisabled.Load()
+}
+
+// latencyBuckets are the upper bounds of the latency histograms.
+var latencyBuckets = [...]time.Duration{
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// histogram is a fixed-bucket latency histogram.
+type histogram struct {
+	counts [len(latencyBuckets) + 1]atomic.Uint64 // the last one is the +Inf bucket
+	sum    atomic.Int64                           // nanoseconds
+	count  atomic.Uint64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := sort.Search(len(latencyBuckets), func(i int) bool { return d <= latencyBuckets[i] })
+	h.counts[i].Add(1)
+	h.sum.Add(int64(d))
+	h.count.Add(1)
+}
+
+func (h *histogram) snapshot() HistogramSnapshot {
+	s := HistogramSnapshot{
+		Count: h.count.Load(),
+		Sum:   time.Duration(h.sum.Load()),
+	}
+	s.Buckets = make([]Bucket, len(latencyBuckets))
+	var cumulative uint64
+	for i, le := range latencyBuckets {
+		cumulative += h.counts[i].Load()
+		s.Buckets[i] = Bucket{UpperBound: le, Count: cumulative}
+	}
+	return s
+}
+
+// maxErrno bounds the errno values counted individually, larger ones are counted as errno 0.
+const maxErrno = 256
+
+// globalMetrics are the package-wide counters.
+type globalMetrics struct {
+	bytesRead     atomic.Uint64
+	bytesWritten  atomic.Uint64
+	reads         atomic.Uint64
+	writes        atomic.Uint64
+	dials         atomic.Uint64
+	accepts       atomic.Uint64
+	active        atomic.Int64
+	errors        [maxErrno]atomic.Uint64 // indexed by errno, 0 holds errors without one
+	dialLatency   histogram
+	acceptLatency histogram
+}
+
+var metrics globalMetrics
+
+// listenerMetrics are the counters of a single TCPListener.
+type listenerMetrics struct {
+	accepted atomic.Uint64
+	active   atomic.Int64
+}
+
+// listeners are the open listeners, reported with their own gauges.
+var listeners sync.Map // *TCPListener -> struct{}
+
+func recordRead(n int, err error) {
+	if metricsDisabled.Load() {
+		return
+	}
+	metrics.reads.Add(1)
+	metrics.bytesRead.Add(uint64(n))
+	if err != nil {
+		recordError(err)
+	}
+}
+
+func recordWrite(n int, err error) {
+	if metricsDisabled.Load() {
+		return
+	}
+	metrics.writes.Add(1)
+	metrics.bytesWritten.Add(uint64(n))
+	if err != nil {
+		recordError(err)
+	}
+}
+
+func recordDial(start time.Time, err error) {
+	if metricsDisabled.Load() {
+		return
+	}
+	metrics.dials.Add(1)
+	metrics.dialLatency.observe(time.Since(start))
+	if err != nil {
+		recordError(err)
+	}
+}
+
+func recordAccept(start time.Time, err error) {
+	if metricsDisabled.Load() {
+		return
+	}
+	metrics.accepts.Add(1)
+	metrics.acceptLatency.observe(time.Since(start))
+	if err != nil {
+		recordError(err)
+	}
+}
+
+// recordError counts err by its errno. io.EOF is not an error here.
+func recordError(err error) {
+	if err == io.EOF {
+		return
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) && errno < maxErrno {
+		metrics.errors[errno].Add(1)
+		return
+	}
+	metrics.errors[0].Add(1)
+}
+
+// Bucket is a cumulative histogram bucket.
+type Bucket struct {
+	UpperBound time.Duration `json:"le"`
+	Count      uint64        `json:"count"`
+}
+
+// HistogramSnapshot is a point-in-time copy of a latency histogram.
+type HistogramSnapshot struct {
+	Count   uint64        `json:"count"`
+	Sum     time.Duration `json:"sum"`
+	Buckets []Bucket      `json:"buckets"`
+}
+
+// ListenerSnapshot is a point-in-time copy of the counters of a listener.
+type ListenerSnapshot struct {
+	Addr     string `json:"addr"`
+	Accepted uint64 `json:"accepted"`
+	Active   int64  `json:"active"`
+	Rejected uint64 `json:"rejected"` // see WithAdmission
+}
+
+// MetricsSnapshot is a point-in-time copy of the package metrics.
+type MetricsSnapshot struct {
+	BytesRead     uint64             `json:"bytes_read"`
+	BytesWritten  uint64             `json:"bytes_written"`
+	Reads         uint64             `json:"reads"`
+	Writes        uint64             `json:"writes"`
+	Dials         uint64             `json:"dials"`
+	Accepts       uint64             `json:"accepts"`
+	ActiveConns   int64              `json:"active_conns"`
+	Errors        map[string]uint64  `json:"errors"` // keyed by errno name such as "ECONNRESET"
+	DialLatency   HistogramSnapshot  `json:"dial_latency"`
+	AcceptLatency HistogramSnapshot  `json:"accept_latency"`
+	Listeners     []ListenerSnapshot `json:"listeners"`
+}
+
+// ReadMetrics returns a snapshot of the package metrics.
+func ReadMetrics() MetricsSnapshot {
+	s := MetricsSnapshot{
+		BytesRead:     metrics.bytesRead.Load(),
+		BytesWritten:  metrics.bytesWritten.Load(),
+		Reads:         metrics.reads.Load(),
+		Writes:        metrics.writes.Load(),
+		Dials:         metrics.dials.Load(),
+		Accepts:       metrics.accepts.Load(),
+		ActiveConns:   metrics.active.Load(),
+		Errors:        make(map[string]uint64),
+		DialLatency:   metrics.dialLatency.snapshot(),
+		AcceptLatency: metrics.acceptLatency.snapshot(),
+	}
+	for i := range metrics.errors {
+		if n := metrics.errors[i].Load(); n > 0 {
+			s.Errors[errnoName(syscall.Errno(i))] = n
+		}
+	}
+
+	listeners.Range(func(k, _ any) bool {
+		l := k.(*TCPListener)
+		s.Listeners = append(s.Listeners, ListenerSnapshot{
+			Addr:     l.tcpAddr.String(),
+			Accepted: l.metrics.accepted.Load(),
+			Active:   l.metrics.active.Load(),
+			Rejected: l.admission.stats().Rejected(),
+		})
+		return true
+	})
+	sort.Slice(s.Listeners, func(i, j int) bool { return s.Listeners[i].Addr < s.Listeners[j].Addr })
+
+	return s
+}
+
+func errnoName(errno syscall.Errno) string {
+	if errno == 0 {
+		return "other"
+	}
+	if name := unix.ErrnoName(errno); name != "" {
+		return name
+	}
+	return fmt.Sprintf("errno%d", int(errno))
+}
+
+var publishOnce sync.Once
+
+// PublishExpvar publishes the package metrics as the expvar variable "rsocket".
+// It is safe to call more than once.
+func PublishExpvar() {
+	publishOnce.Do(func() {
+		expvar.Publish("rsocket", expvar.Func(func() any { return ReadMetrics() }))
+	})
+}
+
+// MetricsHandler returns an http.Handler that serves the package metrics
+// in the Prometheus text exposition format.
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WritePrometheus(w)
+	})
+}
+
+// WritePrometheus writes the package metrics to w in the Prometheus text exposition format.
+func WritePrometheus(w io.Writer) error {
+	s := ReadMetrics()
+	pw := &promWriter{w: w}
+
+	pw.metric("rsocket_read_bytes_total", "counter", "Bytes read from rsocket connections.", s.BytesRead)
+	pw.metric("rsocket_written_bytes_total", "counter", "Bytes written to rsocket connections.", s.BytesWritten)
+	pw.metric("rsocket_reads_total", "counter", "Read operations on rsocket connections.", s.Reads)
+	pw.metric("rsocket_writes_total", "counter", "Write operations on rsocket connections.", s.Writes)
+	pw.metric("rsocket_dials_total", "counter", "Dial attempts.", s.Dials)
+	pw.metric("rsocket_accepts_total", "counter", "Accept attempts.", s.Accepts)
+	pw.metric("rsocket_active_connections", "gauge", "Open rsocket connections.", s.ActiveConns)
+
+	pw.header("rsocket_errors_total", "counter", "Errors by errno.")
+	names := make([]string, 0, len(s.Errors))
+	for name := range s.Errors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		pw.printf("rsocket_errors_total{errno=%q} %d\n", name, s.Errors[name])
+	}
+
+	pw.histogram("rsocket_dial_duration_seconds", "Time to create and connect an rsocket.", s.DialLatency)
+	pw.histogram("rsocket_accept_duration_seconds", "Time spent in raccept, including waiting for clients.", s.AcceptLatency)
+
+	pw.header("rsocket_listener_accepted_total", "counter", "Connections accepted per listener.")
+	for _, l := range s.Listeners {
+		pw.printf("rsocket_listener_accepted_total{listener=%q} %d\n", l.Addr, l.Accepted)
+	}
+	pw.header("rsocket_listener_active_connections", "gauge", "Open accepted connections per listener.")
+	for _, l := range s.Listeners {
+		pw.printf("rsocket_listener_active_connections{listener=%q} %d\n", l.Addr, l.Active)
+	}
+	pw.header("rsocket_listener_rejected_total", "counter", "Connections rejected by admission control per listener.")
+	for _, l := range s.Listeners {
+		pw.printf("rsocket_listener_rejected_total{listener=%q} %d\n", l.Addr, l.Rejected)
+	}
+
+	return pw.err
+}
+
+// promWriter writes the Prometheus text format and keeps the first error.
+type promWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (pw *promWriter) printf(format string, args ...any) {
+	if pw.err != nil {
+		return
+	}
+	_, pw.err = fmt.Fprintf(pw.w, format, args...)
+}
+
+func (pw *promWriter) header(name, typ, help string) {
+	pw.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (pw *promWriter) metric(name, typ, help string, value any) {
+	pw.header(name, typ, help)
+	pw.printf("%s %d\n", name, value)
+}
+
+func (pw *promWriter) histogram(name, help string, h HistogramSnapshot) {
+	pw.header(name, "histogram", help)
+	for _, b := range h.Buckets {
+		pw.printf("%s_bucket{le=\"%g\"} %d\n", name, b.UpperBound.Seconds(), b.Count)
+	}
+	pw.printf("%s_bucket{le=\"+Inf\"} %d\n", name, h.Count)
+	pw.printf("%s_sum %g\n", name, h.Sum.Seconds())
+	pw.printf("%s_count %d\n", name, h.Count)
+}
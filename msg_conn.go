@@ -0,0 +1,174 @@
+package rsocket
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ErrMsgTooLarge is returned when a message exceeds the MsgConn size limit.
+var ErrMsgTooLarge = errors.New("rsocket: message too large")
+
+// MsgConfig configures a MsgConn.
+type MsgConfig struct {
+	// HeaderSize is the width in bytes of the big-endian length prefix:
+	// 1, 2, 4 or 8, default is 4.
+	HeaderSize int
+	// MaxMsgSize limits the size of a message in both directions,
+	// default is the largest size the header can hold, capped at 64MB.
+	MaxMsgSize int
+}
+
+const defaultMaxMsgSize = 64 << 20
+
+// MsgConn sends and receives length-prefixed messages over a TCPConn.
+// rsocket, like TCP, may return partial reads; MsgConn always returns whole
+// messages.
+//
+// ReadMsg and WriteMsg may be called concurrently with each other, but not
+// with themselves.
+type MsgConn struct {
+	conn *TCPConn
+	cfg  MsgConfig
+
+	// the headers are allocated on their own: cgo rejects a pointer into
+	// a struct that holds pointers to unpinned memory, like conn
+	rhdr []byte
+	rmu  sync.Mutex
+
+	whdr []byte
+	wmu  sync.Mutex
+}
+
+// NewMsgConn returns a MsgConn over conn.
+func NewMsgConn(conn *TCPConn, config MsgConfig) (*MsgConn, error) {
+	if config.HeaderSize == 0 {
+		config.HeaderSize = 4
+	}
+	switch config.HeaderSize {
+	case 1, 2, 4, 8:
+	default:
+		return nil, fmt.Errorf("rsocket: invalid message header size %d, want 1, 2, 4 or 8", config.HeaderSize)
+	}
+
+	limit := maxMsgLen(config.HeaderSize)
+	if config.MaxMsgSize == 0 {
+		config.MaxMsgSize = defaultMaxMsgSize
+		if uint64(config.MaxMsgSize) > limit {
+			config.MaxMsgSize = int(limit)
+		}
+	}
+	if config.MaxMsgSize < 0 || uint64(config.MaxMsgSize) > limit {
+		return nil, fmt.Errorf("rsocket: max message size %d does not fit a %d-byte header", config.MaxMsgSize, config.HeaderSize)
+	}
+
+	return &MsgConn{conn: conn, cfg: config, rhdr: make([]byte, 8), whdr: make([]byte, 8)}, nil
+}
+
+// maxMsgLen returns the largest length a header of size bytes can hold.
+func maxMsgLen(size int) uint64 {
+	if size >= 8 {
+		return 1<<63 - 1
+	}
+	return 1<<(8*size) - 1
+}
+
+// encodeMsgLen writes n as a big-endian length prefix of len(hdr) bytes.
+func encodeMsgLen(hdr []byte, n uint64) {
+	switch len(hdr) {
+	case 1:
+		hdr[0] = byte(n)
+	case 2:
+		binary.BigEndian.PutUint16(hdr, uint16(n))
+	case 4:
+		binary.BigEndian.PutUint32(hdr, uint32(n))
+	case 8:
+		binary.BigEndian.PutUint64(hdr, n)
+	}
+}
+
+// decodeMsgLen decodes a length prefix and checks it against max.
+func decodeMsgLen(hdr []byte, max int) (int, error) {
+	var n uint64
+	switch len(hdr) {
+	case 1:
+		n = uint64(hdr[0])
+	case 2:
+		n = uint64(binary.BigEndian.Uint16(hdr))
+	case 4:
+		n = uint64(binary.BigEndian.Uint32(hdr))
+	case 8:
+		n = binary.BigEndian.Uint64(hdr)
+	default:
+		return 0, fmt.Errorf("rsocket: invalid message header size %d", len(hdr))
+	}
+	if n > uint64(max) {
+		return 0, fmt.Errorf("%w: %d bytes, limit is %d", ErrMsgTooLarge, n, max)
+	}
+	return int(n), nil
+}
+
+// WriteMsg writes msg with its length prefix in a single rwritev call.
+func (c *MsgConn) WriteMsg(msg []byte) error {
+	if len(msg) > c.cfg.MaxMsgSize {
+		return fmt.Errorf("%w: %d bytes, limit is %d", ErrMsgTooLarge, len(msg), c.cfg.MaxMsgSize)
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	hdr := c.whdr[:c.cfg.HeaderSize]
+	encodeMsgLen(hdr, uint64(len(msg)))
+	_, err := c.conn.Writev([][]byte{hdr, msg})
+	return err
+}
+
+// ReadMsg reads the next message. The returned buffer comes from a pool;
+// pass it to Release once it is no longer used to avoid an allocation per
+// message. io.EOF is returned if the connection was closed between messages.
+func (c *MsgConn) ReadMsg() ([]byte, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	return readMsg(c.conn, c.rhdr[:c.cfg.HeaderSize], c.cfg.MaxMsgSize, bufferPoolOr(c.conn.pool))
+}
+
+// readMsg reads a message with a len(hdr)-byte prefix from r into a buffer
+// from pool.
+func readMsg(r io.Reader, hdr []byte, max int, pool *BufferPool) ([]byte, error) {
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	n, err := decodeMsgLen(hdr, max)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := pool.Get(n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		pool.Put(msg)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Release returns a buffer returned by ReadMsg to the pool.
+// The buffer must not be used afterwards.
+func (c *MsgConn) Release(msg []byte) {
+	c.conn.Release(msg)
+}
+
+// Conn returns the underlying connection.
+func (c *MsgConn) Conn() *TCPConn {
+	return c.conn
+}
+
+// Close closes the underlying connection.
+func (c *MsgConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,157 @@
+package rsocket
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestMsgConnRoundTrip(t *testing.T) {
+	for _, size := range []int{1, 2, 4, 8} {
+		client, server := testConnPair(t)
+		w, err := NewMsgConn(client, MsgConfig{HeaderSize: size})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewMsgConn(server, MsgConfig{HeaderSize: size})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msgs := [][]byte{{}, []byte("a"), bytes.Repeat([]byte("xy"), 100)}
+		if size > 1 {
+			msgs = append(msgs, bytes.Repeat([]byte{7}, 1<<16-1))
+		}
+		go func() {
+			for _, msg := range msgs {
+				if err := w.WriteMsg(msg); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+			client.CloseWrite()
+		}()
+		for _, want := range msgs {
+			got, err := r.ReadMsg()
+			if err != nil {
+				t.Fatalf("header size %d: %v", size, err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("header size %d: got %d bytes, want %d", size, len(got), len(want))
+			}
+			r.Release(got)
+		}
+		if _, err := r.ReadMsg(); err != io.EOF {
+			t.Fatalf("header size %d: got %v at the end, want io.EOF", size, err)
+		}
+	}
+}
+
+func TestMsgConnTooLarge(t *testing.T) {
+	client, server := testConnPair(t)
+	w, _ := NewMsgConn(client, MsgConfig{HeaderSize: 2})
+	if err := w.WriteMsg(make([]byte, 1<<16)); !errors.Is(err, ErrMsgTooLarge) {
+		t.Fatalf("got %v writing 64KiB with a 2-byte header, want ErrMsgTooLarge", err)
+	}
+
+	// the reader has a lower limit than the writer
+	r, _ := NewMsgConn(server, MsgConfig{HeaderSize: 2, MaxMsgSize: 10})
+	if err := w.WriteMsg(make([]byte, 11)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ReadMsg(); !errors.Is(err, ErrMsgTooLarge) {
+		t.Fatalf("got %v reading 11 bytes with a limit of 10, want ErrMsgTooLarge", err)
+	}
+}
+
+func TestNewMsgConnConfig(t *testing.T) {
+	for _, cfg := range []MsgConfig{
+		{HeaderSize: 3},
+		{HeaderSize: 1, MaxMsgSize: 256},
+		{MaxMsgSize: -1},
+	} {
+		if _, err := NewMsgConn(nil, cfg); err == nil {
+			t.Errorf("NewMsgConn(%+v) succeeded", cfg)
+		}
+	}
+	c, err := NewMsgConn(nil, MsgConfig{HeaderSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.cfg.MaxMsgSize != 255 {
+		t.Errorf("default limit with a 1-byte header is %d, want 255", c.cfg.MaxMsgSize)
+	}
+}
+
+func FuzzDecodeMsgLen(f *testing.F) {
+	f.Add([]byte{0}, 0)
+	f.Add([]byte{0xff, 0xff}, 1<<16)
+	f.Add([]byte{0, 0, 1, 0}, 255)
+	f.Add([]byte{0x80, 0, 0, 0, 0, 0, 0, 0}, defaultMaxMsgSize)
+	f.Add([]byte{1, 2, 3}, 10)
+	f.Fuzz(func(t *testing.T, hdr []byte, max int) {
+		if max < 0 {
+			max = -max
+		}
+		n, err := decodeMsgLen(hdr, max)
+		switch len(hdr) {
+		case 1, 2, 4, 8:
+		default:
+			if err == nil {
+				t.Fatalf("decoded a %d-byte header", len(hdr))
+			}
+			return
+		}
+		if err != nil {
+			if !errors.Is(err, ErrMsgTooLarge) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			return
+		}
+		if n < 0 || n > max {
+			t.Fatalf("decoded %d, limit is %d", n, max)
+		}
+		enc := make([]byte, len(hdr))
+		encodeMsgLen(enc, uint64(n))
+		if !bytes.Equal(enc, hdr) {
+			t.Fatalf("%x decoded to %d, which encodes to %x", hdr, n, enc)
+		}
+	})
+}
+
+func FuzzReadMsg(f *testing.F) {
+	f.Add([]byte{0, 3, 'a', 'b', 'c', 0, 0}, uint8(1), uint16(100))
+	f.Add([]byte{5, 'a'}, uint8(0), uint16(100))
+	f.Add([]byte{0, 0, 0, 200}, uint8(2), uint16(10))
+	f.Add([]byte{}, uint8(3), uint16(0))
+	pool := NewBufferPool()
+	f.Fuzz(func(t *testing.T, data []byte, size uint8, max uint16) {
+		hdr := make([]byte, []int{1, 2, 4, 8}[size%4])
+		r := bytes.NewReader(data)
+		rest := data
+		for {
+			msg, err := readMsg(r, hdr, int(max), pool)
+			if err != nil {
+				switch {
+				case err == io.EOF:
+					if len(rest) != 0 {
+						t.Fatalf("io.EOF with %d bytes left", len(rest))
+					}
+				case err == io.ErrUnexpectedEOF, errors.Is(err, ErrMsgTooLarge):
+				default:
+					t.Fatalf("unexpected error %v", err)
+				}
+				return
+			}
+			if len(msg) > int(max) {
+				t.Fatalf("read %d bytes, limit is %d", len(msg), max)
+			}
+			if !bytes.Equal(msg, rest[len(hdr):len(hdr)+len(msg)]) {
+				t.Fatal("message does not match the input")
+			}
+			rest = rest[len(hdr)+len(msg):]
+			pool.Put(msg)
+		}
+	})
+}
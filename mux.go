@@ -0,0 +1,1041 @@
+package rsocket
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Errors returned by MuxSession and MuxStream.
+var (
+	ErrSessionShutdown        = errors.New("rsocket: mux session shutdown")
+	ErrStreamClosed           = errors.New("rsocket: mux stream closed")
+	ErrStreamReset            = errors.New("rsocket: mux stream reset by peer")
+	ErrRemoteGoAway           = errors.New("rsocket: mux peer does not accept new streams")
+	ErrStreamsExhausted       = errors.New("rsocket: mux stream IDs exhausted")
+	ErrKeepAliveTimeout       = errors.New("rsocket: mux keepalive timeout")
+	ErrConnectionWriteTimeout = errors.New("rsocket: mux connection write timeout")
+)
+
+var _ net.Listener = (*MuxSession)(nil)
+var _ net.Conn = (*MuxStream)(nil)
+
+// mux wire format
+//
+// Every frame starts with a 12-byte header: version (1 byte), type (1 byte),
+// flags (2 bytes), stream ID (4 bytes) and length (4 bytes), all big-endian.
+// For data frames length is the size of the payload that follows, for window
+// updates it is the window increment, for pings an opaque value echoed back
+// and for go-away the reason code.
+const (
+	muxVersion    = 0
+	muxHeaderSize = 12
+
+	muxTypeData         = 0
+	muxTypeWindowUpdate = 1
+	muxTypePing         = 2
+	muxTypeGoAway       = 3
+
+	muxFlagSYN = 1 << 0 // opens a stream, or asks for a ping reply
+	muxFlagACK = 1 << 1 // acknowledges a stream, or replies to a ping
+	muxFlagFIN = 1 << 2 // half-closes a stream
+	muxFlagRST = 1 << 3 // resets a stream
+
+	muxGoAwayNormal   = 0
+	muxGoAwayProtoErr = 1
+
+	// muxInitialWindow is the receive window every stream starts with.
+	muxInitialWindow = 256 << 10
+)
+
+type muxHeader [muxHeaderSize]byte
+
+func (h *muxHeader) encode(typ uint8, flags uint16, streamID, length uint32) {
+	h[0] = muxVersion
+	h[1] = typ
+	binary.BigEndian.PutUint16(h[2:4], flags)
+	binary.BigEndian.PutUint32(h[4:8], streamID)
+	binary.BigEndian.PutUint32(h[8:12], length)
+}
+
+func (h *muxHeader) version() uint8   { return h[0] }
+func (h *muxHeader) typ() uint8       { return h[1] }
+func (h *muxHeader) flags() uint16    { return binary.BigEndian.Uint16(h[2:4]) }
+func (h *muxHeader) streamID() uint32 { return binary.BigEndian.Uint32(h[4:8]) }
+func (h *muxHeader) length() uint32   { return binary.BigEndian.Uint32(h[8:12]) }
+
+// MuxConfig configures a MuxSession. The zero value uses the defaults.
+type MuxConfig struct {
+	// AcceptBacklog is how many incoming streams may wait for AcceptStream
+	// before new ones are reset, default is 256.
+	AcceptBacklog int
+	// MaxStreamWindowSize is the receive window of each stream, which bounds
+	// the data buffered per stream. Default and minimum is 256KB.
+	MaxStreamWindowSize uint32
+	// KeepAliveInterval is how often the session pings the peer,
+	// default is 30s, a negative value disables keepalives.
+	KeepAliveInterval time.Duration
+	// ConnectionWriteTimeout bounds writing a frame and waiting for a ping
+	// reply, default is 10s.
+	ConnectionWriteTimeout time.Duration
+	// StreamCloseTimeout is how long a closed stream waits for the peer to
+	// close its side before it is reset, default is 5m.
+	StreamCloseTimeout time.Duration
+}
+
+func (cfg *MuxConfig) setDefaults() {
+	if cfg.AcceptBacklog <= 0 {
+		cfg.AcceptBacklog = 256
+	}
+	if cfg.MaxStreamWindowSize < muxInitialWindow {
+		cfg.MaxStreamWindowSize = muxInitialWindow
+	}
+	if cfg.KeepAliveInterval == 0 {
+		cfg.KeepAliveInterval = 30 * time.Second
+	}
+	if cfg.ConnectionWriteTimeout <= 0 {
+		cfg.ConnectionWriteTimeout = 10 * time.Second
+	}
+	if cfg.StreamCloseTimeout <= 0 {
+		cfg.StreamCloseTimeout = 5 * time.Minute
+	}
+}
+
+// MuxSession multiplexes many streams over a single connection, so a service
+// can run thousands of logical connections over a handful of rsocket queue
+// pairs and their registered buffers. The protocol is modeled after yamux.
+//
+// A MuxSession is also a net.Listener whose Accept returns incoming streams.
+type MuxSession struct {
+	cfg  MuxConfig
+	conn net.Conn
+
+	localGoAway  atomic.Bool
+	remoteGoAway atomic.Bool
+
+	streamLock   sync.Mutex
+	streams      map[uint32]*MuxStream
+	nextStreamID uint32
+
+	pingLock sync.Mutex
+	pings    map[uint32]chan struct{}
+	pingID   uint32
+
+	acceptCh chan *MuxStream
+	sendCh   chan *muxSend
+	pongCh   chan uint32 // pings to answer, bounded so a ping flood is dropped
+
+	shutdownLock sync.Mutex
+	shutdown     bool
+	shutdownErr  error
+	shutdownCh   chan struct{}
+
+	// the connection is closed by the last of recvLoop and sendLoop to
+	// exit, so that no read or write is in flight on a reused fd
+	loops     atomic.Int32
+	closeErr  error
+	connClose chan struct{} // closed once the connection is closed
+}
+
+type muxSend struct {
+	hdr  muxHeader
+	body []byte
+	err  chan error // nil if nobody waits
+
+	mu      sync.Mutex
+	taken   bool // sendLoop is writing the frame
+	dropped bool // the sender gave up before sendLoop took the frame
+}
+
+// take reports whether the frame is still to be written and marks it taken.
+func (r *muxSend) take() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.taken = !r.dropped
+	return r.taken
+}
+
+// drop withdraws the frame if sendLoop has not taken it yet, and reports
+// whether it did.
+func (r *muxSend) drop() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dropped = !r.taken
+	return r.dropped
+}
+
+// NewMuxClient starts the client side of a session over conn.
+func NewMuxClient(conn net.Conn, config MuxConfig) *MuxSession {
+	return newMuxSession(conn, config, true)
+}
+
+// NewMuxServer starts the server side of a session over conn.
+func NewMuxServer(conn net.Conn, config MuxConfig) *MuxSession {
+	return newMuxSession(conn, config, false)
+}
+
+func newMuxSession(conn net.Conn, config MuxConfig, client bool) *MuxSession {
+	config.setDefaults()
+
+	s := &MuxSession{
+		cfg:        config,
+		conn:       conn,
+		streams:    make(map[uint32]*MuxStream),
+		pings:      make(map[uint32]chan struct{}),
+		acceptCh:   make(chan *MuxStream, config.AcceptBacklog),
+		sendCh:     make(chan *muxSend, 64),
+		pongCh:     make(chan uint32, 64),
+		shutdownCh: make(chan struct{}),
+		connClose:  make(chan struct{}),
+	}
+	// clients open odd streams, servers even ones
+	if client {
+		s.nextStreamID = 1
+	} else {
+		s.nextStreamID = 2
+	}
+
+	s.loops.Store(2)
+	go s.recvLoop()
+	go s.sendLoop()
+	if config.KeepAliveInterval > 0 {
+		go s.keepalive()
+	}
+	return s
+}
+
+// OpenStream opens a new stream to the peer.
+func (s *MuxSession) OpenStream() (*MuxStream, error) {
+	if s.IsClosed() {
+		return nil, ErrSessionShutdown
+	}
+	if s.remoteGoAway.Load() {
+		return nil, ErrRemoteGoAway
+	}
+
+	s.streamLock.Lock()
+	id := s.nextStreamID
+	if id >= math.MaxUint32-1 {
+		s.streamLock.Unlock()
+		return nil, ErrStreamsExhausted
+	}
+	s.nextStreamID += 2
+	stream := newMuxStream(s, id, muxStreamInit)
+	s.streams[id] = stream
+	s.streamLock.Unlock()
+
+	// announces the stream with a SYN
+	if err := stream.sendWindowUpdate(); err != nil {
+		s.closeStream(id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Open opens a new stream as a net.Conn.
+func (s *MuxSession) Open() (net.Conn, error) {
+	return s.OpenStream()
+}
+
+// AcceptStream waits for the next stream opened by the peer.
+func (s *MuxSession) AcceptStream() (*MuxStream, error) {
+	select {
+	case stream := <-s.acceptCh:
+		// acknowledges the stream with an ACK
+		if err := stream.sendWindowUpdate(); err != nil {
+			return nil, err
+		}
+		return stream, nil
+	case <-s.shutdownCh:
+		return nil, s.err()
+	}
+}
+
+// Accept waits for the next stream opened by the peer, it implements net.Listener.
+func (s *MuxSession) Accept() (net.Conn, error) {
+	return s.AcceptStream()
+}
+
+// Addr returns the local address of the session connection.
+func (s *MuxSession) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// NumStreams returns the number of open streams.
+func (s *MuxSession) NumStreams() int {
+	s.streamLock.Lock()
+	defer s.streamLock.Unlock()
+	return len(s.streams)
+}
+
+// GoAway tells the peer that no new streams will be accepted. Existing
+// streams keep working; use Drain to wait for them.
+func (s *MuxSession) GoAway() error {
+	s.localGoAway.Store(true)
+	var hdr muxHeader
+	hdr.encode(muxTypeGoAway, 0, 0, muxGoAwayNormal)
+	return s.waitForSend(hdr, nil)
+}
+
+// Drain sends a go-away, waits up to timeout for the open streams to finish
+// and then closes the session.
+func (s *MuxSession) Drain(timeout time.Duration) error {
+	if err := s.GoAway(); err != nil {
+		s.Close()
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for s.NumStreams() > 0 && time.Now().Before(deadline) {
+		select {
+		case <-ticker.C:
+		case <-s.shutdownCh:
+			return nil
+		}
+	}
+	return s.Close()
+}
+
+// Ping sends a ping and returns the round-trip time.
+func (s *MuxSession) Ping() (time.Duration, error) {
+	ch := make(chan struct{})
+	s.pingLock.Lock()
+	id := s.pingID
+	s.pingID++
+	s.pings[id] = ch
+	s.pingLock.Unlock()
+
+	defer func() {
+		s.pingLock.Lock()
+		delete(s.pings, id)
+		s.pingLock.Unlock()
+	}()
+
+	var hdr muxHeader
+	hdr.encode(muxTypePing, muxFlagSYN, 0, id)
+	start := time.Now()
+	if err := s.waitForSend(hdr, nil); err != nil {
+		return 0, err
+	}
+
+	timer := time.NewTimer(s.cfg.ConnectionWriteTimeout)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return time.Since(start), nil
+	case <-timer.C:
+		return 0, ErrKeepAliveTimeout
+	case <-s.shutdownCh:
+		return 0, s.err()
+	}
+}
+
+// IsClosed reports whether the session is shut down.
+func (s *MuxSession) IsClosed() bool {
+	select {
+	case <-s.shutdownCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// CloseChan returns a channel that is closed when the session shuts down.
+func (s *MuxSession) CloseChan() <-chan struct{} {
+	return s.shutdownCh
+}
+
+// Close closes the session, its streams and the underlying connection. It
+// returns once the connection is closed.
+func (s *MuxSession) Close() error {
+	s.stop()
+	<-s.connClose
+	return s.closeErr
+}
+
+// stop shuts the session down and interrupts the connection, which is
+// closed once the loops exited.
+func (s *MuxSession) stop() {
+	s.shutdownLock.Lock()
+	if s.shutdown {
+		s.shutdownLock.Unlock()
+		return
+	}
+	s.shutdown = true
+	if s.shutdownErr == nil {
+		s.shutdownErr = ErrSessionShutdown
+	}
+	close(s.shutdownCh)
+	interruptConn(s.conn)
+	s.shutdownLock.Unlock()
+
+	s.streamLock.Lock()
+	for _, stream := range s.streams {
+		stream.forceClose()
+	}
+	s.streamLock.Unlock()
+}
+
+// loopDone is called by recvLoop and sendLoop when they exit.
+func (s *MuxSession) loopDone() {
+	if s.loops.Add(-1) == 0 {
+		s.closeErr = s.conn.Close()
+		close(s.connClose)
+	}
+}
+
+// exitErr shuts the session down because of err. It does not wait for the
+// loops, which call it themselves.
+func (s *MuxSession) exitErr(err error) {
+	s.shutdownLock.Lock()
+	if s.shutdownErr == nil {
+		s.shutdownErr = err
+	}
+	s.shutdownLock.Unlock()
+	s.stop()
+}
+
+func (s *MuxSession) err() error {
+	s.shutdownLock.Lock()
+	defer s.shutdownLock.Unlock()
+	if s.shutdownErr == nil || s.shutdownErr == io.EOF {
+		return ErrSessionShutdown
+	}
+	return s.shutdownErr
+}
+
+// waitForSend queues a frame and waits until it is written. On timeout a
+// frame still queued is withdrawn, so body is not written after it returns;
+// one already being written fails the session instead.
+func (s *MuxSession) waitForSend(hdr muxHeader, body []byte) error {
+	req := &muxSend{hdr: hdr, body: body, err: make(chan error, 1)}
+	timer := time.NewTimer(s.cfg.ConnectionWriteTimeout)
+	defer timer.Stop()
+
+	select {
+	case s.sendCh <- req:
+	case <-s.shutdownCh:
+		return s.err()
+	case <-timer.C:
+		return ErrConnectionWriteTimeout
+	}
+
+	select {
+	case err := <-req.err:
+		return err
+	case <-s.shutdownCh:
+		req.drop()
+		return s.err()
+	case <-timer.C:
+		if !req.drop() {
+			// the peer may get part of the frame, the stream cannot go on
+			s.exitErr(ErrConnectionWriteTimeout)
+		}
+		return ErrConnectionWriteTimeout
+	}
+}
+
+// sendNoWait queues a control frame without waiting for it to be written.
+func (s *MuxSession) sendNoWait(hdr muxHeader) error {
+	timer := time.NewTimer(s.cfg.ConnectionWriteTimeout)
+	defer timer.Stop()
+
+	select {
+	case s.sendCh <- &muxSend{hdr: hdr}:
+		return nil
+	case <-s.shutdownCh:
+		return s.err()
+	case <-timer.C:
+		return ErrConnectionWriteTimeout
+	}
+}
+
+// sendLoop writes queued frames. Header and payload go out in one rwritev
+// call on a TCPConn.
+func (s *MuxSession) sendLoop() {
+	defer s.loopDone()
+	for {
+		select {
+		case id := <-s.pongCh:
+			var pong muxHeader
+			pong.encode(muxTypePing, muxFlagACK, 0, id)
+			if err := s.writeFrame(pong[:], nil); err != nil {
+				s.exitErr(err)
+				return
+			}
+		case req := <-s.sendCh:
+			if !req.take() {
+				continue
+			}
+			err := s.writeFrame(req.hdr[:], req.body)
+			if req.err != nil {
+				req.err <- err
+			}
+			if err != nil {
+				s.exitErr(err)
+				return
+			}
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
+
+func (s *MuxSession) writeFrame(hdr, body []byte) error {
+	if tc, ok := s.conn.(*TCPConn); ok {
+		_, err := tc.Writev([][]byte{hdr, body})
+		return err
+	}
+	if len(body) == 0 {
+		_, err := s.conn.Write(hdr)
+		return err
+	}
+	bufs := net.Buffers{hdr, body}
+	_, err := bufs.WriteTo(s.conn)
+	return err
+}
+
+// recvLoop reads and dispatches frames until the connection fails.
+func (s *MuxSession) recvLoop() {
+	defer s.loopDone()
+	var hdr muxHeader
+	for {
+		if _, err := io.ReadFull(s.conn, hdr[:]); err != nil {
+			s.exitErr(err)
+			return
+		}
+		if hdr.version() != muxVersion {
+			s.goAwayProtoErr()
+			s.exitErr(fmt.Errorf("rsocket: mux protocol version %d not supported", hdr.version()))
+			return
+		}
+
+		var err error
+		switch hdr.typ() {
+		case muxTypeData, muxTypeWindowUpdate:
+			err = s.handleStreamMessage(&hdr)
+		case muxTypePing:
+			s.handlePing(&hdr)
+		case muxTypeGoAway:
+			err = s.handleGoAway(&hdr)
+		default:
+			s.goAwayProtoErr()
+			err = fmt.Errorf("rsocket: mux frame type %d not supported", hdr.typ())
+		}
+		if err != nil {
+			s.exitErr(err)
+			return
+		}
+	}
+}
+
+func (s *MuxSession) goAwayProtoErr() {
+	var hdr muxHeader
+	hdr.encode(muxTypeGoAway, 0, 0, muxGoAwayProtoErr)
+	s.sendNoWait(hdr)
+}
+
+func (s *MuxSession) handleStreamMessage(hdr *muxHeader) error {
+	id, flags := hdr.streamID(), hdr.flags()
+	if flags&muxFlagSYN != 0 {
+		if err := s.incomingStream(id); err != nil {
+			return err
+		}
+	}
+
+	s.streamLock.Lock()
+	stream := s.streams[id]
+	s.streamLock.Unlock()
+
+	if stream == nil {
+		// late frames of a stream that was already closed or reset
+		if hdr.typ() == muxTypeData && hdr.length() > 0 {
+			if _, err := io.CopyN(io.Discard, s.conn, int64(hdr.length())); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if hdr.typ() == muxTypeWindowUpdate {
+		stream.incrSendWindow(hdr.length(), flags)
+		return nil
+	}
+	return stream.readData(hdr.length(), flags, s.conn)
+}
+
+func (s *MuxSession) incomingStream(id uint32) error {
+	var rst muxHeader
+	rst.encode(muxTypeWindowUpdate, muxFlagRST, id, 0)
+	if s.localGoAway.Load() {
+		return s.sendNoWait(rst)
+	}
+
+	stream := newMuxStream(s, id, muxStreamSYNReceived)
+
+	s.streamLock.Lock()
+	if id%2 == s.nextStreamID%2 {
+		s.streamLock.Unlock()
+		s.goAwayProtoErr()
+		return fmt.Errorf("rsocket: mux peer opened stream %d with our parity", id)
+	}
+	if _, ok := s.streams[id]; ok {
+		s.streamLock.Unlock()
+		s.goAwayProtoErr()
+		return fmt.Errorf("rsocket: mux peer opened duplicate stream %d", id)
+	}
+	s.streams[id] = stream
+	s.streamLock.Unlock()
+
+	select {
+	case s.acceptCh <- stream:
+		return nil
+	default:
+		// backlog exceeded
+		s.closeStream(id)
+		return s.sendNoWait(rst)
+	}
+}
+
+func (s *MuxSession) handlePing(hdr *muxHeader) {
+	flags, id := hdr.flags(), hdr.length()
+	if flags&muxFlagSYN != 0 {
+		// do not block reading on a congested writer, and drop the pings
+		// of a peer that sends them faster than they can be answered
+		select {
+		case s.pongCh <- id:
+		default:
+		}
+		return
+	}
+
+	s.pingLock.Lock()
+	ch := s.pings[id]
+	if ch != nil {
+		delete(s.pings, id)
+		close(ch)
+	}
+	s.pingLock.Unlock()
+}
+
+func (s *MuxSession) handleGoAway(hdr *muxHeader) error {
+	s.remoteGoAway.Store(true)
+	if code := hdr.length(); code != muxGoAwayNormal {
+		return fmt.Errorf("rsocket: mux peer went away with error code %d", code)
+	}
+	return nil
+}
+
+func (s *MuxSession) keepalive() {
+	ticker := time.NewTicker(s.cfg.KeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := s.Ping(); err != nil {
+				if err == ErrKeepAliveTimeout {
+					s.exitErr(err)
+				}
+				return
+			}
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
+
+func (s *MuxSession) closeStream(id uint32) {
+	s.streamLock.Lock()
+	delete(s.streams, id)
+	s.streamLock.Unlock()
+}
+
+type muxStreamState int
+
+const (
+	muxStreamInit muxStreamState = iota
+	muxStreamSYNSent
+	muxStreamSYNReceived
+	muxStreamEstablished
+	muxStreamLocalClose
+	muxStreamRemoteClose
+	muxStreamClosed
+	muxStreamReset
+)
+
+// MuxStream is a stream of a MuxSession. It implements net.Conn with
+// per-stream flow control and deadlines.
+type MuxStream struct {
+	id      uint32
+	session *MuxSession
+
+	mu            sync.Mutex
+	state         muxStreamState
+	err           error // set when the session shut the stream down
+	recvBuf       []byte
+	recvWindow    uint32 // bytes the peer may still send
+	sendWindow    uint32 // bytes we may still send
+	readDeadline  time.Time
+	writeDeadline time.Time
+	closeTimer    *time.Timer
+
+	writeMu    sync.Mutex
+	recvNotify chan struct{}
+	sendNotify chan struct{}
+}
+
+func newMuxStream(s *MuxSession, id uint32, state muxStreamState) *MuxStream {
+	return &MuxStream{
+		id:         id,
+		session:    s,
+		state:      state,
+		recvWindow: muxInitialWindow,
+		sendWindow: muxInitialWindow,
+		recvNotify: make(chan struct{}, 1),
+		sendNotify: make(chan struct{}, 1),
+	}
+}
+
+func asyncNotify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// StreamID returns the ID of the stream.
+func (st *MuxStream) StreamID() uint32 {
+	return st.id
+}
+
+// Session returns the session of the stream.
+func (st *MuxStream) Session() *MuxSession {
+	return st.session
+}
+
+// Read reads data from the stream. It returns io.EOF once the peer closed
+// the stream and all data was read.
+func (st *MuxStream) Read(b []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if len(st.recvBuf) > 0 {
+			n := copy(b, st.recvBuf)
+			st.recvBuf = st.recvBuf[n:]
+			st.mu.Unlock()
+			st.sendWindowUpdate()
+			return n, nil
+		}
+		switch st.state {
+		case muxStreamRemoteClose, muxStreamClosed:
+			err := st.err
+			st.mu.Unlock()
+			if err != nil {
+				return 0, err
+			}
+			return 0, io.EOF
+		case muxStreamReset:
+			st.mu.Unlock()
+			return 0, ErrStreamReset
+		}
+		deadline := st.readDeadline
+		st.mu.Unlock()
+
+		if err := st.wait(st.recvNotify, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write writes data to the stream, blocking while the peer's receive window is full.
+func (st *MuxStream) Write(b []byte) (int, error) {
+	st.writeMu.Lock()
+	defer st.writeMu.Unlock()
+
+	total := 0
+	for total < len(b) {
+		n, err := st.write(b[total:])
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (st *MuxStream) write(b []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		switch st.state {
+		case muxStreamLocalClose, muxStreamClosed:
+			err := st.err
+			st.mu.Unlock()
+			if err != nil {
+				return 0, err
+			}
+			return 0, ErrStreamClosed
+		case muxStreamReset:
+			st.mu.Unlock()
+			return 0, ErrStreamReset
+		}
+
+		if st.sendWindow == 0 {
+			deadline := st.writeDeadline
+			st.mu.Unlock()
+			if err := st.wait(st.sendNotify, deadline); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		n := uint32(len(b))
+		if n > st.sendWindow {
+			n = st.sendWindow
+		}
+		st.sendWindow -= n
+		flags := st.sendFlags()
+		st.mu.Unlock()
+
+		var hdr muxHeader
+		hdr.encode(muxTypeData, flags, st.id, n)
+		if err := st.session.waitForSend(hdr, b[:n]); err != nil {
+			// the frame was not sent, or the session is shut down
+			st.mu.Lock()
+			st.sendWindow += n
+			st.mu.Unlock()
+			return 0, err
+		}
+		return int(n), nil
+	}
+}
+
+// wait waits for a notification on ch, the deadline or the session shutdown.
+func (st *MuxStream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-ch:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	case <-st.session.shutdownCh:
+		return st.session.err()
+	}
+}
+
+// sendFlags returns the flags the next frame must carry to open or
+// acknowledge the stream. It must be called with st.mu held.
+func (st *MuxStream) sendFlags() uint16 {
+	switch st.state {
+	case muxStreamInit:
+		st.state = muxStreamSYNSent
+		return muxFlagSYN
+	case muxStreamSYNReceived:
+		st.state = muxStreamEstablished
+		return muxFlagACK
+	}
+	return 0
+}
+
+// sendWindowUpdate grows the peer's send window once the application has
+// consumed at least half of the receive window.
+func (st *MuxStream) sendWindowUpdate() error {
+	st.mu.Lock()
+	max := st.session.cfg.MaxStreamWindowSize
+	delta := (max - uint32(len(st.recvBuf))) - st.recvWindow
+	flags := st.sendFlags()
+	if delta < max/2 && flags == 0 {
+		st.mu.Unlock()
+		return nil
+	}
+	st.recvWindow += delta
+	st.mu.Unlock()
+
+	var hdr muxHeader
+	hdr.encode(muxTypeWindowUpdate, flags, st.id, delta)
+	return st.session.sendNoWait(hdr)
+}
+
+// processFlags applies the ACK, FIN and RST flags of a received frame.
+func (st *MuxStream) processFlags(flags uint16) {
+	st.mu.Lock()
+	closeStream := false
+	if flags&muxFlagACK != 0 && st.state == muxStreamSYNSent {
+		st.state = muxStreamEstablished
+	}
+	if flags&muxFlagFIN != 0 {
+		switch st.state {
+		case muxStreamSYNSent, muxStreamSYNReceived, muxStreamEstablished:
+			st.state = muxStreamRemoteClose
+		case muxStreamLocalClose:
+			st.state = muxStreamClosed
+			closeStream = true
+		}
+	}
+	if flags&muxFlagRST != 0 {
+		st.state = muxStreamReset
+		closeStream = true
+	}
+	if closeStream && st.closeTimer != nil {
+		st.closeTimer.Stop()
+	}
+	st.mu.Unlock()
+
+	if closeStream {
+		st.session.closeStream(st.id)
+	}
+	asyncNotify(st.recvNotify)
+	asyncNotify(st.sendNotify)
+}
+
+func (st *MuxStream) incrSendWindow(delta uint32, flags uint16) {
+	st.processFlags(flags)
+	st.mu.Lock()
+	st.sendWindow += delta
+	st.mu.Unlock()
+	asyncNotify(st.sendNotify)
+}
+
+func (st *MuxStream) readData(length uint32, flags uint16, conn io.Reader) error {
+	st.processFlags(flags)
+	if length == 0 {
+		return nil
+	}
+
+	st.mu.Lock()
+	if length > st.recvWindow {
+		st.mu.Unlock()
+		st.session.goAwayProtoErr()
+		return fmt.Errorf("rsocket: mux stream %d received %d bytes over its window of %d", st.id, length, st.recvWindow)
+	}
+	st.mu.Unlock()
+
+	buf := DefaultBufferPool.Get(int(length))
+	defer DefaultBufferPool.Put(buf)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+
+	// the window shrinks with the buffer growing so that a concurrent
+	// sendWindowUpdate does not count the bytes being read as consumed
+	st.mu.Lock()
+	st.recvWindow -= length
+	st.recvBuf = append(st.recvBuf, buf...)
+	st.mu.Unlock()
+	asyncNotify(st.recvNotify)
+	return nil
+}
+
+// Close half-closes the stream: the peer reads io.EOF after the data
+// already written, and the stream is released once the peer closes too.
+func (st *MuxStream) Close() error {
+	st.mu.Lock()
+	closeStream := false
+	switch st.state {
+	case muxStreamInit, muxStreamSYNSent, muxStreamSYNReceived, muxStreamEstablished:
+		st.state = muxStreamLocalClose
+	case muxStreamRemoteClose:
+		st.state = muxStreamClosed
+		closeStream = true
+	default:
+		st.mu.Unlock()
+		return nil
+	}
+	flags := st.sendFlags() | muxFlagFIN
+	if !closeStream {
+		// reset the stream if the peer never closes its side
+		st.closeTimer = time.AfterFunc(st.session.cfg.StreamCloseTimeout, st.closeTimeout)
+	}
+	st.mu.Unlock()
+
+	var hdr muxHeader
+	hdr.encode(muxTypeWindowUpdate, flags, st.id, 0)
+	err := st.session.waitForSend(hdr, nil)
+
+	if closeStream {
+		st.session.closeStream(st.id)
+	}
+	asyncNotify(st.recvNotify)
+	asyncNotify(st.sendNotify)
+	return err
+}
+
+func (st *MuxStream) closeTimeout() {
+	st.mu.Lock()
+	if st.state != muxStreamLocalClose {
+		st.mu.Unlock()
+		return
+	}
+	st.state = muxStreamReset
+	st.mu.Unlock()
+
+	st.session.closeStream(st.id)
+	var hdr muxHeader
+	hdr.encode(muxTypeWindowUpdate, muxFlagRST, st.id, 0)
+	st.session.sendNoWait(hdr)
+}
+
+// forceClose closes the stream because the session shut down.
+func (st *MuxStream) forceClose() {
+	st.mu.Lock()
+	st.state = muxStreamClosed
+	st.err = ErrSessionShutdown
+	if st.closeTimer != nil {
+		st.closeTimer.Stop()
+	}
+	st.mu.Unlock()
+	asyncNotify(st.recvNotify)
+	asyncNotify(st.sendNotify)
+}
+
+// LocalAddr returns the local address of the session connection.
+func (st *MuxStream) LocalAddr() net.Addr {
+	return st.session.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the session connection.
+func (st *MuxStream) RemoteAddr() net.Addr {
+	return st.session.conn.RemoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines of the stream.
+func (st *MuxStream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	st.SetWriteDeadline(t)
+	return nil
+}
+
+// SetReadDeadline sets the read deadline of the stream.
+func (st *MuxStream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	asyncNotify(st.recvNotify)
+	return nil
+}
+
+// SetWriteDeadline sets the write deadline of the stream.
+func (st *MuxStream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	asyncNotify(st.sendNotify)
+	return nil
+}
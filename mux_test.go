@@ -0,0 +1,288 @@
+package rsocket
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// testMuxPair returns a client and a server session over net.Pipe.
+func testMuxPair(t *testing.T, cfg MuxConfig) (client, server *MuxSession) {
+	t.Helper()
+	a, b := net.Pipe()
+	client, server = NewMuxClient(a, cfg), NewMuxServer(b, cfg)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestMuxOpenAccept(t *testing.T) {
+	client, server := testMuxPair(t, MuxConfig{KeepAliveInterval: -1})
+
+	for i := range 3 {
+		stream, err := client.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		peer, err := server.AcceptStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// clients open odd streams
+		if stream.StreamID() != uint32(2*i+1) || peer.StreamID() != stream.StreamID() {
+			t.Fatalf("got stream IDs %d and %d, want %d", stream.StreamID(), peer.StreamID(), 2*i+1)
+		}
+
+		if _, err := stream.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		stream.Close()
+		got, err := io.ReadAll(peer)
+		if err != nil || string(got) != "hello" {
+			t.Fatalf("got %q, %v, want hello", got, err)
+		}
+		peer.Close()
+	}
+
+	// a server stream the other way
+	stream, err := server.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := client.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stream.StreamID() != 2 || peer.StreamID() != 2 {
+		t.Fatalf("got stream IDs %d and %d, want 2", stream.StreamID(), peer.StreamID())
+	}
+}
+
+func TestMuxEcho(t *testing.T) {
+	client, server := testMuxPair(t, MuxConfig{KeepAliveInterval: -1})
+
+	go func() {
+		for {
+			stream, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer stream.Close()
+				io.Copy(stream, stream)
+			}()
+		}
+	}()
+
+	for range 4 {
+		stream, err := client.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := bytes.Repeat([]byte("abc"), 1000)
+		go func() {
+			stream.Write(msg)
+			stream.Close()
+		}()
+		got, err := io.ReadAll(stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("got %d bytes back, want %d", len(got), len(msg))
+		}
+	}
+	if _, err := client.Ping(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMuxFlowControl(t *testing.T) {
+	client, server := testMuxPair(t, MuxConfig{KeepAliveInterval: -1})
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the peer does not read: writing stops at its receive window
+	stream.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	data := make([]byte, 2*muxInitialWindow)
+	n, err := stream.Write(data)
+	if !errors.Is(err, os.ErrDeadlineExceeded) || n != muxInitialWindow {
+		t.Fatalf("got %d, %v writing past the window, want %d and a deadline error", n, err, muxInitialWindow)
+	}
+
+	// reading reopens the window
+	stream.SetWriteDeadline(time.Time{})
+	done := make(chan error, 1)
+	go func() {
+		_, err := stream.Write(data[n:])
+		done <- err
+	}()
+	if _, err := io.ReadFull(peer, make([]byte, len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMuxGoAway(t *testing.T) {
+	client, server := testMuxPair(t, MuxConfig{KeepAliveInterval: -1})
+	if err := server.GoAway(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, err := client.OpenStream()
+		if errors.Is(err, ErrRemoteGoAway) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %v opening streams after a go-away, want ErrRemoteGoAway", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the server still opens streams of its own
+	if _, err := server.OpenStream(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readMuxFrame reads a frame written by a session, returning its header.
+func readMuxFrame(t *testing.T, r io.Reader) muxHeader {
+	t.Helper()
+	var hdr muxHeader
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		t.Fatal(err)
+	}
+	if hdr.typ() == muxTypeData {
+		if _, err := io.CopyN(io.Discard, r, int64(hdr.length())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return hdr
+}
+
+func TestMuxWriteTimeout(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	s := NewMuxClient(a, MuxConfig{KeepAliveInterval: -1, ConnectionWriteTimeout: 50 * time.Millisecond})
+	defer s.Close()
+
+	// nobody reads b: the SYN blocks the send loop and the data frame
+	// stays queued until it times out
+	stream, err := s.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := stream.Write([]byte("lost"))
+	if n != 0 || !errors.Is(err, ErrConnectionWriteTimeout) {
+		t.Fatalf("got %d, %v, want 0 and ErrConnectionWriteTimeout", n, err)
+	}
+	stream.mu.Lock()
+	window := stream.sendWindow
+	stream.mu.Unlock()
+	if window != muxInitialWindow {
+		t.Errorf("got a send window of %d after the timeout, want %d", window, muxInitialWindow)
+	}
+
+	// the withdrawn frame is never written, the next one is
+	if hdr := readMuxFrame(t, b); hdr.typ() != muxTypeWindowUpdate || hdr.flags()&muxFlagSYN == 0 {
+		t.Fatalf("got frame type %d flags %#x, want the SYN", hdr.typ(), hdr.flags())
+	}
+	go stream.Write([]byte("sent"))
+	if hdr := readMuxFrame(t, b); hdr.typ() != muxTypeData || hdr.length() != 4 {
+		t.Fatalf("got frame type %d length %d, want the second write", hdr.typ(), hdr.length())
+	}
+}
+
+func TestMuxKeepAliveTimeout(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	// the peer reads everything and answers nothing
+	go io.Copy(io.Discard, b)
+	s := NewMuxClient(a, MuxConfig{KeepAliveInterval: 20 * time.Millisecond, ConnectionWriteTimeout: 50 * time.Millisecond})
+	defer s.Close()
+
+	select {
+	case <-s.CloseChan():
+	case <-time.After(time.Second):
+		t.Fatal("session still open without ping replies")
+	}
+	if _, err := s.AcceptStream(); !errors.Is(err, ErrKeepAliveTimeout) {
+		t.Fatalf("got %v, want ErrKeepAliveTimeout", err)
+	}
+}
+
+func TestMuxPingFlood(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	s := NewMuxServer(a, MuxConfig{KeepAliveInterval: -1})
+	defer s.Close()
+
+	// pings are answered as the peer reads, the others dropped
+	go func() {
+		var ping muxHeader
+		for i := range 1000 {
+			ping.encode(muxTypePing, muxFlagSYN, 0, uint32(i))
+			if _, err := b.Write(ping[:]); err != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	b.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	pongs := 0
+	for {
+		var hdr muxHeader
+		if _, err := io.ReadFull(b, hdr[:]); err != nil {
+			break
+		}
+		if hdr.typ() != muxTypePing || hdr.flags() != muxFlagACK {
+			t.Fatalf("got frame type %d flags %#x, want a pong", hdr.typ(), hdr.flags())
+		}
+		pongs++
+	}
+	if pongs == 0 || pongs > cap(s.pongCh)+1 {
+		t.Errorf("got %d pongs for 1000 pings read late, want 1 to %d", pongs, cap(s.pongCh)+1)
+	}
+}
+
+func TestMuxClose(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	go io.Copy(io.Discard, b)
+	conn := &closeCounter{Conn: a}
+	s := NewMuxClient(conn, MuxConfig{KeepAliveInterval: -1})
+	stream, err := s.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the receive loop is blocked reading when the session closes
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if conn.closes != 1 {
+		t.Fatalf("got %d closes of the connection, want 1", conn.closes)
+	}
+	s.Close()
+	if conn.closes != 1 {
+		t.Fatalf("got %d closes after a second Close, want 1", conn.closes)
+	}
+	if _, err := stream.Write([]byte("x")); !errors.Is(err, ErrSessionShutdown) {
+		t.Fatalf("got %v writing to a stream of a closed session, want ErrSessionShutdown", err)
+	}
+}
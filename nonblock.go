@@ -0,0 +1,108 @@
+package rsocket
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"time"
+)
+
+// ErrWouldBlock is returned by TryRead and TryWrite when the operation
+// cannot make progress without blocking.
+var ErrWouldBlock = errors.New("rsocket: operation would block")
+
+// WithNonblock puts the socket in nonblocking mode. DialTCP then returns as
+// soon as the connection is initiated, use WaitConnect to wait for it to be
+// established. Reads and writes on the connection fail with EAGAIN instead of
+// blocking, see TryRead and TryWrite.
+func WithNonblock() OptionSocketFn {
+	return func(fd int) error {
+		if s := lookupSetup(fd); s != nil {
+			s.nonblock = true
+		}
+		return SetNonblock(fd, true)
+	}
+}
+
+// SetNonblock sets or clears nonblocking mode on the connection.
+func (c *TCPConn) SetNonblock(nonblocking bool) error {
+	return SetNonblock(c.fd, nonblocking)
+}
+
+// WaitConnect waits up to timeout for a connection dialed WithNonblock to be
+// established and returns its SO_ERROR. A negative timeout waits forever,
+// os.ErrDeadlineExceeded is returned if the timeout expires.
+func (c *TCPConn) WaitConnect(timeout time.Duration) error {
+	ctx := context.Background()
+	if timeout >= 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	err := waitConnect(ctx, c.fd)
+	if err == context.DeadlineExceeded {
+		return os.ErrDeadlineExceeded
+	}
+	return err
+}
+
+// TryRead reads without blocking, whatever the mode of the socket. It returns
+// ErrWouldBlock if no data is available and io.EOF once the peer has closed
+// the connection.
+func (c *TCPConn) TryRead(p []byte) (int, error) {
+	start := c.trace.now()
+	n, err := Recv(c.fd, p, MSG_DONTWAIT)
+	if n == 0 && err == nil && len(p) > 0 {
+		err = io.EOF
+	}
+	if err == syscall.EAGAIN {
+		c.trace.read(c.fd, 0, ErrWouldBlock, start)
+		return 0, ErrWouldBlock
+	}
+	recordRead(n, err)
+	c.bytesRead.Add(uint64(n))
+	c.captureRead(p[:max(n, 0)], err)
+	c.trace.read(c.fd, n, err, start)
+	return n, err
+}
+
+// TryWrite writes without blocking, whatever the mode of the socket. It may
+// write only part of p and returns ErrWouldBlock if nothing could be written.
+func (c *TCPConn) TryWrite(p []byte) (int, error) {
+	start := c.trace.now()
+	n, err := Send(c.fd, p, MSG_DONTWAIT)
+	if err == syscall.EAGAIN {
+		c.trace.write(c.fd, 0, ErrWouldBlock, start)
+		return 0, ErrWouldBlock
+	}
+	recordWrite(n, err)
+	c.bytesWritten.Add(uint64(n))
+	c.capture.Load().data(true, p[:max(n, 0)])
+	c.trace.write(c.fd, n, err, start)
+	return n, err
+}
+
+// SetNonblock sets or clears nonblocking mode on the connection.
+func (c *UDPConn) SetNonblock(nonblocking bool) error {
+	return SetNonblock(c.fd, nonblocking)
+}
+
+// TryRead reads a datagram without blocking, whatever the mode of the
+// socket. It returns ErrWouldBlock if none is available.
+func (c *UDPConn) TryRead(p []byte) (int, error) {
+	n, _, err := c.recv(p, MSG_DONTWAIT)
+	return n, err
+}
+
+// TryWrite sends p as a datagram to the peer without blocking, whatever the
+// mode of the socket. It returns ErrWouldBlock if the socket cannot take it
+// now, or if a UDPConn from ListenUDP has not received a datagram yet.
+func (c *UDPConn) TryWrite(p []byte) (int, error) {
+	peer := c.currentPeer()
+	if peer == nil {
+		return 0, ErrWouldBlock
+	}
+	return c.send(p, MSG_DONTWAIT, peer)
+}
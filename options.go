@@ -0,0 +1,174 @@
+package rsocket
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+// OptionStage is the point of a socket's life at which an option is applied.
+type OptionStage int
+
+const (
+	// StagePreBind applies the option right after the socket is created,
+	// before it is bound. Options without a stage run there.
+	StagePreBind OptionStage = iota
+	// StagePreConnect applies the option after bind, right before rconnect
+	// or rlisten. This is the last point at which the RDMA resources of the
+	// connection can be sized. Accepted connections inherit these settings
+	// from the listener through rsocket.
+	StagePreConnect
+	// StagePostAccept applies the option once the connection is established:
+	// after rconnect for a dial, and on every accepted connection for a
+	// listener.
+	StagePostAccept
+)
+
+func (s OptionStage) String() string {
+	switch s {
+	case StagePreBind:
+		return "pre-bind"
+	case StagePreConnect:
+		return "pre-connect"
+	case StagePostAccept:
+		return "post-accept"
+	default:
+		return "unknown"
+	}
+}
+
+// stagedOption is an option deferred to a later stage.
+type stagedOption struct {
+	name  string
+	stage OptionStage
+	set   func(fd int) error
+}
+
+// NewOption returns an option named name that calls set at stage. On a
+// socket that is not set up by DialTCP or NewTCPListener, set runs right away.
+func NewOption(name string, stage OptionStage, set func(fd int) error) OptionSocketFn {
+	return func(fd int) error {
+		s := lookupSetup(fd)
+		if s == nil || stage == StagePreBind {
+			if err := set(fd); err != nil {
+				return fmt.Errorf("rsocket: %s: %w", name, err)
+			}
+			return nil
+		}
+		s.staged = append(s.staged, stagedOption{name: name, stage: stage, set: set})
+		return nil
+	}
+}
+
+// runStage applies the options of the setup deferred to stage.
+func (s *socketSetup) runStage(fd int, stage OptionStage) error {
+	return runOptions(fd, s.staged, stage, s.logger)
+}
+
+func runOptions(fd int, opts []stagedOption, stage OptionStage, logger *slog.Logger) error {
+	for _, o := range opts {
+		if o.stage != stage {
+			continue
+		}
+		err := o.set(fd)
+		if logger := loggerOr(logger); debugEnabled(logger) {
+			logDebug(logger, "rsocket: apply option", appendErr([]slog.Attr{slog.Int("fd", fd),
+				slog.String("option", o.name), slog.String("stage", stage.String())}, err)...)
+		}
+		if err != nil {
+			return fmt.Errorf("rsocket: %s: %w", o.name, err)
+		}
+	}
+	return nil
+}
+
+// positiveIntOption returns an option setting level/opt to value, which must be positive.
+func positiveIntOption(name string, stage OptionStage, level, opt, value int) OptionSocketFn {
+	if value <= 0 {
+		return invalidOption(name, value)
+	}
+	return NewOption(name, stage, func(fd int) error {
+		return SetSockOptInt(fd, level, opt, value)
+	})
+}
+
+func invalidOption(name string, value int) OptionSocketFn {
+	return func(int) error {
+		return fmt.Errorf("rsocket: %s: invalid value %d", name, value)
+	}
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// WithSQSize sets the size of the send queue (RDMA_SQSIZE) before the
+// connection is established.
+func WithSQSize(size int) OptionSocketFn {
+	return positiveIntOption("WithSQSize", StagePreConnect, SOL_RDMA, RDMA_SQSIZE, size)
+}
+
+// WithRQSize sets the size of the receive queue (RDMA_RQSIZE) before the
+// connection is established.
+func WithRQSize(size int) OptionSocketFn {
+	return positiveIntOption("WithRQSize", StagePreConnect, SOL_RDMA, RDMA_RQSIZE, size)
+}
+
+// WithInline sets the maximum size of data sent inline with a work request
+// (RDMA_INLINE) before the connection is established. 0 disables inline sends.
+func WithInline(size int) OptionSocketFn {
+	if size < 0 {
+		return invalidOption("WithInline", size)
+	}
+	return NewOption("WithInline", StagePreConnect, func(fd int) error {
+		return SetSockOptInt(fd, SOL_RDMA, RDMA_INLINE, size)
+	})
+}
+
+// WithIOMapSize sets the number of buffers that can be mapped with Iomap
+// (RDMA_IOMAPSIZE) before the connection is established.
+func WithIOMapSize(size int) OptionSocketFn {
+	if size < 0 {
+		return invalidOption("WithIOMapSize", size)
+	}
+	return NewOption("WithIOMapSize", StagePreConnect, func(fd int) error {
+		return SetSockOptInt(fd, SOL_RDMA, RDMA_IOMAPSIZE, size)
+	})
+}
+
+// WithSendBuffer sets SO_SNDBUF, the size of the registered send buffer,
+// before the socket is bound.
+func WithSendBuffer(size int) OptionSocketFn {
+	return positiveIntOption("WithSendBuffer", StagePreBind, SOL_SOCKET, SO_SNDBUF, size)
+}
+
+// WithRecvBuffer sets SO_RCVBUF, the size of the registered receive buffer,
+// before the socket is bound.
+func WithRecvBuffer(size int) OptionSocketFn {
+	return positiveIntOption("WithRecvBuffer", StagePreBind, SOL_SOCKET, SO_RCVBUF, size)
+}
+
+// WithReuseAddr sets SO_REUSEADDR before the socket is bound.
+func WithReuseAddr(reuse bool) OptionSocketFn {
+	return NewOption("WithReuseAddr", StagePreBind, func(fd int) error {
+		return SetReuseAddr(fd, reuse)
+	})
+}
+
+// WithNoDelay sets TCP_NODELAY on the established connection, or on every
+// connection accepted by a listener. See SetTCPNoDelay.
+func WithNoDelay(noDelay bool) OptionSocketFn {
+	return NewOption("WithNoDelay", StagePostAccept, func(fd int) error {
+		return SetTCPNoDelay(fd, noDelay)
+	})
+}
+
+// WithKeepAlive sets SO_KEEPALIVE on the established connection, or on every
+// connection accepted by a listener.
+func WithKeepAlive(keepAlive bool) OptionSocketFn {
+	return NewOption("WithKeepAlive", StagePostAccept, func(fd int) error {
+		return SetSockOptInt(fd, SOL_SOCKET, SO_KEEPALIVE, boolToInt(keepAlive))
+	})
+}
@@ -0,0 +1,232 @@
+package rsocket
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// PollEvent is a file descriptor returned by Poller.Wait with its ready events.
+type PollEvent struct {
+	Fd     int
+	Events int16 // POLLIN, POLLOUT, POLLHUP, POLLERR, ...
+}
+
+// Poller waits for events on a set of rsocket, or regular, file descriptors
+// with rpoll. It keeps the pollfd array between calls, so registering a
+// descriptor does not rebuild it.
+//
+// Add, Modify, Remove and Wake may be called while another goroutine is in
+// Wait: Wait then polls the updated set. Only one goroutine waits at a time.
+type Poller struct {
+	mu      sync.Mutex
+	fds     []unix.PollFd // fds[0] is the wakeup eventfd
+	index   map[int]int   // fd -> position in fds
+	waiting bool
+	woken   bool
+	closed  bool
+	efd     int
+
+	waitMu sync.Mutex
+	set    []unix.PollFd // the copy of fds being polled
+	events []PollEvent
+}
+
+// NewPoller returns an empty Poller.
+func NewPoller() (*Poller, error) {
+	// rpoll passes regular fds to poll, so an eventfd can interrupt it
+	efd, err := unix.Eventfd(0, unix.EFD_NONBLOCK|unix.EFD_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	return &Poller{
+		fds:   []unix.PollFd{{Fd: int32(efd), Events: unix.POLLIN}},
+		index: make(map[int]int),
+		efd:   efd,
+	}, nil
+}
+
+// Add registers fd for events. It fails with EEXIST if fd is registered.
+func (p *Poller) Add(fd int, events int16) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return net.ErrClosed
+	}
+	if _, ok := p.index[fd]; ok {
+		return syscall.EEXIST
+	}
+	p.index[fd] = len(p.fds)
+	p.fds = append(p.fds, unix.PollFd{Fd: int32(fd), Events: events})
+	p.notify()
+	return nil
+}
+
+// Modify changes the events fd is registered for. It fails with ENOENT if fd
+// is not registered.
+func (p *Poller) Modify(fd int, events int16) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return net.ErrClosed
+	}
+	i, ok := p.index[fd]
+	if !ok {
+		return syscall.ENOENT
+	}
+	p.fds[i].Events = events
+	p.notify()
+	return nil
+}
+
+// Remove unregisters fd. It fails with ENOENT if fd is not registered.
+// Events for fd may still be returned by a Wait that was in progress.
+func (p *Poller) Remove(fd int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return net.ErrClosed
+	}
+	i, ok := p.index[fd]
+	if !ok {
+		return syscall.ENOENT
+	}
+	last := len(p.fds) - 1
+	p.fds[i] = p.fds[last]
+	p.index[int(p.fds[i].Fd)] = i
+	p.fds = p.fds[:last]
+	delete(p.index, fd)
+	p.notify()
+	return nil
+}
+
+// Len returns the number of registered file descriptors.
+func (p *Poller) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.index)
+}
+
+// Wake makes a Wait in progress, or the next one, return without events.
+func (p *Poller) Wake() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.woken = true
+	p.notify()
+}
+
+// notify interrupts a Wait in progress. It must be called with p.mu held.
+func (p *Poller) notify() {
+	if !p.waiting {
+		return
+	}
+	var b [8]byte
+	binary.NativeEndian.PutUint64(b[:], 1)
+	unix.Write(p.efd, b[:])
+}
+
+// Wait waits up to timeout for events on the registered file descriptors,
+// a negative timeout waits until there are events or Wake is called.
+// Interrupted polls are retried. The returned slice is reused by the next Wait.
+func (p *Poller) Wait(timeout time.Duration) ([]PollEvent, error) {
+	p.waitMu.Lock()
+	defer p.waitMu.Unlock()
+
+	var deadline time.Time
+	if timeout >= 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, net.ErrClosed
+		}
+		if p.woken {
+			p.woken = false
+			p.mu.Unlock()
+			return p.events[:0], nil
+		}
+		p.set = append(p.set[:0], p.fds...)
+		p.waiting = true
+		p.mu.Unlock()
+
+		ms := -1
+		if timeout >= 0 {
+			ms = int((max(time.Until(deadline), 0) + time.Millisecond - 1) / time.Millisecond)
+		}
+		n, err := Poll(p.set, ms)
+
+		p.mu.Lock()
+		p.waiting = false
+		p.mu.Unlock()
+
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if p.set[0].Revents != 0 {
+			var b [8]byte
+			unix.Read(p.efd, b[:])
+		}
+		p.events = p.events[:0]
+		for _, pfd := range p.set[1:] {
+			if pfd.Revents != 0 {
+				p.events = append(p.events, PollEvent{Fd: int(pfd.Fd), Events: pfd.Revents})
+			}
+		}
+		if len(p.events) > 0 || n == 0 {
+			return p.events, nil
+		}
+		// woken by a registration change or Wake, which the loop checks
+	}
+}
+
+// Close releases the poller. A Wait in progress returns net.ErrClosed.
+func (p *Poller) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return net.ErrClosed
+	}
+	p.closed = true
+	p.notify()
+	p.mu.Unlock()
+
+	// the eventfd is closed once no Wait polls it anymore
+	p.waitMu.Lock()
+	defer p.waitMu.Unlock()
+	return unix.Close(p.efd)
+}
+
+// nfdbits is the number of descriptors in an element of syscall.FdSet.Bits.
+const nfdbits = int(unsafe.Sizeof(syscall.FdSet{}.Bits[0])) * 8
+
+// FdSet adds fd to set, like FD_SET. fd must be below FD_SETSIZE (1024).
+func FdSet(fd int, set *syscall.FdSet) {
+	set.Bits[fd/nfdbits] |= 1 << (uint(fd) % uint(nfdbits))
+}
+
+// FdClr removes fd from set, like FD_CLR.
+func FdClr(fd int, set *syscall.FdSet) {
+	set.Bits[fd/nfdbits] &^= 1 << (uint(fd) % uint(nfdbits))
+}
+
+// FdIsSet reports whether fd is in set, like FD_ISSET.
+func FdIsSet(fd int, set *syscall.FdSet) bool {
+	return set.Bits[fd/nfdbits]&(1<<(uint(fd)%uint(nfdbits))) != 0
+}
+
+// FdZero clears set, like FD_ZERO.
+func FdZero(set *syscall.FdSet) {
+	*set = syscall.FdSet{}
+}
@@ -0,0 +1,219 @@
+package rsocket
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// testPipe returns the read and write ends of a pipe, which rpoll passes
+// to poll like any fd that is not an rsocket.
+func testPipe(t *testing.T) (r, w int) {
+	t.Helper()
+	var p [2]int
+	if err := unix.Pipe2(p[:], unix.O_CLOEXEC); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		unix.Close(p[0])
+		unix.Close(p[1])
+	})
+	return p[0], p[1]
+}
+
+// testPoller returns a Poller, skipping the test if rpoll is unavailable.
+func testPoller(t *testing.T) *Poller {
+	t.Helper()
+	p, err := NewPoller()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	if _, err := p.Wait(0); err != nil {
+		t.Skipf("rpoll not available: %v", err)
+	}
+	return p
+}
+
+// waitEvents waits up to timeout and returns the events by fd.
+func waitEvents(t *testing.T, p *Poller, timeout time.Duration) map[int]int16 {
+	t.Helper()
+	got, err := pollerEvents(p, timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func pollerEvents(p *Poller, timeout time.Duration) (map[int]int16, error) {
+	events, err := p.Wait(timeout)
+	got := make(map[int]int16)
+	for _, ev := range events {
+		got[ev.Fd] = ev.Events
+	}
+	return got, err
+}
+
+func TestPollerRegistration(t *testing.T) {
+	p := testPoller(t)
+	r1, w1 := testPipe(t)
+	r2, w2 := testPipe(t)
+
+	if err := p.Add(r1, unix.POLLIN); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Add(r1, unix.POLLIN); err != syscall.EEXIST {
+		t.Fatalf("got %v adding a registered fd, want EEXIST", err)
+	}
+	if err := p.Add(w1, unix.POLLOUT); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Add(r2, unix.POLLIN); err != nil {
+		t.Fatal(err)
+	}
+	if n := p.Len(); n != 3 {
+		t.Fatalf("got Len %d, want 3", n)
+	}
+
+	if got := waitEvents(t, p, time.Second); len(got) != 1 || got[w1]&unix.POLLOUT == 0 {
+		t.Fatalf("got events %v, want only POLLOUT on the write end", got)
+	}
+	unix.Write(w1, []byte("x"))
+	unix.Write(w2, []byte("x"))
+	if got := waitEvents(t, p, time.Second); len(got) != 3 || got[r1] != unix.POLLIN || got[r2] != unix.POLLIN {
+		t.Fatalf("got events %v, want POLLIN on both read ends", got)
+	}
+
+	// r2 takes the place of the removed fd and keeps its registration
+	if err := p.Remove(r1); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Remove(r1); err != syscall.ENOENT {
+		t.Fatalf("got %v removing an unregistered fd, want ENOENT", err)
+	}
+	if err := p.Modify(w1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := waitEvents(t, p, time.Second); len(got) != 1 || got[r2] != unix.POLLIN {
+		t.Fatalf("got events %v, want POLLIN on the remaining read end", got)
+	}
+	if err := p.Modify(r2, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := waitEvents(t, p, 10*time.Millisecond); len(got) != 0 {
+		t.Fatalf("got events %v with no events registered, want none", got)
+	}
+	if err := p.Modify(r1, unix.POLLIN); err != syscall.ENOENT {
+		t.Fatalf("got %v modifying an unregistered fd, want ENOENT", err)
+	}
+	if n := p.Len(); n != 2 {
+		t.Fatalf("got Len %d, want 2", n)
+	}
+}
+
+func TestPollerWaitUpdates(t *testing.T) {
+	p := testPoller(t)
+	r, w := testPipe(t)
+	unix.Write(w, []byte("x"))
+	if err := p.Add(r, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// a registration change applies to the Wait in progress
+	done := make(chan map[int]int16, 1)
+	go func() {
+		got, err := pollerEvents(p, -1)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- got
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if err := p.Modify(r, unix.POLLIN); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-done:
+		if got[r] != unix.POLLIN {
+			t.Fatalf("got events %v, want POLLIN on the read end", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Wait did not see the modified registration")
+	}
+}
+
+func TestPollerWake(t *testing.T) {
+	p := testPoller(t)
+	r, _ := testPipe(t)
+	if err := p.Add(r, unix.POLLIN); err != nil {
+		t.Fatal(err)
+	}
+
+	// a Wake before Wait makes the next one return
+	p.Wake()
+	if got := waitEvents(t, p, -1); len(got) != 0 {
+		t.Fatalf("got events %v after Wake, want none", got)
+	}
+
+	done := make(chan map[int]int16, 1)
+	go func() {
+		got, err := pollerEvents(p, -1)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- got
+	}()
+	time.Sleep(20 * time.Millisecond)
+	p.Wake()
+	select {
+	case got := <-done:
+		if len(got) != 0 {
+			t.Fatalf("got events %v after Wake, want none", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Wait still blocked after Wake")
+	}
+
+	// the timeout still applies after a Wake was consumed
+	start := time.Now()
+	if got := waitEvents(t, p, 20*time.Millisecond); len(got) != 0 {
+		t.Fatalf("got events %v, want none", got)
+	}
+	if d := time.Since(start); d < 15*time.Millisecond {
+		t.Errorf("Wait returned after %v, want the 20ms timeout", d)
+	}
+}
+
+func TestPollerClose(t *testing.T) {
+	p := testPoller(t)
+	r, _ := testPipe(t)
+	p.Add(r, unix.POLLIN)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := p.Wait(-1)
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("got %v from a Wait interrupted by Close, want net.ErrClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Wait still blocked after Close")
+	}
+	if err := p.Add(r, unix.POLLOUT); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("got %v adding to a closed poller, want net.ErrClosed", err)
+	}
+	if err := p.Close(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("got %v from a second Close, want net.ErrClosed", err)
+	}
+}
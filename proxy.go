@@ -0,0 +1,107 @@
+package rsocket
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// Dialer implements the dialer interfaces of golang.org/x/net/proxy, so that
+// libraries that take one can run over rsocket.
+var (
+	_ proxy.Dialer        = (*Dialer)(nil)
+	_ proxy.ContextDialer = (*Dialer)(nil)
+)
+
+// RegisterProxyScheme registers scheme, "rdma" if empty, with
+// proxy.RegisterDialerType. proxy.FromURL, and proxy.FromEnvironment with
+// ALL_PROXY set to a URL of the scheme, then return a Dialer configured by
+// DialerFromURL. The forward dialer is not used: connections go straight to
+// their destination over rsocket.
+func RegisterProxyScheme(scheme string) {
+	if scheme == "" {
+		scheme = "rdma"
+	}
+	proxy.RegisterDialerType(scheme, func(u *url.URL, _ proxy.Dialer) (proxy.Dialer, error) {
+		return DialerFromURL(u)
+	})
+}
+
+// DialerFromURL returns a Dialer configured by u, e.g.
+// rdma://10.0.0.1?timeout=5s&sqsize=512. The host of u, if any, is the local
+// address to bind to, which selects the RDMA device. It must be an IP
+// literal, IPv4 or IPv6 like rdma://[fd00::1], of the family of the
+// addresses dialed: WithLocalAddr fails on the others. The query sets:
+//
+//	timeout     Timeout, a duration
+//	parallel    Parallel, a bool
+//	sqsize      WithSQSize
+//	rqsize      WithRQSize
+//	inline      WithInline
+//	iomapsize   WithIOMapSize
+//	sndbuf      WithSendBuffer
+//	rcvbuf      WithRecvBuffer
+//	nodelay     WithNoDelay, a bool
+//	keepalive   WithKeepAlive, a bool
+func DialerFromURL(u *url.URL) (*Dialer, error) {
+	d := &Dialer{}
+	if host := u.Hostname(); host != "" {
+		if net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("rsocket: %s: local address must be an IP", u.Redacted())
+		}
+		port := 0
+		if p := u.Port(); p != "" {
+			var err error
+			if port, err = strconv.Atoi(p); err != nil {
+				return nil, fmt.Errorf("rsocket: %s: invalid port %q", u.Redacted(), p)
+			}
+		}
+		d.Options = append(d.Options, WithLocalAddr(host, port))
+	}
+
+	ints := map[string]func(int) OptionSocketFn{
+		"sqsize":    WithSQSize,
+		"rqsize":    WithRQSize,
+		"inline":    WithInline,
+		"iomapsize": WithIOMapSize,
+		"sndbuf":    WithSendBuffer,
+		"rcvbuf":    WithRecvBuffer,
+	}
+	bools := map[string]func(bool) OptionSocketFn{
+		"nodelay":   WithNoDelay,
+		"keepalive": WithKeepAlive,
+	}
+	query := u.Query()
+	for _, key := range slices.Sorted(maps.Keys(query)) {
+		value := query.Get(key)
+		var err error
+		switch {
+		case key == "timeout":
+			d.Timeout, err = time.ParseDuration(value)
+		case key == "parallel":
+			d.Parallel, err = strconv.ParseBool(value)
+		case ints[key] != nil:
+			var n int
+			if n, err = strconv.Atoi(value); err == nil {
+				d.Options = append(d.Options, ints[key](n))
+			}
+		case bools[key] != nil:
+			var b bool
+			if b, err = strconv.ParseBool(value); err == nil {
+				d.Options = append(d.Options, bools[key](b))
+			}
+		default:
+			return nil, fmt.Errorf("rsocket: %s: unknown parameter %q", u.Redacted(), key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("rsocket: %s: invalid %s %q", u.Redacted(), key, value)
+		}
+	}
+	return d, nil
+}
@@ -0,0 +1,53 @@
+package rsocket
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestDialerFromURL(t *testing.T) {
+	u, _ := url.Parse("rdma://10.0.0.1:7000?timeout=5s&parallel=true&sqsize=512&nodelay=1")
+	d, err := DialerFromURL(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Timeout != 5*time.Second || !d.Parallel || len(d.Options) != 3 {
+		t.Errorf("got timeout %v, parallel %v and %d options, want 5s, true and 3", d.Timeout, d.Parallel, len(d.Options))
+	}
+
+	for _, bad := range []string{
+		"rdma://ib0.example.com",
+		"rdma://10.0.0.1:99999999999999999999",
+		"rdma://10.0.0.1?sqsize=many",
+		"rdma://10.0.0.1?color=blue",
+	} {
+		u, err := url.Parse(bad)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := DialerFromURL(u); err == nil {
+			t.Errorf("%s: got no error", bad)
+		}
+	}
+}
+
+func TestDialerFromURLIPv6(t *testing.T) {
+	u, _ := url.Parse("rdma://[fd00::1]")
+	d, err := DialerFromURL(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Options) != 1 {
+		t.Fatalf("got %d options, want the local address", len(d.Options))
+	}
+
+	// an IPv6 local address cannot bind an IPv4 dial, rather than binding
+	// the any address
+	const fd = -1
+	setups.Store(fd, &socketSetup{family: AF_INET})
+	defer setups.Delete(fd)
+	if err := d.Options[0](fd); err == nil {
+		t.Fatal("got no error binding an IPv6 address to an IPv4 socket")
+	}
+}
@@ -0,0 +1,499 @@
+package rsocket
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// LoadBalancing selects the event loop that serves an accepted connection.
+type LoadBalancing int
+
+const (
+	// RoundRobin assigns connections to the loops in turn.
+	RoundRobin LoadBalancing = iota
+	// LeastConnections assigns a connection to the loop serving the fewest.
+	LeastConnections
+)
+
+// EventConfig configures an EventServer. Callbacks are called on the loop
+// goroutine of the connection and must not block, since they hold up every
+// other connection of the loop.
+type EventConfig struct {
+	// Loops is the number of event loops, default is runtime.NumCPU().
+	Loops int
+	// ReadBufferSize is the size of the read buffer of each loop, default is 64KB.
+	ReadBufferSize int
+	// LoadBalancing selects the loop of accepted connections, default is RoundRobin.
+	LoadBalancing LoadBalancing
+
+	// OnOpen is called when a connection is added to its loop.
+	OnOpen func(c *EventConn)
+	// OnData is called with the data read from a connection. in is only valid
+	// during the call; replies are written with c.Write.
+	OnData func(c *EventConn, in []byte)
+	// OnClose is called when a connection is closed, err is nil if it was
+	// closed by the peer or with Close.
+	OnClose func(c *EventConn, err error)
+}
+
+// EventServer is a reactor server: it accepts connections and serves them
+// from a fixed number of event loops, each locked to an OS thread and waiting
+// on its connections with rpoll, instead of running a goroutine per connection.
+type EventServer struct {
+	ln     *TCPListener
+	cfg    EventConfig
+	loops  []*eventLoop
+	next   atomic.Uint64
+	closed atomic.Bool
+	wg     sync.WaitGroup
+	logger *slog.Logger
+
+	mu     sync.Mutex
+	poller *Poller       // waits for connections to accept, nil unless serving
+	served chan struct{} // closed once Serve returns
+}
+
+// NewEventServer returns an event server for the connections accepted by ln.
+func NewEventServer(ln *TCPListener, config EventConfig) (*EventServer, error) {
+	if config.Loops <= 0 {
+		config.Loops = runtime.NumCPU()
+	}
+	if config.ReadBufferSize <= 0 {
+		config.ReadBufferSize = 64 << 10
+	}
+
+	s := &EventServer{
+		ln:     ln,
+		cfg:    config,
+		logger: ln.logger,
+	}
+	for i := 0; i < config.Loops; i++ {
+		poller, err := NewPoller()
+		if err != nil {
+			for _, l := range s.loops {
+				l.poller.Close()
+			}
+			return nil, err
+		}
+		s.loops = append(s.loops, &eventLoop{
+			srv:    s,
+			poller: poller,
+			conns:  make(map[int]*EventConn),
+			buf:    make([]byte, config.ReadBufferSize),
+		})
+	}
+	return s, nil
+}
+
+// Serve starts the event loops and accepts connections until the listener
+// fails, switching the listener to nonblocking mode. It returns nil once the
+// server is closed.
+func (s *EventServer) Serve() error {
+	// raccept cannot be interrupted, and closing the listener under it frees
+	// the rsocket it uses: Serve polls the listener with a poller that Close
+	// wakes up, and accepts without blocking
+	poller, err := NewPoller()
+	if err != nil {
+		return err
+	}
+	if err := poller.Add(s.ln.fd, unix.POLLIN); err != nil {
+		poller.Close()
+		return err
+	}
+	if err := SetNonblock(s.ln.fd, true); err != nil {
+		poller.Close()
+		return err
+	}
+
+	s.mu.Lock()
+	if s.closed.Load() {
+		s.mu.Unlock()
+		poller.Close()
+		return nil
+	}
+	served := make(chan struct{})
+	s.poller, s.served = poller, served
+	for _, l := range s.loops {
+		s.wg.Add(1)
+		go l.run()
+	}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.poller = nil
+		s.mu.Unlock()
+		poller.Close()
+		close(served)
+	}()
+
+	for {
+		events, err := poller.Wait(-1)
+		if s.closed.Load() {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			continue
+		}
+
+		conn, err := s.ln.Accept()
+		if err == syscall.EAGAIN {
+			// the connection was rejected by admission control, or is gone
+			continue
+		}
+		if err != nil {
+			if s.closed.Load() {
+				return nil
+			}
+			return err
+		}
+		if s.closed.Load() {
+			conn.Close()
+			return nil
+		}
+		s.pick().add(conn.(*TCPConn))
+	}
+}
+
+// pick returns the loop for a new connection.
+func (s *EventServer) pick() *eventLoop {
+	if s.cfg.LoadBalancing == LeastConnections {
+		best := s.loops[0]
+		for _, l := range s.loops[1:] {
+			if l.count.Load() < best.count.Load() {
+				best = l
+			}
+		}
+		return best
+	}
+	return s.loops[(s.next.Add(1)-1)%uint64(len(s.loops))]
+}
+
+// NumConns returns the number of connections served.
+func (s *EventServer) NumConns() int {
+	var n int64
+	for _, l := range s.loops {
+		n += l.count.Load()
+	}
+	return int(n)
+}
+
+// Close closes the listener, stops the loops and closes their connections.
+func (s *EventServer) Close() error {
+	if !s.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+	// the listener is closed once Serve no longer uses it
+	s.ln.admission.close()
+	s.mu.Lock()
+	poller, served := s.poller, s.served
+	s.mu.Unlock()
+	if poller != nil {
+		poller.Wake()
+		<-served
+	}
+	err := s.ln.Close()
+	for _, l := range s.loops {
+		l.queue(func() { l.done = true })
+	}
+	s.wg.Wait()
+	for _, l := range s.loops {
+		l.poller.Close()
+	}
+	return err
+}
+
+// eventLoop serves a set of connections from one goroutine.
+type eventLoop struct {
+	srv    *EventServer
+	poller *Poller
+	count  atomic.Int64
+
+	mu      sync.Mutex
+	tasks   []func()
+	stopped bool // no task runs anymore
+
+	// owned by the loop goroutine
+	conns map[int]*EventConn
+	buf   []byte
+	done  bool
+}
+
+// queue runs task on the loop goroutine. It reports false if the loop has
+// stopped and task will not run.
+func (l *eventLoop) queue(task func()) bool {
+	l.mu.Lock()
+	if l.stopped {
+		l.mu.Unlock()
+		return false
+	}
+	l.tasks = append(l.tasks, task)
+	l.mu.Unlock()
+	l.poller.Wake()
+	return true
+}
+
+func (l *eventLoop) runTasks() {
+	l.mu.Lock()
+	tasks := l.tasks
+	l.tasks = nil
+	l.mu.Unlock()
+	for _, task := range tasks {
+		task()
+	}
+}
+
+func (l *eventLoop) add(conn *TCPConn) {
+	l.count.Add(1)
+	if !l.queue(func() { l.open(conn) }) {
+		l.count.Add(-1)
+		conn.Close()
+	}
+}
+
+func (l *eventLoop) run() {
+	defer l.srv.wg.Done()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	reason := net.ErrClosed
+	for !l.done {
+		events, err := l.poller.Wait(-1)
+		if err != nil {
+			// Wait retries EINTR, anything else would fail again at once
+			if logger := loggerOr(l.srv.logger); debugEnabled(logger) {
+				logDebug(logger, "rsocket: event loop poll", appendErr(nil, err)...)
+			}
+			reason = err
+			break
+		}
+
+		for _, ev := range events {
+			c := l.conns[ev.Fd]
+			if c == nil {
+				continue
+			}
+			if ev.Events&(unix.POLLIN|unix.POLLHUP|unix.POLLERR) != 0 {
+				l.read(c)
+			}
+			if !c.closed && (len(c.out) > 0 || c.closing) {
+				l.flush(c)
+			}
+		}
+		l.runTasks()
+	}
+
+	l.closeAll(reason)
+	// connections queued before the loop stopped are closed by open, later
+	// ones by add
+	l.mu.Lock()
+	l.done = true
+	l.stopped = true
+	l.mu.Unlock()
+	l.runTasks()
+}
+
+func (l *eventLoop) open(conn *TCPConn) {
+	if l.done {
+		l.count.Add(-1)
+		conn.Close()
+		return
+	}
+
+	if err := l.poller.Add(conn.fd, unix.POLLIN); err != nil {
+		l.count.Add(-1)
+		conn.Close()
+		return
+	}
+	c := &EventConn{conn: conn, fd: conn.fd, loop: l, events: unix.POLLIN}
+	l.conns[c.fd] = c
+	if l.srv.cfg.OnOpen != nil {
+		l.srv.cfg.OnOpen(c)
+	}
+	if !c.closed && (len(c.out) > 0 || c.closing) {
+		l.flush(c)
+	}
+}
+
+func (l *eventLoop) read(c *EventConn) {
+	start := c.conn.trace.now()
+	n, err := Recv(c.fd, l.buf, MSG_DONTWAIT)
+	if n == 0 && err == nil {
+		// the peer closed the connection
+		err = io.EOF
+	}
+	recordRead(n, err)
+	c.conn.bytesRead.Add(uint64(n))
+	c.conn.captureRead(l.buf[:max(n, 0)], err)
+	c.conn.trace.read(c.fd, n, err, start)
+
+	switch {
+	case n > 0:
+		if l.srv.cfg.OnData != nil {
+			l.srv.cfg.OnData(c, l.buf[:n])
+		}
+	case err == io.EOF:
+		l.close(c, nil)
+	case err != syscall.EAGAIN:
+		l.close(c, err)
+	}
+}
+
+// flush writes as much of the outbound buffer as the socket takes.
+func (l *eventLoop) flush(c *EventConn) {
+	written := 0
+	for written < len(c.out) {
+		start := c.conn.trace.now()
+		n, err := Send(c.fd, c.out[written:], MSG_DONTWAIT)
+		recordWrite(n, err)
+		c.conn.bytesWritten.Add(uint64(n))
+		c.conn.capture.Load().data(true, c.out[written:written+max(n, 0)])
+		c.conn.trace.write(c.fd, n, err, start)
+		if err == syscall.EAGAIN {
+			break
+		}
+		if err != nil {
+			l.close(c, err)
+			return
+		}
+		written += n
+	}
+	c.out = c.out[:copy(c.out, c.out[written:])]
+
+	if len(c.out) == 0 && c.closing {
+		l.close(c, nil)
+		return
+	}
+
+	// wait for the socket to become writable only while output is pending
+	events := int16(unix.POLLIN)
+	if len(c.out) > 0 {
+		events |= unix.POLLOUT
+	}
+	if events != c.events {
+		l.poller.Modify(c.fd, events)
+		c.events = events
+	}
+}
+
+func (l *eventLoop) close(c *EventConn, err error) {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	delete(l.conns, c.fd)
+	l.poller.Remove(c.fd)
+	l.count.Add(-1)
+	if l.srv.cfg.OnClose != nil {
+		l.srv.cfg.OnClose(c, err)
+	}
+	c.conn.Close()
+}
+
+func (l *eventLoop) closeAll(err error) {
+	for _, c := range l.conns {
+		l.close(c, err)
+	}
+}
+
+// EventConn is a connection served by an EventServer. Its methods must be
+// called from the callbacks, except AsyncWrite and AsyncClose.
+type EventConn struct {
+	conn    *TCPConn
+	fd      int
+	loop    *eventLoop
+	out     []byte
+	events  int16 // registered poll events
+	ctx     any
+	closing bool
+	closed  bool
+}
+
+// Write appends p to the outbound buffer, which is flushed after the callback
+// returns and whenever the connection becomes writable.
+func (c *EventConn) Write(p []byte) (int, error) {
+	if c.closed || c.closing {
+		return 0, net.ErrClosed
+	}
+	c.out = append(c.out, p...)
+	return len(p), nil
+}
+
+// Close closes the connection once the outbound buffer is flushed.
+func (c *EventConn) Close() error {
+	c.closing = true
+	return nil
+}
+
+// AsyncWrite writes p to the connection from any goroutine.
+func (c *EventConn) AsyncWrite(p []byte) error {
+	if c.loop.srv.closed.Load() {
+		return net.ErrClosed
+	}
+	p = bytes.Clone(p)
+	if !c.loop.queue(func() {
+		if _, err := c.Write(p); err == nil {
+			c.loop.flush(c)
+		}
+	}) {
+		return net.ErrClosed
+	}
+	return nil
+}
+
+// AsyncClose closes the connection from any goroutine once the data written
+// before is flushed.
+func (c *EventConn) AsyncClose() error {
+	if c.loop.srv.closed.Load() {
+		return net.ErrClosed
+	}
+	if !c.loop.queue(func() {
+		if !c.closed {
+			c.closing = true
+			c.loop.flush(c)
+		}
+	}) {
+		return net.ErrClosed
+	}
+	return nil
+}
+
+// Buffered returns the number of bytes waiting in the outbound buffer.
+func (c *EventConn) Buffered() int {
+	return len(c.out)
+}
+
+// Context returns the value set with SetContext.
+func (c *EventConn) Context() any {
+	return c.ctx
+}
+
+// SetContext attaches a value to the connection, e.g. the protocol state.
+func (c *EventConn) SetContext(ctx any) {
+	c.ctx = ctx
+}
+
+// Fd returns the connection's file descriptor.
+func (c *EventConn) Fd() int {
+	return c.fd
+}
+
+// LocalAddr returns the local network address.
+func (c *EventConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote network address.
+func (c *EventConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
@@ -0,0 +1,91 @@
+package rsocket
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testEventServer returns a serving echo server and its address. The server
+// owns the listener, the test closes the server.
+func testEventServer(t *testing.T) (*EventServer, string, chan error) {
+	t.Helper()
+	ln, err := NewTCPListener("127.0.0.1", 0, 16)
+	if err != nil {
+		t.Skipf("rsocket not available: %v", err)
+	}
+	sa, err := GetSockName(ln.File())
+	if err != nil {
+		ln.Close()
+		t.Fatal(err)
+	}
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(sa.(*syscall.SockaddrInet4).Port))
+
+	srv, err := NewEventServer(ln, EventConfig{
+		Loops:  2,
+		OnData: func(c *EventConn, in []byte) { c.Write(in) },
+	})
+	if err != nil {
+		ln.Close()
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve() }()
+	return srv, addr, served
+}
+
+func TestEventServerEcho(t *testing.T) {
+	srv, addr, _ := testEventServer(t)
+	defer srv.Close()
+
+	for range 3 {
+		conn, err := DialTCP(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("got %q, %v, want ping", buf, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestEventServerClose(t *testing.T) {
+	srv, addr, served := testEventServer(t)
+	conn, err := DialTCP(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("x"))
+	io.ReadFull(conn, make([]byte, 1))
+
+	// Serve is waiting for the next connection
+	time.Sleep(20 * time.Millisecond)
+	closed := make(chan error, 1)
+	go func() { closed <- srv.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close blocked while Serve waits for connections")
+	}
+	if err := <-served; err != nil {
+		t.Fatalf("got %v from Serve after Close, want nil", err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("got %v reading a connection of a closed server, want io.EOF", err)
+	}
+	if err := srv.Close(); err != nil {
+		t.Fatalf("got %v from a second Close, want nil", err)
+	}
+}
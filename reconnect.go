@@ -0,0 +1,404 @@
+package rsocket
+
+import (
+	"errors"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrNotConnected is returned by ReconnectingConn reads and writes when there
+// is no connection and the caller may not wait for one, or waited too long.
+var ErrNotConnected = errors.New("rsocket: not connected")
+
+var _ net.Conn = (*ReconnectingConn)(nil)
+
+// ConnState is the state of a ReconnectingConn.
+type ConnState int
+
+const (
+	// StateConnecting means a dial is in progress.
+	StateConnecting ConnState = iota
+	// StateConnected means there is a usable connection.
+	StateConnected
+	// StateDisconnected means the connection broke and a redial is pending.
+	StateDisconnected
+	// StateClosed means Close was called.
+	StateClosed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// StateChange reports a state transition of a ReconnectingConn.
+// Err is the dial or I/O error that caused it, if any.
+type StateChange struct {
+	State ConnState
+	Err   error
+}
+
+// ReconnectConfig configures a ReconnectingConn.
+type ReconnectConfig struct {
+	// InitialBackoff is the wait after the first failed dial, default is 100ms.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the wait between dials, default is 30s.
+	MaxBackoff time.Duration
+	// Multiplier grows the backoff after each failed dial, default is 2.
+	Multiplier float64
+	// Jitter randomizes each backoff by up to this fraction, default is 0.2,
+	// a negative value disables it. It keeps clients from redialing in
+	// lockstep after a fabric outage.
+	Jitter float64
+
+	// FailFast makes Read and Write return ErrNotConnected right away while
+	// there is no connection, instead of waiting for the redial.
+	FailFast bool
+	// WaitTimeout bounds how long Read and Write wait for a connection,
+	// 0 means waiting until Close.
+	WaitTimeout time.Duration
+
+	// OnStateChange, if set, is called on every state transition, by the
+	// goroutine that caused it and without holding locks, so it may call
+	// State. It must not block.
+	OnStateChange func(StateChange)
+
+	// Dial creates the underlying connection, default is DialTCP with the
+	// address and options given to NewReconnectingConn.
+	Dial func() (net.Conn, error)
+}
+
+func (cfg *ReconnectConfig) setDefaults() {
+	if cfg.InitialBackoff <= 0 {
+		cfg.InitialBackoff = 100 * time.Millisecond
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = 30 * time.Second
+	}
+	if cfg.Multiplier < 1 {
+		cfg.Multiplier = 2
+	}
+	switch {
+	case cfg.Jitter == 0:
+		cfg.Jitter = 0.2
+	case cfg.Jitter < 0:
+		cfg.Jitter = 0
+	case cfg.Jitter > 1:
+		cfg.Jitter = 1
+	}
+}
+
+// ReconnectingConn is a client connection that redials with jittered
+// exponential backoff whenever the underlying connection breaks.
+//
+// The byte stream is not resumed: the Read or Write that hit the broken
+// connection returns its error, and later calls use the new connection.
+type ReconnectingConn struct {
+	cfg     ReconnectConfig
+	changes chan StateChange
+
+	mu         sync.Mutex
+	conn       *liveConn     // nil while there is no connection
+	ready      chan struct{} // closed once conn is set
+	state      ConnState
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	closed     chan struct{}
+}
+
+// liveConn is a connection of a ReconnectingConn with the calls using it. A
+// dropped connection is shut down at once but only closed when its last call
+// returns, since the redial could otherwise get its fd while they still use it.
+type liveConn struct {
+	net.Conn
+	users   int  // guarded by ReconnectingConn.mu
+	dropped bool // guarded by ReconnectingConn.mu
+}
+
+// NewReconnectingConn returns a ReconnectingConn to address and starts
+// dialing in the background. It never fails, dial errors are reported
+// through the state changes.
+func NewReconnectingConn(address string, config ReconnectConfig, optFns ...OptionSocketFn) *ReconnectingConn {
+	config.setDefaults()
+	if config.Dial == nil {
+		config.Dial = func() (net.Conn, error) {
+			conn, err := DialTCP(address, optFns...)
+			if err != nil {
+				return nil, err
+			}
+			return conn, nil
+		}
+	}
+
+	c := &ReconnectingConn{
+		cfg:     config,
+		changes: make(chan StateChange, 16),
+		ready:   make(chan struct{}),
+		state:   StateConnecting,
+		closed:  make(chan struct{}),
+	}
+	go c.redial()
+	return c
+}
+
+// StateChanges returns a channel of state transitions. Transitions are
+// dropped if the channel is full, use State for the current state.
+func (c *ReconnectingConn) StateChanges() <-chan StateChange {
+	return c.changes
+}
+
+// State returns the current state.
+func (c *ReconnectingConn) State() ConnState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+// setState must be called with c.mu held. The returned function calls
+// OnStateChange and must be called once c.mu is released.
+func (c *ReconnectingConn) setState(state ConnState, err error) (notify func()) {
+	if c.state == StateClosed {
+		return func() {}
+	}
+	c.state = state
+	change := StateChange{State: state, Err: err}
+	select {
+	case c.changes <- change:
+	default:
+	}
+	return func() {
+		if c.cfg.OnStateChange != nil {
+			c.cfg.OnStateChange(change)
+		}
+	}
+}
+
+// redial dials until it succeeds or the connection is closed.
+func (c *ReconnectingConn) redial() {
+	backoff := c.cfg.InitialBackoff
+	for {
+		c.mu.Lock()
+		notify := c.setState(StateConnecting, nil)
+		c.mu.Unlock()
+		notify()
+
+		conn, err := c.cfg.Dial()
+		if err == nil {
+			c.mu.Lock()
+			if c.state == StateClosed {
+				c.mu.Unlock()
+				conn.Close()
+				return
+			}
+			c.conn = &liveConn{Conn: conn}
+			c.localAddr, c.remoteAddr = conn.LocalAddr(), conn.RemoteAddr()
+			close(c.ready)
+			notify := c.setState(StateConnected, nil)
+			c.mu.Unlock()
+			notify()
+			return
+		}
+
+		c.mu.Lock()
+		notify = c.setState(StateDisconnected, err)
+		c.mu.Unlock()
+		notify()
+
+		wait := backoff
+		if c.cfg.Jitter > 0 {
+			wait = time.Duration(float64(backoff) * (1 + c.cfg.Jitter*(2*rand.Float64()-1)))
+		}
+		select {
+		case <-time.After(wait):
+		case <-c.closed:
+			return
+		}
+		backoff = time.Duration(float64(backoff) * c.cfg.Multiplier)
+		if backoff > c.cfg.MaxBackoff {
+			backoff = c.cfg.MaxBackoff
+		}
+	}
+}
+
+// acquire returns the connection, waiting for it according to the config.
+// The caller must pass it to release once done with it.
+func (c *ReconnectingConn) acquire() (*liveConn, error) {
+	var timeout <-chan time.Time
+	if c.cfg.WaitTimeout > 0 {
+		timer := time.NewTimer(c.cfg.WaitTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		c.mu.Lock()
+		if c.state == StateClosed {
+			c.mu.Unlock()
+			return nil, net.ErrClosed
+		}
+		if c.conn != nil {
+			conn := c.conn
+			conn.users++
+			c.mu.Unlock()
+			return conn, nil
+		}
+		ready := c.ready
+		c.mu.Unlock()
+
+		if c.cfg.FailFast {
+			return nil, ErrNotConnected
+		}
+		select {
+		case <-ready:
+		case <-timeout:
+			return nil, ErrNotConnected
+		case <-c.closed:
+			return nil, net.ErrClosed
+		}
+	}
+}
+
+// release ends a use of conn, closing it if it was dropped meanwhile.
+func (c *ReconnectingConn) release(conn *liveConn) {
+	c.mu.Lock()
+	conn.users--
+	last := conn.dropped && conn.users == 0
+	c.mu.Unlock()
+	if last {
+		conn.Close()
+	}
+}
+
+// drop detaches conn, with c.mu held. It is shut down so that the calls
+// still using it return, and closed now if there are none. It reports the
+// error of the close, if any.
+func (c *ReconnectingConn) drop(conn *liveConn) error {
+	c.conn = nil
+	conn.dropped = true
+	if conn.users == 0 {
+		return conn.Close()
+	}
+	interruptConn(conn.Conn)
+	return nil
+}
+
+// fail drops conn and starts redialing, unless another caller already did.
+func (c *ReconnectingConn) fail(conn *liveConn, err error) {
+	c.mu.Lock()
+	if conn != c.conn || c.state == StateClosed {
+		c.mu.Unlock()
+		return
+	}
+	c.drop(conn)
+	c.ready = make(chan struct{})
+	notify := c.setState(StateDisconnected, err)
+	c.mu.Unlock()
+
+	notify()
+	go c.redial()
+}
+
+// Read reads from the current connection. If it breaks, Read returns the
+// error and the connection is redialed.
+func (c *ReconnectingConn) Read(p []byte) (int, error) {
+	conn, err := c.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer c.release(conn)
+	n, err := conn.Read(p)
+	if err != nil {
+		c.fail(conn, err)
+	}
+	return n, err
+}
+
+// Write writes to the current connection. If it breaks, Write returns the
+// error and the connection is redialed.
+func (c *ReconnectingConn) Write(p []byte) (int, error) {
+	conn, err := c.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer c.release(conn)
+	n, err := conn.Write(p)
+	if err != nil {
+		c.fail(conn, err)
+	}
+	return n, err
+}
+
+// Close closes the connection and stops redialing. A connection still used
+// by Read or Write calls is shut down, and closed once they return.
+func (c *ReconnectingConn) Close() error {
+	c.mu.Lock()
+	if c.state == StateClosed {
+		c.mu.Unlock()
+		return net.ErrClosed
+	}
+	notify := c.setState(StateClosed, nil)
+	close(c.closed)
+
+	var err error
+	if c.conn != nil {
+		err = c.drop(c.conn)
+	}
+	c.mu.Unlock()
+
+	notify()
+	return err
+}
+
+// LocalAddr returns the local address of the current or last connection.
+func (c *ReconnectingConn) LocalAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.localAddr
+}
+
+// RemoteAddr returns the remote address of the current or last connection.
+func (c *ReconnectingConn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.remoteAddr
+}
+
+// SetDeadline sets the deadlines of the current connection.
+func (c *ReconnectingConn) SetDeadline(t time.Time) error {
+	return c.withConn(func(conn net.Conn) error { return conn.SetDeadline(t) })
+}
+
+// SetReadDeadline sets the read deadline of the current connection.
+func (c *ReconnectingConn) SetReadDeadline(t time.Time) error {
+	return c.withConn(func(conn net.Conn) error { return conn.SetReadDeadline(t) })
+}
+
+// SetWriteDeadline sets the write deadline of the current connection.
+func (c *ReconnectingConn) SetWriteDeadline(t time.Time) error {
+	return c.withConn(func(conn net.Conn) error { return conn.SetWriteDeadline(t) })
+}
+
+func (c *ReconnectingConn) withConn(fn func(net.Conn) error) error {
+	c.mu.Lock()
+	conn := c.conn
+	if conn == nil {
+		c.mu.Unlock()
+		return ErrNotConnected
+	}
+	conn.users++
+	c.mu.Unlock()
+	defer c.release(conn)
+	return fn(conn)
+}
@@ -0,0 +1,244 @@
+package rsocket
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pipeDialer dials net.Pipe connections after failing the first fails
+// dials. The other ends are sent on peers.
+type pipeDialer struct {
+	mu    sync.Mutex
+	fails int
+	dials []time.Time
+	conns []*closeCounter
+	peers chan net.Conn
+}
+
+var errDialRefused = errors.New("dial refused")
+
+func newPipeDialer(fails int) *pipeDialer {
+	return &pipeDialer{fails: fails, peers: make(chan net.Conn, 4)}
+}
+
+func (d *pipeDialer) Dial() (net.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dials = append(d.dials, time.Now())
+	if d.fails > 0 {
+		d.fails--
+		return nil, errDialRefused
+	}
+	a, b := net.Pipe()
+	conn := &closeCounter{Conn: a}
+	d.conns = append(d.conns, conn)
+	d.peers <- b
+	return conn, nil
+}
+
+func (d *pipeDialer) Dials() []time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.dials
+}
+
+// peer returns the other end of the next connection dialed.
+func (d *pipeDialer) peer(t *testing.T) net.Conn {
+	t.Helper()
+	select {
+	case b := <-d.peers:
+		t.Cleanup(func() { b.Close() })
+		return b
+	case <-time.After(time.Second):
+		t.Fatal("no connection dialed")
+		return nil
+	}
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	d := newPipeDialer(3)
+	c := NewReconnectingConn("", ReconnectConfig{
+		InitialBackoff: 20 * time.Millisecond,
+		MaxBackoff:     50 * time.Millisecond,
+		Multiplier:     3,
+		Jitter:         -1,
+		Dial:           d.Dial,
+	})
+	defer c.Close()
+
+	// a write waits for the connection
+	peer := d.peer(t)
+	go c.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(peer, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("got %q, %v, want hello", buf, err)
+	}
+
+	// 20ms, then 60ms capped to 50ms, twice
+	dials := d.Dials()
+	if len(dials) != 4 {
+		t.Fatalf("got %d dials, want 4", len(dials))
+	}
+	for i, want := range []time.Duration{20, 50, 50} {
+		want *= time.Millisecond
+		if gap := dials[i+1].Sub(dials[i]); gap < want || gap > want+100*time.Millisecond {
+			t.Errorf("got %v before dial %d, want %v", gap, i+2, want)
+		}
+	}
+
+	var states []ConnState
+	for len(states) < 8 {
+		change := <-c.StateChanges()
+		if change.State == StateDisconnected && !errors.Is(change.Err, errDialRefused) {
+			t.Errorf("got a disconnection for %v, want the dial error", change.Err)
+		}
+		states = append(states, change.State)
+	}
+	want := []ConnState{
+		StateConnecting, StateDisconnected,
+		StateConnecting, StateDisconnected,
+		StateConnecting, StateDisconnected,
+		StateConnecting, StateConnected,
+	}
+	for i := range want {
+		if states[i] != want[i] {
+			t.Fatalf("got states %v, want %v", states, want)
+		}
+	}
+}
+
+func TestReconnectRedial(t *testing.T) {
+	d := newPipeDialer(0)
+	var mu sync.Mutex
+	var changes []StateChange
+	c := NewReconnectingConn("", ReconnectConfig{
+		InitialBackoff: time.Millisecond,
+		Dial:           d.Dial,
+		OnStateChange: func(change StateChange) {
+			mu.Lock()
+			changes = append(changes, change)
+			mu.Unlock()
+		},
+	})
+	defer c.Close()
+
+	// the peer goes away: the read fails and the connection is redialed
+	first := d.peer(t)
+	first.Close()
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("got %v reading a closed connection, want io.EOF", err)
+	}
+	second := d.peer(t)
+	go c.Write([]byte("again"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(second, buf); err != nil || string(buf) != "again" {
+		t.Fatalf("got %q, %v on the new connection, want again", buf, err)
+	}
+
+	d.mu.Lock()
+	closes := d.conns[0].closes
+	d.mu.Unlock()
+	if closes != 1 {
+		t.Errorf("got %d closes of the broken connection, want 1", closes)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	var lost bool
+	for _, change := range changes {
+		if change.State == StateDisconnected && change.Err == io.EOF {
+			lost = true
+		}
+	}
+	if !lost {
+		t.Errorf("got state changes %v, want a disconnection for io.EOF", changes)
+	}
+}
+
+func TestReconnectCloseInFlight(t *testing.T) {
+	d := newPipeDialer(0)
+	c := NewReconnectingConn("", ReconnectConfig{Dial: d.Dial})
+	d.peer(t)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Read(make([]byte, 1))
+		done <- err
+	}()
+	// wait for the Read to use the connection
+	deadline := time.Now().Add(time.Second)
+	for {
+		c.mu.Lock()
+		users := 0
+		if c.conn != nil {
+			users = c.conn.users
+		}
+		c.mu.Unlock()
+		if users == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Read did not start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// the connection in use is interrupted, and closed once the Read returns
+	d.mu.Lock()
+	conn := d.conns[0]
+	d.mu.Unlock()
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("got no error from a Read interrupted by Close")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Read still blocked after Close")
+	}
+	if conn.closes != 1 {
+		t.Fatalf("got %d closes once the Read returned, want 1", conn.closes)
+	}
+
+	if _, err := c.Write([]byte("x")); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("got %v writing after Close, want net.ErrClosed", err)
+	}
+	if err := c.Close(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("got %v from a second Close, want net.ErrClosed", err)
+	}
+	if c.State() != StateClosed || len(d.Dials()) != 1 {
+		t.Fatalf("got state %v after %d dials, want closed after 1", c.State(), len(d.Dials()))
+	}
+}
+
+func TestReconnectNotConnected(t *testing.T) {
+	d := newPipeDialer(1000)
+	c := NewReconnectingConn("", ReconnectConfig{InitialBackoff: time.Millisecond, FailFast: true, Dial: d.Dial})
+	if _, err := c.Write([]byte("x")); err != ErrNotConnected {
+		t.Fatalf("got %v with FailFast, want ErrNotConnected", err)
+	}
+	c.Close()
+
+	c = NewReconnectingConn("", ReconnectConfig{InitialBackoff: time.Millisecond, WaitTimeout: 20 * time.Millisecond, Dial: d.Dial})
+	start := time.Now()
+	if _, err := c.Read(make([]byte, 1)); err != ErrNotConnected {
+		t.Fatalf("got %v past WaitTimeout, want ErrNotConnected", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("Read returned after %v, want the 20ms WaitTimeout", elapsed)
+	}
+
+	// Close stops redialing
+	c.Close()
+	time.Sleep(10 * time.Millisecond)
+	n := len(d.Dials())
+	time.Sleep(20 * time.Millisecond)
+	if m := len(d.Dials()); m != n {
+		t.Fatalf("got %d dials after Close, want none", m-n)
+	}
+}
@@ -4,6 +4,11 @@ package rsocket
 #cgo CFLAGS: -I/usr/include
 #cgo LDFLAGS: -lrdmacm -libverbs
 #include <rdma/rsocket.h>
+
+// rfcntl is variadic, which cgo cannot call
+static int rfcntl_arg(int socket, int cmd, int arg) {
+	return rfcntl(socket, cmd, arg);
+}
 */
 import "C"
 import (
@@ -33,11 +38,12 @@ const (
 
 // RDMA specific socket options
 const (
-	SOL_RDMA    = C.SOL_RDMA
-	RDMA_SQSIZE = C.RDMA_SQSIZE
-	RDMA_RQSIZE = C.RDMA_RQSIZE
-	RDMA_INLINE = C.RDMA_INLINE
-	RDMA_ROUTE  = C.RDMA_ROUTE
+	SOL_RDMA       = C.SOL_RDMA
+	RDMA_SQSIZE    = C.RDMA_SQSIZE
+	RDMA_RQSIZE    = C.RDMA_RQSIZE
+	RDMA_INLINE    = C.RDMA_INLINE
+	RDMA_IOMAPSIZE = C.RDMA_IOMAPSIZE
+	RDMA_ROUTE     = C.RDMA_ROUTE
 )
 
 // Socket option constants
@@ -51,16 +57,23 @@ const (
 	SO_ERROR     = syscall.SO_ERROR
 	SO_SNDBUF    = syscall.SO_SNDBUF
 	SO_RCVBUF    = syscall.SO_RCVBUF
+	SO_KEEPALIVE = syscall.SO_KEEPALIVE
 
 	// RDMA specific options
 	O_NONBLOCK = syscall.O_NONBLOCK
 )
 
+// Message flag constants
+const (
+	MSG_DONTWAIT = syscall.MSG_DONTWAIT
+	MSG_PEEK     = syscall.MSG_PEEK
+)
+
 // Socket creates a new RDMA socket
 func Socket(domain, typ, protocol int) (int, error) {
-	fd := C.rsocket(C.int(domain), C.int(typ), C.int(protocol))
+	fd, errno := C.rsocket(C.int(domain), C.int(typ), C.int(protocol))
 	if fd < 0 {
-		return -1, syscall.Errno(-fd)
+		return -1, errnoErr(errno)
 	}
 	return int(fd), nil
 }
@@ -71,16 +84,16 @@ func Bind(fd int, sa syscall.Sockaddr) error {
 	if err != nil {
 		return err
 	}
-	if rc := C.rbind(C.int(fd), (*C.struct_sockaddr)(unsafe.Pointer(ptr)), C.socklen_t(len)); rc < 0 {
-		return syscall.Errno(-rc)
+	if rc, errno := C.rbind(C.int(fd), (*C.struct_sockaddr)(unsafe.Pointer(ptr)), C.socklen_t(len)); rc < 0 {
+		return errnoErr(errno)
 	}
 	return nil
 }
 
 // Listen marks the socket as a passive socket
 func Listen(fd int, backlog int) error {
-	if rc := C.rlisten(C.int(fd), C.int(backlog)); rc < 0 {
-		return syscall.Errno(-rc)
+	if rc, errno := C.rlisten(C.int(fd), C.int(backlog)); rc < 0 {
+		return errnoErr(errno)
 	}
 	return nil
 }
@@ -91,9 +104,9 @@ func Accept(fd int) (int, syscall.Sockaddr, error) {
 		addr syscall.RawSockaddrAny
 		len  = C.socklen_t(syscall.SizeofSockaddrAny)
 	)
-	nfd := C.raccept(C.int(fd), (*C.struct_sockaddr)(unsafe.Pointer(&addr)), &len)
+	nfd, errno := C.raccept(C.int(fd), (*C.struct_sockaddr)(unsafe.Pointer(&addr)), &len)
 	if nfd < 0 {
-		return -1, nil, syscall.Errno(-nfd)
+		return -1, nil, errnoErr(errno)
 	}
 	sa, err := anyToSockaddr(&addr)
 	if err != nil {
@@ -108,8 +121,8 @@ func Connect(fd int, sa syscall.Sockaddr) error {
 	if err != nil {
 		return err
 	}
-	if rc := C.rconnect(C.int(fd), (*C.struct_sockaddr)(unsafe.Pointer(ptr)), C.socklen_t(len)); rc < 0 {
-		return syscall.Errno(-rc)
+	if rc, errno := C.rconnect(C.int(fd), (*C.struct_sockaddr)(unsafe.Pointer(ptr)), C.socklen_t(len)); rc < 0 {
+		return errnoErr(errno)
 	}
 	return nil
 }
@@ -119,9 +132,33 @@ func Read(fd int, p []byte) (int, error) {
 	if len(p) == 0 {
 		return 0, nil
 	}
-	n := C.rread(C.int(fd), unsafe.Pointer(&p[0]), C.size_t(len(p)))
+	n, errno := C.rread(C.int(fd), unsafe.Pointer(&p[0]), C.size_t(len(p)))
+	if n < 0 {
+		return 0, errnoErr(errno)
+	}
+	return int(n), nil
+}
+
+// Recv receives data from a connected socket
+func Recv(fd int, p []byte, flags int) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	n, errno := C.rrecv(C.int(fd), unsafe.Pointer(&p[0]), C.size_t(len(p)), C.int(flags))
+	if n < 0 {
+		return 0, errnoErr(errno)
+	}
+	return int(n), nil
+}
+
+// Send sends data on a connected socket
+func Send(fd int, p []byte, flags int) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	n, errno := C.rsend(C.int(fd), unsafe.Pointer(&p[0]), C.size_t(len(p)), C.int(flags))
 	if n < 0 {
-		return 0, syscall.Errno(-n)
+		return 0, errnoErr(errno)
 	}
 	return int(n), nil
 }
@@ -133,10 +170,10 @@ func RecvFrom(fd int, p []byte, flags int) (int, syscall.Sockaddr, error) {
 	}
 	var addr syscall.RawSockaddrAny
 	var addrlen C.socklen_t = C.socklen_t(syscall.SizeofSockaddrAny)
-	n := C.rrecvfrom(C.int(fd), unsafe.Pointer(&p[0]), C.size_t(len(p)), C.int(flags),
+	n, errno := C.rrecvfrom(C.int(fd), unsafe.Pointer(&p[0]), C.size_t(len(p)), C.int(flags),
 		(*C.struct_sockaddr)(unsafe.Pointer(&addr)), &addrlen)
 	if n < 0 {
-		return 0, nil, syscall.Errno(-n)
+		return 0, nil, errnoErr(errno)
 	}
 	sa, err := anyToSockaddr(&addr)
 	if err != nil {
@@ -147,9 +184,9 @@ func RecvFrom(fd int, p []byte, flags int) (int, syscall.Sockaddr, error) {
 
 // RecvMsg receives a message from the socket
 func RecvMsg(fd int, msg *syscall.Msghdr, flags int) (int, error) {
-	n := C.rrecvmsg(C.int(fd), (*C.struct_msghdr)(unsafe.Pointer(msg)), C.int(flags))
+	n, errno := C.rrecvmsg(C.int(fd), (*C.struct_msghdr)(unsafe.Pointer(msg)), C.int(flags))
 	if n < 0 {
-		return 0, syscall.Errno(-n)
+		return 0, errnoErr(errno)
 	}
 	return int(n), nil
 }
@@ -163,19 +200,19 @@ func SendTo(fd int, p []byte, flags int, sa syscall.Sockaddr) (int, error) {
 	if err != nil {
 		return 0, err
 	}
-	n := C.rsendto(C.int(fd), unsafe.Pointer(&p[0]), C.size_t(len(p)), C.int(flags),
+	n, errno := C.rsendto(C.int(fd), unsafe.Pointer(&p[0]), C.size_t(len(p)), C.int(flags),
 		(*C.struct_sockaddr)(unsafe.Pointer(ptr)), C.socklen_t(l))
 	if n < 0 {
-		return 0, syscall.Errno(-n)
+		return 0, errnoErr(errno)
 	}
 	return int(n), nil
 }
 
 // SendMsg sends a message on the socket
 func SendMsg(fd int, msg *syscall.Msghdr, flags int) (int, error) {
-	n := C.rsendmsg(C.int(fd), (*C.struct_msghdr)(unsafe.Pointer(msg)), C.int(flags))
+	n, errno := C.rsendmsg(C.int(fd), (*C.struct_msghdr)(unsafe.Pointer(msg)), C.int(flags))
 	if n < 0 {
-		return 0, syscall.Errno(-n)
+		return 0, errnoErr(errno)
 	}
 	return int(n), nil
 }
@@ -185,9 +222,9 @@ func Write(fd int, p []byte) (int, error) {
 	if len(p) == 0 {
 		return 0, nil
 	}
-	n := C.rwrite(C.int(fd), unsafe.Pointer(&p[0]), C.size_t(len(p)))
+	n, errno := C.rwrite(C.int(fd), unsafe.Pointer(&p[0]), C.size_t(len(p)))
 	if n < 0 {
-		return 0, syscall.Errno(-n)
+		return 0, errnoErr(errno)
 	}
 	return int(n), nil
 }
@@ -197,25 +234,33 @@ func Writev(fd int, iov []syscall.Iovec) (int, error) {
 	if len(iov) == 0 {
 		return 0, nil
 	}
-	n := C.rwritev(C.int(fd), (*C.struct_iovec)(unsafe.Pointer(&iov[0])), C.int(len(iov)))
+	n, errno := C.rwritev(C.int(fd), (*C.struct_iovec)(unsafe.Pointer(&iov[0])), C.int(len(iov)))
 	if n < 0 {
-		return 0, syscall.Errno(-n)
+		return 0, errnoErr(errno)
 	}
 	return int(n), nil
 }
 
 // Close closes the socket
 func Close(fd int) error {
-	if rc := C.rclose(C.int(fd)); rc < 0 {
-		return syscall.Errno(-rc)
+	if rc, errno := C.rclose(C.int(fd)); rc < 0 {
+		return errnoErr(errno)
+	}
+	return nil
+}
+
+// Shutdown shuts down part of a full-duplex connection
+func Shutdown(fd int, how int) error {
+	if rc, errno := C.rshutdown(C.int(fd), C.int(how)); rc < 0 {
+		return errnoErr(errno)
 	}
 	return nil
 }
 
 // SetSockOpt sets a socket option
 func SetSockOpt(fd, level, opt int, value unsafe.Pointer, len uint32) error {
-	if rc := C.rsetsockopt(C.int(fd), C.int(level), C.int(opt), value, C.socklen_t(len)); rc < 0 {
-		return syscall.Errno(-rc)
+	if rc, errno := C.rsetsockopt(C.int(fd), C.int(level), C.int(opt), value, C.socklen_t(len)); rc < 0 {
+		return errnoErr(errno)
 	}
 	return nil
 }
@@ -223,8 +268,8 @@ func SetSockOpt(fd, level, opt int, value unsafe.Pointer, len uint32) error {
 // GetSockOpt gets a socket option
 func GetSockOpt(fd, level, opt int, value unsafe.Pointer, len *uint32) error {
 	l := C.socklen_t(*len)
-	if rc := C.rgetsockopt(C.int(fd), C.int(level), C.int(opt), value, &l); rc < 0 {
-		return syscall.Errno(-rc)
+	if rc, errno := C.rgetsockopt(C.int(fd), C.int(level), C.int(opt), value, &l); rc < 0 {
+		return errnoErr(errno)
 	}
 	*len = uint32(l)
 	return nil
@@ -257,7 +302,8 @@ func SetReuseAddr(fd int, value bool) error {
 	return SetSockOptInt(fd, SOL_SOCKET, SO_REUSEADDR, intValue)
 }
 
-// SetTCPNoDelay sets TCP_NODELAY option
+// SetTCPNoDelay sets TCP_NODELAY option. rsocket accepts it but sends every
+// write right away regardless, use a CoalescingWriter to batch small writes.
 func SetTCPNoDelay(fd int, value bool) error {
 	intValue := 0
 	if value {
@@ -276,6 +322,31 @@ func SetRecvBuffer(fd int, value int) error {
 	return SetSockOptInt(fd, SOL_SOCKET, SO_RCVBUF, value)
 }
 
+// Fcntl performs the F_GETFL or F_SETFL command on the socket,
+// the only ones rsocket supports
+func Fcntl(fd, cmd, arg int) (int, error) {
+	rc, errno := C.rfcntl_arg(C.int(fd), C.int(cmd), C.int(arg))
+	if rc < 0 {
+		return 0, errnoErr(errno)
+	}
+	return int(rc), nil
+}
+
+// SetNonblock sets or clears O_NONBLOCK on the socket
+func SetNonblock(fd int, nonblocking bool) error {
+	flags, err := Fcntl(fd, syscall.F_GETFL, 0)
+	if err != nil {
+		return err
+	}
+	if nonblocking {
+		flags |= O_NONBLOCK
+	} else {
+		flags &^= O_NONBLOCK
+	}
+	_, err = Fcntl(fd, syscall.F_SETFL, flags)
+	return err
+}
+
 // GetSocketError gets SO_ERROR option
 func GetSocketError(fd int) error {
 	errcode, err := GetSockOptInt(fd, SOL_SOCKET, SO_ERROR)
@@ -303,6 +374,18 @@ func SetRDMAInline(fd int, value int) error {
 	return SetSockOptInt(fd, SOL_RDMA, RDMA_INLINE, value)
 }
 
+// errnoErr returns the errno cgo captured for a failed rsocket call.
+// rsocket functions follow the libc convention: they return -1 and set errno,
+// rather than returning a negated errno like raw system calls, so
+// syscall.Errno(-rc) would report every failure as EPERM. errno should always
+// be non-zero, but a failure without it is reported as EIO rather than success.
+func errnoErr(errno error) error {
+	if errno == nil {
+		return syscall.EIO
+	}
+	return errno
+}
+
 // sockaddrToAny converts a syscall.Sockaddr to a syscall.RawSockaddrAny
 func sockaddrToAny(sa syscall.Sockaddr) (*syscall.RawSockaddrAny, uint32, error) {
 	if sa == nil {
@@ -311,21 +394,22 @@ func sockaddrToAny(sa syscall.Sockaddr) (*syscall.RawSockaddrAny, uint32, error)
 
 	switch sa := sa.(type) {
 	case *syscall.SockaddrInet4:
-		raw := syscall.RawSockaddrInet4{
-			Family: syscall.AF_INET,
-			Port:   uint16((sa.Port >> 8) | ((sa.Port & 0xff) << 8)), // network byte order
-		}
+		// fill a RawSockaddrAny so the returned pointer covers a whole allocation
+		var rsa syscall.RawSockaddrAny
+		raw := (*syscall.RawSockaddrInet4)(unsafe.Pointer(&rsa))
+		raw.Family = syscall.AF_INET
+		raw.Port = uint16((sa.Port >> 8) | ((sa.Port & 0xff) << 8)) // network byte order
 		copy(raw.Addr[:], sa.Addr[:])
-		return (*syscall.RawSockaddrAny)(unsafe.Pointer(&raw)), syscall.SizeofSockaddrInet4, nil
+		return &rsa, syscall.SizeofSockaddrInet4, nil
 
 	case *syscall.SockaddrInet6:
-		raw := syscall.RawSockaddrInet6{
-			Family:   syscall.AF_INET6,
-			Port:     uint16((sa.Port >> 8) | ((sa.Port & 0xff) << 8)), // network byte order
-			Flowinfo: sa.ZoneId,
-		}
+		var rsa syscall.RawSockaddrAny
+		raw := (*syscall.RawSockaddrInet6)(unsafe.Pointer(&rsa))
+		raw.Family = syscall.AF_INET6
+		raw.Port = uint16((sa.Port >> 8) | ((sa.Port & 0xff) << 8)) // network byte order
+		raw.Scope_id = sa.ZoneId
 		copy(raw.Addr[:], sa.Addr[:])
-		return (*syscall.RawSockaddrAny)(unsafe.Pointer(&raw)), syscall.SizeofSockaddrInet6, nil
+		return &rsa, syscall.SizeofSockaddrInet6, nil
 
 	default:
 		return nil, 0, syscall.EAFNOSUPPORT
@@ -367,8 +451,8 @@ func GetPeerName(fd int) (syscall.Sockaddr, error) {
 		addr syscall.RawSockaddrAny
 		len  = C.socklen_t(syscall.SizeofSockaddrAny)
 	)
-	if rc := C.rgetpeername(C.int(fd), (*C.struct_sockaddr)(unsafe.Pointer(&addr)), &len); rc < 0 {
-		return nil, syscall.Errno(-rc)
+	if rc, errno := C.rgetpeername(C.int(fd), (*C.struct_sockaddr)(unsafe.Pointer(&addr)), &len); rc < 0 {
+		return nil, errnoErr(errno)
 	}
 	return anyToSockaddr(&addr)
 }
@@ -379,27 +463,29 @@ func GetSockName(fd int) (syscall.Sockaddr, error) {
 		addr syscall.RawSockaddrAny
 		len  = C.socklen_t(syscall.SizeofSockaddrAny)
 	)
-	if rc := C.rgetsockname(C.int(fd), (*C.struct_sockaddr)(unsafe.Pointer(&addr)), &len); rc < 0 {
-		return nil, syscall.Errno(-rc)
+	if rc, errno := C.rgetsockname(C.int(fd), (*C.struct_sockaddr)(unsafe.Pointer(&addr)), &len); rc < 0 {
+		return nil, errnoErr(errno)
 	}
 	return anyToSockaddr(&addr)
 }
 
-// Poll polls the file descriptors
+// Poll polls the file descriptors. With no descriptors it just waits for
+// the timeout. See Poller for repeated polling of a set of descriptors.
 func Poll(fds []unix.PollFd, timeout int) (int, error) {
-	n := C.rpoll((*C.struct_pollfd)(unsafe.Pointer(&fds[0])), C.nfds_t(len(fds)), C.int(timeout))
+	n, errno := C.rpoll((*C.struct_pollfd)(unsafe.Pointer(unsafe.SliceData(fds))), C.nfds_t(len(fds)), C.int(timeout))
 	if n < 0 {
-		return 0, syscall.Errno(-n)
+		return 0, errnoErr(errno)
 	}
 	return int(n), nil
 }
 
-// Select waits for some file descriptors to become ready to perform I/O
+// Select waits for some file descriptors to become ready to perform I/O.
+// Build the sets with FdZero and FdSet and test them with FdIsSet.
 func Select(nfds int, readfds, writefds, exceptfds *syscall.FdSet, timeout *syscall.Timeval) (int, error) {
-	n := C.rselect(C.int(nfds), (*C.fd_set)(unsafe.Pointer(readfds)), (*C.fd_set)(unsafe.Pointer(writefds)),
+	n, errno := C.rselect(C.int(nfds), (*C.fd_set)(unsafe.Pointer(readfds)), (*C.fd_set)(unsafe.Pointer(writefds)),
 		(*C.fd_set)(unsafe.Pointer(exceptfds)), (*C.struct_timeval)(unsafe.Pointer(timeout)))
 	if n < 0 {
-		return 0, syscall.Errno(-n)
+		return 0, errnoErr(errno)
 	}
 	return int(n), nil
 }
@@ -407,9 +493,9 @@ func Select(nfds int, readfds, writefds, exceptfds *syscall.FdSet, timeout *sysc
 // Iomap maps a file or device into memory
 func Iomap(fd int, buf []byte, prot int, flags int, offset int64) (int64, error) {
 	ptr := unsafe.Pointer(&buf[0])
-	rc := C.riomap(C.int(fd), ptr, C.size_t(len(buf)), C.int(prot), C.int(flags), C.off_t(offset))
+	rc, errno := C.riomap(C.int(fd), ptr, C.size_t(len(buf)), C.int(prot), C.int(flags), C.off_t(offset))
 	if rc == ^C.off_t(0) {
-		return 0, syscall.Errno(-rc)
+		return 0, errnoErr(errno)
 	}
 	return int64(rc), nil
 }
@@ -417,9 +503,9 @@ func Iomap(fd int, buf []byte, prot int, flags int, offset int64) (int64, error)
 // Iounmap unmaps a file or device from memory
 func Iounmap(fd int, buf []byte) error {
 	ptr := unsafe.Pointer(&buf[0])
-	rc := C.riounmap(C.int(fd), ptr, C.size_t(len(buf)))
+	rc, errno := C.riounmap(C.int(fd), ptr, C.size_t(len(buf)))
 	if rc < 0 {
-		return syscall.Errno(-rc)
+		return errnoErr(errno)
 	}
 	return nil
 }
@@ -427,9 +513,10 @@ func Iounmap(fd int, buf []byte) error {
 // Iowrite writes data to a file or device at a specific offset
 func Iowrite(fd int, buf []byte, offset int64, flags int) (int, error) {
 	ptr := unsafe.Pointer(&buf[0])
-	rc := C.riowrite(C.int(fd), ptr, C.size_t(len(buf)), C.off_t(offset), C.int(flags))
-	if rc < 0 {
-		return 0, syscall.Errno(-rc)
+	rc, errno := C.riowrite(C.int(fd), ptr, C.size_t(len(buf)), C.off_t(offset), C.int(flags))
+	// riowrite returns a size_t, -1 on error
+	if rc == ^C.size_t(0) {
+		return 0, errnoErr(errno)
 	}
 	return int(rc), nil
 }
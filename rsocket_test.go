@@ -0,0 +1,55 @@
+package rsocket
+
+import (
+	"net"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+// testListener listens on a free loopback port. The test is skipped when
+// rsocket cannot create sockets, for example without an RDMA device.
+func testListener(t *testing.T, optFns ...OptionSocketFn) (*TCPListener, string) {
+	t.Helper()
+	ln, err := NewTCPListener("127.0.0.1", 0, 16, optFns...)
+	if err != nil {
+		t.Skipf("rsocket not available: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	sa, err := GetSockName(ln.File())
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := sa.(*syscall.SockaddrInet4).Port
+	return ln, net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+}
+
+// testConnPair returns both ends of a loopback connection.
+func testConnPair(t *testing.T) (client, server *TCPConn) {
+	t.Helper()
+	ln, addr := testListener(t)
+
+	accepted := make(chan *TCPConn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		accepted <- conn.(*TCPConn)
+	}()
+	client, err := DialTCP(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server = <-accepted
+	if server == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
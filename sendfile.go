@@ -0,0 +1,184 @@
+package rsocket
+
+import (
+	"io"
+	"os"
+)
+
+// sendFileChunks is the number of pool buffers ReadFrom fills from a file
+// before sending them with one rwritev.
+const sendFileChunks = 4
+
+var _ io.ReaderFrom = (*TCPConn)(nil)
+
+// file is what ReadFrom needs of a file. It is implemented by *os.File and
+// by the wrapper os.File.WriteTo passes to io.Copy.
+type file interface {
+	io.ReaderAt
+	io.Seeker
+	Stat() (os.FileInfo, error)
+}
+
+// ReadFrom implements io.ReaderFrom, so io.Copy to the connection uses it.
+// When r is a regular *os.File, or an *io.SectionReader or *io.LimitedReader
+// over one, the file is read with pread in large chunks aligned to the pool's
+// buffers and each batch of chunks is sent with a single rwritev, from its
+// current offset, which is advanced like with sendfile. Memory use is bounded
+// by a few buffers of the connection's pool whatever the size of the file.
+// Other readers are copied through a pool buffer.
+func (c *TCPConn) ReadFrom(r io.Reader) (int64, error) {
+	if n, handled, err := c.sendFile(r); handled {
+		return n, err
+	}
+	pool := bufferPoolOr(c.pool)
+	buf := pool.Get(pool.MaxSize())
+	defer pool.Put(buf)
+	return io.CopyBuffer(writerOnly{c}, r, buf)
+}
+
+// writerOnly hides the ReadFrom method of a writer from io.CopyBuffer.
+type writerOnly struct {
+	io.Writer
+}
+
+// sendFile sends the regular file behind r, if any.
+func (c *TCPConn) sendFile(r io.Reader) (written int64, handled bool, err error) {
+	remain := int64(-1) // unlimited
+	lr, ok := r.(*io.LimitedReader)
+	if ok {
+		remain, r = lr.N, lr.R
+		if remain <= 0 {
+			return 0, true, nil
+		}
+	}
+
+	var f file
+	var seeker io.Seeker
+	off, end := int64(0), int64(-1) // end is the file size unless r is a section
+	switch r := r.(type) {
+	case *io.SectionReader:
+		outer, base, n := r.Outer()
+		if f, ok = outer.(file); !ok {
+			return 0, false, nil
+		}
+		pos, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, false, nil
+		}
+		seeker, off, end = r, base+pos, base+n
+	case file:
+		pos, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, false, nil
+		}
+		f, seeker, off = r, r, pos
+	default:
+		return 0, false, nil
+	}
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return 0, false, nil
+	}
+	if end < 0 || end > fi.Size() {
+		end = fi.Size()
+	}
+	n := max(end-off, 0)
+	if remain >= 0 {
+		n = min(n, remain)
+	}
+
+	written, err = c.sendFileRange(f, off, n)
+	if _, serr := seeker.Seek(written, io.SeekCurrent); serr != nil && err == nil {
+		err = serr
+	}
+	if lr != nil {
+		lr.N -= written
+	}
+	return written, true, err
+}
+
+// sendFileRange sends n bytes of f from offset off.
+func (c *TCPConn) sendFileRange(f io.ReaderAt, off, n int64) (int64, error) {
+	pool := bufferPoolOr(c.pool)
+	chunk := int64(pool.MaxSize())
+	var bufs [sendFileChunks][]byte
+	for i := range bufs {
+		bufs[i] = pool.Get(int(chunk))
+		defer pool.Put(bufs[i])
+	}
+
+	var written int64
+	iov := make([][]byte, 0, sendFileChunks)
+	for written < n {
+		// fill the chunks, the first one up to the next chunk boundary of
+		// the file so that the following reads are aligned
+		iov = iov[:0]
+		pos, eof := off+written, false
+		for i := 0; i < sendFileChunks && pos < off+n && !eof; i++ {
+			size := min(chunk-pos%chunk, off+n-pos)
+			m, err := f.ReadAt(bufs[i][:size], pos)
+			if err == io.EOF {
+				// the file shrank, send what is left
+				eof = true
+			} else if err != nil {
+				return written, err
+			}
+			if m > 0 {
+				iov = append(iov, bufs[i][:m])
+			}
+			pos += int64(m)
+		}
+		if len(iov) == 0 {
+			break
+		}
+
+		m, err := c.Writev(iov)
+		written += int64(m)
+		if err != nil || eof {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// IowriteFile writes n bytes of f from offset off into the buffer the peer
+// mapped with Iomap, at remoteOffset, with riowrite. The data goes straight
+// into the peer's memory without a receive on its side: the application
+// protocol has to tell the peer which window to use and when the data is
+// there, e.g. with a message written after IowriteFile returns, since
+// rsocket delivers riowrite data before later sends.
+func (c *TCPConn) IowriteFile(f *os.File, off, n, remoteOffset int64) (int64, error) {
+	pool := bufferPoolOr(c.pool)
+	buf := pool.Get(pool.MaxSize())
+	defer pool.Put(buf)
+
+	var written int64
+	for written < n {
+		m, err := f.ReadAt(buf[:min(int64(len(buf)), n-written)], off+written)
+		if m == 0 {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return written, err
+		}
+		for p := buf[:m]; len(p) > 0; {
+			start := c.trace.now()
+			w, werr := Iowrite(c.fd, p, remoteOffset+written, 0)
+			recordWrite(w, werr)
+			c.bytesWritten.Add(uint64(w))
+			c.trace.write(c.fd, w, werr, start)
+			if werr != nil {
+				return written, werr
+			}
+			if w == 0 {
+				return written, io.ErrShortWrite
+			}
+			p = p[w:]
+			written += int64(w)
+		}
+		if err != nil && err != io.EOF {
+			return written, err
+		}
+	}
+	return written, nil
+}
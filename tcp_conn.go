@@ -1,10 +1,16 @@
 package rsocket
 
 import (
-	"log"
+	"context"
+	"io"
+	"log/slog"
 	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"unsafe"
 )
 
 var _ net.Conn = (*TCPConn)(nil)
@@ -12,59 +18,206 @@ var _ net.Listener = (*TCPListener)(nil)
 
 type OptionSocketFn func(fd int) error
 
+// WithLocalAddr binds the socket to ip and port. An empty or unspecified ip
+// is the any address of the socket's family, any other must be of that
+// family: an IPv4 address for an IPv4 socket, an IPv6 one otherwise.
 func WithLocalAddr(ip string, port int) OptionSocketFn {
 	return func(fd int) error {
 		srcAddr := net.ParseIP(ip)
-		sa := &syscall.SockaddrInet4{
-			Port: port,
+		if srcAddr == nil && ip != "" {
+			return &net.AddrError{Err: "invalid local IP address", Addr: ip}
 		}
-		copy(sa.Addr[:], srcAddr.To4())
 
+		s := lookupSetup(fd)
+		family := AF_INET
+		if s != nil {
+			family = s.family
+		} else if sa, err := GetSockName(fd); err == nil {
+			if _, ok := sa.(*syscall.SockaddrInet6); ok {
+				family = AF_INET6
+			}
+		}
+		sa, err := localSockaddr(family, srcAddr, port)
+		if err != nil {
+			return err
+		}
+
+		if s != nil {
+			return s.bind(fd, sa)
+		}
 		return Bind(fd, sa)
 	}
 }
 
-// TCPListener is a TCP network listener baseded on rsocket.
-type TCPListener struct {
-	ip      string
-	port    int
-	tcpAddr *net.TCPAddr
-	fd      int
+// listenSockaddr returns the family and the sockaddr to listen on ip and
+// port: IPv6 for an IPv6 ip, otherwise IPv4.
+func listenSockaddr(ip string, port int) (int, syscall.Sockaddr, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil && ip != "" {
+		return 0, nil, &net.AddrError{Err: "invalid listen IP address", Addr: ip}
+	}
+	family := AF_INET
+	if addr != nil && addr.To4() == nil {
+		family = AF_INET6
+	}
+	sa, err := localSockaddr(family, addr, port)
+	return family, sa, err
 }
 
-type TCPConn struct {
-	fd         int
-	localAddr  *net.TCPAddr
-	remoteAddr *net.TCPAddr
+// localSockaddr returns the sockaddr of family to bind ip and port to. A nil
+// or unspecified ip is the any address of family.
+func localSockaddr(family int, ip net.IP, port int) (syscall.Sockaddr, error) {
+	if ip == nil || ip.IsUnspecified() {
+		ip = nil
+	}
+	if family == AF_INET6 {
+		sa := &syscall.SockaddrInet6{Port: port}
+		if ip != nil {
+			if ip.To4() != nil {
+				return nil, &net.AddrError{Err: "IPv4 local address on an IPv6 socket", Addr: ip.String()}
+			}
+			copy(sa.Addr[:], ip)
+		}
+		return sa, nil
+	}
+	sa := &syscall.SockaddrInet4{Port: port}
+	if ip != nil {
+		ip4 := ip.To4()
+		if ip4 == nil {
+			return nil, &net.AddrError{Err: "IPv6 local address on an IPv4 socket", Addr: ip.String()}
+		}
+		copy(sa.Addr[:], ip4)
+	}
+	return sa, nil
 }
 
-// NewTCPListener creates a new TCPListener.
-// It binds the listener to the given ip and port.
-func NewTCPListener(ip string, port int, backlog int, optFns ...OptionSocketFn) (*TCPListener, error) {
-	fd, err := Socket(AF_INET, SOCK_STREAM, 0)
+// socketSetup is the state that options attach to a socket while DialTCP or
+// NewTCPListener sets it up.
+type socketSetup struct {
+	family    int // AF_INET or AF_INET6
+	trace     *ConnTrace
+	logger    *slog.Logger
+	pool      *BufferPool
+	nonblock  bool
+	staged    []stagedOption // options deferred to a later stage, see NewOption
+	capture   *Capture
+	admission *AdmissionConfig
+}
+
+// setups holds the sockets that are being set up, keyed by fd.
+var setups sync.Map // fd -> *socketSetup
+
+// lookupSetup returns the setup state of fd, or nil if fd is not being set up.
+func lookupSetup(fd int) *socketSetup {
+	s, _ := setups.Load(fd)
+	setup, _ := s.(*socketSetup)
+	return setup
+}
+
+// newSocket creates an rsocket of family and typ and applies optFns to it.
+// On error the socket is closed.
+func newSocket(setup *socketSetup, family, typ int, optFns []OptionSocketFn) (int, error) {
+	fd, err := Socket(family, typ, 0)
+	setup.trace.socketCreated(fd, err)
+	if logger := loggerOr(setup.logger); debugEnabled(logger) {
+		logDebug(logger, "rsocket: socket", appendErr([]slog.Attr{slog.Int("fd", fd)}, err)...)
+	}
 	if err != nil {
-		log.Fatal(err)
+		return -1, err
 	}
 
-	for _, optFn := range optFns {
+	setup.family = family
+	setups.Store(fd, setup)
+	defer setups.Delete(fd)
+
+	for i, optFn := range optFns {
 		err = optFn(fd)
+		if logger := loggerOr(setup.logger); debugEnabled(logger) {
+			logDebug(logger, "rsocket: apply option", appendErr([]slog.Attr{slog.Int("fd", fd), slog.Int("option", i)}, err)...)
+		}
 		if err != nil {
 			Close(fd)
-			return nil, err
+			return -1, err
 		}
 	}
+	return fd, nil
+}
 
-	srcAddr := net.ParseIP(ip)
-	sa := &syscall.SockaddrInet4{
-		Port: port,
+// bind binds fd to sa and reports it to the trace and logger of the setup.
+func (s *socketSetup) bind(fd int, sa syscall.Sockaddr) error {
+	addr := sockaddrToTCPAddr(sa)
+	s.trace.bindStart(fd, addr)
+	start := s.trace.now()
+	err := Bind(fd, sa)
+	s.trace.bindDone(fd, addr, err, start)
+	if logger := loggerOr(s.logger); debugEnabled(logger) {
+		logDebug(logger, "rsocket: bind", appendErr([]slog.Attr{slog.Int("fd", fd), addrAttr("local", addr)}, err)...)
+	}
+	return err
+}
+
+// TCPListener is a TCP network listener baseded on rsocket.
+type TCPListener struct {
+	ip        string
+	port      int
+	tcpAddr   *net.TCPAddr
+	fd        int
+	metrics   listenerMetrics
+	trace     *ConnTrace
+	logger    *slog.Logger   // nil means the package-level logger
+	pool      *BufferPool    // nil means DefaultBufferPool
+	staged    []stagedOption // applied to accepted connections
+	capture   *Capture       // nil if accepted connections are not captured
+	admission *admission     // nil without WithAdmission
+}
+
+type TCPConn struct {
+	fd           int
+	localAddr    *net.TCPAddr
+	remoteAddr   *net.TCPAddr
+	listener     *listenerMetrics // nil for dialed connections
+	closed       atomic.Bool
+	trace        *ConnTrace
+	logger       *slog.Logger // nil means the package-level logger
+	pool         *BufferPool  // nil means DefaultBufferPool
+	readSize     atomic.Int64 // ReadPooled buffer size, 0 until the first call
+	created      time.Time
+	bytesRead    atomic.Uint64
+	bytesWritten atomic.Uint64
+	capture      atomic.Pointer[captureStream]
+	admission    *admission // released on Close, nil if not admitted by one
+}
+
+// NewTCPListener creates a new TCPListener.
+// It binds the listener to the given ip and port, an IPv4 or IPv6 literal, or
+// to the IPv4 any address if ip is empty.
+func NewTCPListener(ip string, port int, backlog int, optFns ...OptionSocketFn) (*TCPListener, error) {
+	family, sa, err := listenSockaddr(ip, port)
+	if err != nil {
+		return nil, err
+	}
+	setup := &socketSetup{}
+	fd, err := newSocket(setup, family, SOCK_STREAM, optFns)
+	if err != nil {
+		return nil, err
 	}
-	copy(sa.Addr[:], srcAddr.To4())
+	srcAddr := net.ParseIP(ip)
 
-	if err := Bind(fd, sa); err != nil {
+	if err := setup.bind(fd, sa); err != nil {
+		Close(fd)
+		return nil, err
+	}
+	if err := setup.runStage(fd, StagePreConnect); err != nil {
+		Close(fd)
 		return nil, err
 	}
 
-	if err := Listen(fd, backlog); err != nil {
+	err = Listen(fd, backlog)
+	if logger := loggerOr(setup.logger); debugEnabled(logger) {
+		logDebug(logger, "rsocket: listen", appendErr([]slog.Attr{slog.Int("fd", fd), slog.Int("backlog", backlog)}, err)...)
+	}
+	if err != nil {
+		Close(fd)
 		return nil, err
 	}
 
@@ -73,41 +226,106 @@ func NewTCPListener(ip string, port int, backlog int, optFns ...OptionSocketFn)
 		Port: port,
 	}
 
-	return &TCPListener{
+	l := &TCPListener{
 		ip:      ip,
 		port:    port,
 		fd:      fd,
 		tcpAddr: localAddr,
-	}, nil
+		trace:   setup.trace,
+		logger:  setup.logger,
+		pool:    setup.pool,
+		staged:  setup.staged,
+		capture: setup.capture,
+	}
+	if setup.admission != nil {
+		l.admission = newAdmission(*setup.admission)
+	}
+	listeners.Store(l, struct{}{})
+
+	return l, nil
 }
 
 // Accept waits for and returns the next connection to the listener.
+// Connections over the budget set with WithAdmission are not returned.
 func (l *TCPListener) Accept() (net.Conn, error) {
-	fd, addr, err := Accept(l.fd)
+	fd, remoteAddr, start, err := l.accept()
 	if err != nil {
 		return nil, err
 	}
-	sa := addr.(*syscall.SockaddrInet4)
-	ip := net.IPv4(sa.Addr[0], sa.Addr[1], sa.Addr[2], sa.Addr[3])
-	port := sa.Port
-
-	remoteAddr := &net.TCPAddr{
-		IP:   ip,
-		Port: port,
-	}
 
 	conn := &TCPConn{
+		created:    time.Now(),
 		fd:         fd,
 		localAddr:  l.tcpAddr,
 		remoteAddr: remoteAddr,
+		listener:   &l.metrics,
+		trace:      l.trace,
+		logger:     l.logger,
+		pool:       l.pool,
+		admission:  l.admission,
+	}
+	l.trace.accepted(l.fd, fd, remoteAddr, nil, start)
+	if logger := loggerOr(l.logger); debugEnabled(logger) {
+		logDebug(logger, "rsocket: accept", slog.Int("lfd", l.fd), slog.Int("fd", fd),
+			addrAttr("local", l.tcpAddr), addrAttr("remote", remoteAddr))
 	}
+	// a failing option is logged but does not fail Accept, which would stop
+	// most accept loops
+	runOptions(fd, l.staged, StagePostAccept, l.logger)
+	if l.capture != nil {
+		conn.SetCapture(l.capture)
+	}
+	l.metrics.accepted.Add(1)
+	l.metrics.active.Add(1)
+	metrics.active.Add(1)
 
 	return conn, nil
 }
 
+// accept accepts the next connection within the admission budget.
+func (l *TCPListener) accept() (int, *net.TCPAddr, time.Time, error) {
+	for {
+		if err := l.admission.wait(); err != nil {
+			return -1, nil, time.Time{}, err
+		}
+		start := time.Now()
+		fd, addr, err := Accept(l.fd)
+		recordAccept(start, err)
+		if err != nil {
+			l.admission.cancel()
+			l.trace.accepted(l.fd, -1, nil, err, start)
+			if logger := loggerOr(l.logger); debugEnabled(logger) {
+				logDebug(logger, "rsocket: accept", appendErr([]slog.Attr{slog.Int("lfd", l.fd), addrAttr("local", l.tcpAddr)}, err)...)
+			}
+			return -1, nil, start, err
+		}
+		remoteAddr := sockaddrToTCPAddr(addr)
+		if remoteAddr == nil {
+			remoteAddr = &net.TCPAddr{IP: net.IPv4zero}
+		}
+		if reason := l.admission.admit(remoteAddr.IP); reason != "" {
+			l.reject(fd, remoteAddr, reason)
+			continue
+		}
+		return fd, remoteAddr, start, nil
+	}
+}
+
 // Close closes the listener.
 func (l *TCPListener) Close() error {
-	return Close(l.fd)
+	listeners.Delete(l)
+	l.admission.close()
+	err := Close(l.fd)
+	l.trace.closed(l.fd, err)
+	if logger := loggerOr(l.logger); debugEnabled(logger) {
+		logDebug(logger, "rsocket: close listener", appendErr([]slog.Attr{slog.Int("fd", l.fd), addrAttr("local", l.tcpAddr)}, err)...)
+	}
+	return err
+}
+
+// ActiveConns returns the number of accepted connections that are not closed yet.
+func (l *TCPListener) ActiveConns() int64 {
+	return l.metrics.active.Load()
 }
 
 // Addr returns the listener's network address.
@@ -121,61 +339,180 @@ func (l *TCPListener) File() int {
 }
 
 // DialTCP connects to the address on the named network based on rsocket.
+// All addresses of the host are tried in order, see Dialer for more control.
 func DialTCP(address string, optFns ...OptionSocketFn) (*TCPConn, error) {
-	fd, err := Socket(AF_INET, SOCK_STREAM, 0)
-	if err != nil {
-		log.Fatal(err)
+	return DialTCPContext(context.Background(), address, optFns...)
+}
+
+// DialTCPContext is like DialTCP but reports the stages of the dial to the
+// ConnTrace of ctx, if any. It returns ctx.Err() if ctx is done before connecting.
+func DialTCPContext(ctx context.Context, address string, optFns ...OptionSocketFn) (*TCPConn, error) {
+	d := &Dialer{Options: optFns}
+	return d.dialTCP(ctx, "tcp", address)
+}
+
+// File returns the connection's file descriptor.
+func (c *TCPConn) File() int {
+	return c.fd
+}
+
+// Read reads data from the connection.
+// It returns io.EOF once the peer has closed the connection.
+func (c *TCPConn) Read(p []byte) (int, error) {
+	start := c.trace.now()
+	n, err := Read(c.fd, p)
+	// rread returns 0 at the end of the stream, as read does, but io.Reader
+	// callers such as io.Copy expect io.EOF and would spin on (0, nil)
+	if n == 0 && err == nil && len(p) > 0 {
+		err = io.EOF
 	}
+	recordRead(n, err)
+	c.bytesRead.Add(uint64(n))
+	c.captureRead(p[:max(n, 0)], err)
+	c.trace.read(c.fd, n, err, start)
+	return n, err
+}
 
-	for _, optFn := range optFns {
-		err = optFn(fd)
-		if err != nil {
-			Close(fd)
-			return nil, err
+// ReadPooled reads into a buffer from the connection's pool, sized to hold
+// what one read can return: the SO_RCVBUF of the socket, capped at the
+// largest class of the pool. Pass the buffer to Release once it is no longer
+// used, so that a steady stream of reads does not allocate.
+func (c *TCPConn) ReadPooled() ([]byte, error) {
+	pool := bufferPoolOr(c.pool)
+	size := int(c.readSize.Load())
+	if size == 0 {
+		size = pool.MaxSize()
+		if rcvbuf, err := GetSockOptInt(c.fd, SOL_SOCKET, SO_RCVBUF); err == nil && rcvbuf > 0 && rcvbuf < size {
+			size = rcvbuf
 		}
+		c.readSize.Store(int64(size))
 	}
 
-	tcpAddr, err := net.ResolveTCPAddr("tcp", address)
-	if err != nil {
+	buf := pool.Get(size)
+	n, err := c.Read(buf)
+	if n == 0 {
+		pool.Put(buf)
 		return nil, err
 	}
+	return buf[:n], err
+}
 
-	sa := &syscall.SockaddrInet4{
-		Port: tcpAddr.Port,
-	}
-	copy(sa.Addr[:], tcpAddr.IP.To4())
+// GetBuffer returns a buffer of length n from the connection's pool, e.g. to
+// fill and Write. Pass it to Release once it is no longer used.
+func (c *TCPConn) GetBuffer(n int) []byte {
+	return bufferPoolOr(c.pool).Get(n)
+}
 
-	if err := Connect(fd, sa); err != nil {
-		return nil, err
-	}
+// Release returns a buffer from ReadPooled or GetBuffer to the pool.
+func (c *TCPConn) Release(buf []byte) {
+	bufferPoolOr(c.pool).Put(buf)
+}
 
-	conn := &TCPConn{
-		fd:         fd,
-		localAddr:  nil,
-		remoteAddr: tcpAddr,
+// Write writes data to the connection.
+func (c *TCPConn) Write(p []byte) (int, error) {
+	start := c.trace.now()
+	n, err := Write(c.fd, p)
+	recordWrite(n, err)
+	c.bytesWritten.Add(uint64(n))
+	c.capture.Load().data(true, p[:max(n, 0)])
+	c.trace.write(c.fd, n, err, start)
+	return n, err
+}
+
+// Writev writes all bufs to the connection with rwritev, so they go out in a
+// single call unless rsocket accepts only part of them.
+// It returns the number of bytes written.
+func (c *TCPConn) Writev(bufs [][]byte) (int, error) {
+	// the iovecs hold pointers to Go memory that C may not keep unpinned
+	var pinner runtime.Pinner
+	defer pinner.Unpin()
+
+	iovs := make([]syscall.Iovec, 0, len(bufs))
+	for _, b := range bufs {
+		if len(b) == 0 {
+			continue
+		}
+		pinner.Pin(&b[0])
+		iov := syscall.Iovec{Base: &b[0]}
+		iov.SetLen(len(b))
+		iovs = append(iovs, iov)
 	}
 
-	return conn, nil
+	written := 0
+	for len(iovs) > 0 {
+		start := c.trace.now()
+		n, err := Writev(c.fd, iovs)
+		recordWrite(n, err)
+		c.bytesWritten.Add(uint64(n))
+		c.capture.Load().dataIovecs(iovs, n)
+		c.trace.write(c.fd, n, err, start)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			return written, io.ErrShortWrite
+		}
+
+		// skip what was written and retry the rest
+		for n > 0 {
+			if l := int(iovs[0].Len); n >= l {
+				n -= l
+				iovs = iovs[1:]
+				continue
+			}
+			iovs[0].Base = (*byte)(unsafe.Add(unsafe.Pointer(iovs[0].Base), n))
+			iovs[0].SetLen(int(iovs[0].Len) - n)
+			n = 0
+		}
+	}
+	return written, nil
 }
 
-// File returns the connection's file descriptor.
-func (c *TCPConn) File() int {
-	return c.fd
+// Close closes the connection. Only the first call closes the socket, later
+// ones return net.ErrClosed: the fd may already belong to another socket.
+func (c *TCPConn) Close() error {
+	if !c.closed.CompareAndSwap(false, true) {
+		return net.ErrClosed
+	}
+	c.capture.Load().fin(true)
+	metrics.active.Add(-1)
+	if c.listener != nil {
+		c.listener.active.Add(-1)
+	}
+	c.admission.release(c.remoteAddr.IP)
+	err := Close(c.fd)
+	c.trace.closed(c.fd, err)
+	if logger := loggerOr(c.logger); debugEnabled(logger) {
+		logDebug(logger, "rsocket: close", appendErr([]slog.Attr{slog.Int("fd", c.fd),
+			addrAttr("local", c.localAddr), addrAttr("remote", c.remoteAddr)}, err)...)
+	}
+	return err
 }
 
-// Read reads data from the connection.
-func (c *TCPConn) Read(p []byte) (int, error) {
-	return Read(c.fd, p)
+// CloseRead shuts down the reading side of the connection.
+func (c *TCPConn) CloseRead() error {
+	return Shutdown(c.fd, syscall.SHUT_RD)
 }
 
-// Write writes data to the connection.
-func (c *TCPConn) Write(p []byte) (int, error) {
-	return Write(c.fd, p)
+// CloseWrite shuts down the writing side of the connection.
+func (c *TCPConn) CloseWrite() error {
+	return Shutdown(c.fd, syscall.SHUT_WR)
 }
 
-// Close closes the connection.
-func (c *TCPConn) Close() error {
-	return Close(c.fd)
+// interruptConn makes pending reads and writes on conn fail without closing it,
+// since the fd could be reused while they are still in flight.
+func interruptConn(conn net.Conn) {
+	type shutdowner interface {
+		CloseRead() error
+		CloseWrite() error
+	}
+	if sc, ok := conn.(shutdowner); ok {
+		sc.CloseRead()
+		sc.CloseWrite()
+		return
+	}
+	conn.SetDeadline(time.Now())
 }
 
 // LocalAddr returns the local network address.
@@ -0,0 +1,90 @@
+package rsocket
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestLocalSockaddr(t *testing.T) {
+	tests := []struct {
+		family int
+		ip     string
+		want   syscall.Sockaddr // nil if an error is expected
+	}{
+		{AF_INET, "", &syscall.SockaddrInet4{Port: 80}},
+		{AF_INET, "192.0.2.1", &syscall.SockaddrInet4{Port: 80, Addr: [4]byte{192, 0, 2, 1}}},
+		{AF_INET, "::", &syscall.SockaddrInet4{Port: 80}},
+		{AF_INET, "2001:db8::1", nil},
+		{AF_INET6, "", &syscall.SockaddrInet6{Port: 80}},
+		{AF_INET6, "0.0.0.0", &syscall.SockaddrInet6{Port: 80}},
+		{AF_INET6, "2001:db8::1", &syscall.SockaddrInet6{Port: 80, Addr: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 1}}},
+		{AF_INET6, "192.0.2.1", nil},
+	}
+	for _, tt := range tests {
+		got, err := localSockaddr(tt.family, net.ParseIP(tt.ip), 80)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("family %d, %q: got %+v, want an error", tt.family, tt.ip, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("family %d, %q: %v", tt.family, tt.ip, err)
+			continue
+		}
+		if !sockaddrEqual(got, tt.want) {
+			t.Errorf("family %d, %q: got %+v, want %+v", tt.family, tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestWithLocalAddrInvalid(t *testing.T) {
+	if err := WithLocalAddr("not an ip", 0)(-1); err == nil {
+		t.Fatal("got no error for an invalid IP")
+	}
+}
+
+func sockaddrEqual(a, b syscall.Sockaddr) bool {
+	switch a := a.(type) {
+	case *syscall.SockaddrInet4:
+		b, ok := b.(*syscall.SockaddrInet4)
+		return ok && a.Port == b.Port && a.Addr == b.Addr
+	case *syscall.SockaddrInet6:
+		b, ok := b.(*syscall.SockaddrInet6)
+		return ok && a.Port == b.Port && a.Addr == b.Addr
+	}
+	return false
+}
+
+func TestListenSockaddr(t *testing.T) {
+	tests := []struct {
+		ip     string
+		family int
+		want   syscall.Sockaddr // nil if an error is expected
+	}{
+		{"", AF_INET, &syscall.SockaddrInet4{Port: 80}},
+		{"0.0.0.0", AF_INET, &syscall.SockaddrInet4{Port: 80}},
+		{"192.0.2.1", AF_INET, &syscall.SockaddrInet4{Port: 80, Addr: [4]byte{192, 0, 2, 1}}},
+		{"::", AF_INET6, &syscall.SockaddrInet6{Port: 80}},
+		{"2001:db8::1", AF_INET6, &syscall.SockaddrInet6{Port: 80, Addr: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 1}}},
+		{"localhost", 0, nil},
+		{"192.0.2", 0, nil},
+	}
+	for _, tt := range tests {
+		family, got, err := listenSockaddr(tt.ip, 80)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%q: got %+v, want an error", tt.ip, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.ip, err)
+			continue
+		}
+		if family != tt.family || !sockaddrEqual(got, tt.want) {
+			t.Errorf("%q: got family %d and %+v, want %d and %+v", tt.ip, family, got, tt.family, tt.want)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package rsocket
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// ConnTrace is a set of hooks that are called at the stages of the life of an
+// rsocket connection or listener. Any hook may be nil. Hooks are called
+// synchronously from the goroutine doing the operation, so they should be fast.
+//
+// A ConnTrace is attached to a dial through the context with WithConnTrace and
+// DialTCPContext, or to a dial or listener with the WithTrace option. Connections
+// accepted by a traced listener inherit its trace.
+type ConnTrace struct {
+	// DNSStart is called before the dialed address is resolved.
+	DNSStart func(address string)
+	// DNSDone is called after the dialed address is resolved.
+	DNSDone func(addr *net.TCPAddr, err error, elapsed time.Duration)
+
+	// SocketCreated is called after the rsocket is created.
+	// It is not called for a trace attached with WithTrace if rsocket fails.
+	SocketCreated func(fd int, err error)
+
+	// BindStart is called before the socket is bound to a local address.
+	BindStart func(fd int, addr net.Addr)
+	// BindDone is called after the socket is bound.
+	BindDone func(fd int, addr net.Addr, err error, elapsed time.Duration)
+
+	// ConnectStart is called before rconnect.
+	ConnectStart func(fd int, addr net.Addr)
+	// ConnectDone is called after rconnect returns.
+	ConnectDone func(fd int, addr net.Addr, err error, elapsed time.Duration)
+
+	// Accepted is called after raccept returns on the listener lfd,
+	// fd is the accepted connection. elapsed includes waiting for a client.
+	Accepted func(lfd, fd int, remote net.Addr, err error, elapsed time.Duration)
+
+	// Read is called after each Read with the number of bytes read.
+	Read func(fd int, n int, err error, elapsed time.Duration)
+	// Write is called after each Write with the number of bytes written.
+	Write func(fd int, n int, err error, elapsed time.Duration)
+
+	// Closed is called after the connection or listener is closed.
+	Closed func(fd int, err error)
+}
+
+type connTraceKey struct{}
+
+// WithConnTrace returns a new context based on ctx that carries trace.
+func WithConnTrace(ctx context.Context, trace *ConnTrace) context.Context {
+	return context.WithValue(ctx, connTraceKey{}, trace)
+}
+
+// ContextConnTrace returns the ConnTrace of ctx, or nil if there is none.
+func ContextConnTrace(ctx context.Context) *ConnTrace {
+	trace, _ := ctx.Value(connTraceKey{}).(*ConnTrace)
+	return trace
+}
+
+// WithTrace attaches trace to the dialed connection or to the listener and
+// the connections it accepts. Put it first so it sees the other options.
+func WithTrace(trace *ConnTrace) OptionSocketFn {
+	return func(fd int) error {
+		if s := lookupSetup(fd); s != nil {
+			s.trace = trace
+			trace.socketCreated(fd, nil)
+		}
+		return nil
+	}
+}
+
+// now returns the current time if t traces anything, or the zero time so
+// untraced connections do not pay for reading the clock.
+func (t *ConnTrace) now() time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+func (t *ConnTrace) dnsStart(address string) {
+	if t != nil && t.DNSStart != nil {
+		t.DNSStart(address)
+	}
+}
+
+func (t *ConnTrace) dnsDone(addr *net.TCPAddr, err error, start time.Time) {
+	if t != nil && t.DNSDone != nil {
+		t.DNSDone(addr, err, time.Since(start))
+	}
+}
+
+func (t *ConnTrace) socketCreated(fd int, err error) {
+	if t != nil && t.SocketCreated != nil {
+		t.SocketCreated(fd, err)
+	}
+}
+
+func (t *ConnTrace) bindStart(fd int, addr net.Addr) {
+	if t != nil && t.BindStart != nil {
+		t.BindStart(fd, addr)
+	}
+}
+
+func (t *ConnTrace) bindDone(fd int, addr net.Addr, err error, start time.Time) {
+	if t != nil && t.BindDone != nil {
+		t.BindDone(fd, addr, err, time.Since(start))
+	}
+}
+
+func (t *ConnTrace) connectStart(fd int, addr net.Addr) {
+	if t != nil && t.ConnectStart != nil {
+		t.ConnectStart(fd, addr)
+	}
+}
+
+func (t *ConnTrace) connectDone(fd int, addr net.Addr, err error, start time.Time) {
+	if t != nil && t.ConnectDone != nil {
+		t.ConnectDone(fd, addr, err, time.Since(start))
+	}
+}
+
+func (t *ConnTrace) accepted(lfd, fd int, remote net.Addr, err error, start time.Time) {
+	if t != nil && t.Accepted != nil {
+		t.Accepted(lfd, fd, remote, err, time.Since(start))
+	}
+}
+
+func (t *ConnTrace) read(fd, n int, err error, start time.Time) {
+	if t != nil && t.Read != nil {
+		t.Read(fd, n, err, time.Since(start))
+	}
+}
+
+func (t *ConnTrace) write(fd, n int, err error, start time.Time) {
+	if t != nil && t.Write != nil {
+		t.Write(fd, n, err, time.Since(start))
+	}
+}
+
+func (t *ConnTrace) closed(fd int, err error) {
+	if t != nil && t.Closed != nil {
+		t.Closed(fd, err)
+	}
+}
@@ -0,0 +1,253 @@
+package rsocket
+
+import (
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var _ net.Conn = (*UDPConn)(nil)
+var _ net.PacketConn = (*UDPConn)(nil)
+
+// UDPConn is a datagram rsocket. A UDPConn from DialUDP sends to the address
+// it was dialed with. One from ListenUDP has no peer until it receives its
+// first datagram: Write then sends to the sender of that datagram, and blocks
+// until there is one. ReadFrom and WriteTo work with any peer.
+type UDPConn struct {
+	fd      int
+	logger  *slog.Logger // nil means the package-level logger
+	closed  atomic.Bool
+	done    chan struct{} // closed by Close
+	capture atomic.Pointer[udpCapture]
+
+	mu         sync.Mutex
+	peer       syscall.Sockaddr
+	remoteAddr *net.UDPAddr
+	ready      chan struct{} // closed once peer is set
+}
+
+// DialUDP creates a datagram rsocket that sends to address, a host:port.
+func DialUDP(address string, optFns ...OptionSocketFn) (*UDPConn, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	family, sa := AF_INET, syscall.Sockaddr(nil)
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		sa4 := &syscall.SockaddrInet4{Port: addr.Port}
+		copy(sa4.Addr[:], ip4)
+		sa = sa4
+	} else {
+		sa6 := &syscall.SockaddrInet6{Port: addr.Port}
+		copy(sa6.Addr[:], addr.IP.To16())
+		family, sa = AF_INET6, sa6
+	}
+
+	setup := &socketSetup{}
+	fd, err := newSocket(setup, family, SOCK_DGRAM, optFns)
+	if err != nil {
+		return nil, err
+	}
+	c := newUDPConn(fd, setup)
+	c.setPeer(sa)
+	if setup.capture != nil {
+		c.SetCapture(setup.capture)
+	}
+	return c, nil
+}
+
+// ListenUDP creates a datagram rsocket bound to the given ip and port, an
+// IPv4 or IPv6 literal, or to the IPv4 any address if ip is empty.
+func ListenUDP(ip string, port int, optFns ...OptionSocketFn) (*UDPConn, error) {
+	family, sa, err := listenSockaddr(ip, port)
+	if err != nil {
+		return nil, err
+	}
+	setup := &socketSetup{}
+	fd, err := newSocket(setup, family, SOCK_DGRAM, optFns)
+	if err != nil {
+		return nil, err
+	}
+	if err := setup.bind(fd, sa); err != nil {
+		Close(fd)
+		return nil, err
+	}
+	c := newUDPConn(fd, setup)
+	if setup.capture != nil {
+		c.SetCapture(setup.capture)
+	}
+	return c, nil
+}
+
+func newUDPConn(fd int, setup *socketSetup) *UDPConn {
+	return &UDPConn{
+		fd:     fd,
+		logger: setup.logger,
+		done:   make(chan struct{}),
+		ready:  make(chan struct{}),
+	}
+}
+
+// setPeer makes sa the peer of Write, unless there is one already.
+func (c *UDPConn) setPeer(sa syscall.Sockaddr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.peer == nil && sa != nil {
+		c.peer = sa
+		c.remoteAddr = sockaddrToUDPAddr(sa)
+		close(c.ready)
+	}
+}
+
+// File returns the connection's file descriptor.
+func (c *UDPConn) File() int {
+	return c.fd
+}
+
+// Read reads a datagram. The first datagram of a UDPConn from ListenUDP
+// sets its peer.
+func (c *UDPConn) Read(p []byte) (int, error) {
+	n, _, err := c.recv(p, 0)
+	return n, err
+}
+
+// ReadFrom reads a datagram and returns the address it came from.
+func (c *UDPConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, sa, err := c.recv(p, 0)
+	if err != nil {
+		return 0, nil, err
+	}
+	return n, sockaddrToUDPAddr(sa), nil
+}
+
+func (c *UDPConn) recv(p []byte, flags int) (int, syscall.Sockaddr, error) {
+	n, sa, err := RecvFrom(c.fd, p, flags)
+	if err == syscall.EAGAIN && flags&MSG_DONTWAIT != 0 {
+		return 0, nil, ErrWouldBlock
+	}
+	recordRead(n, err)
+	if err != nil {
+		return 0, nil, err
+	}
+	c.setPeer(sa)
+	c.capture.Load().datagram(c.fd, false, sa, p[:n])
+	return n, sa, nil
+}
+
+// Write sends p as a datagram to the peer, waiting for a UDPConn from
+// ListenUDP to receive its first datagram.
+func (c *UDPConn) Write(p []byte) (int, error) {
+	select {
+	case <-c.ready:
+	case <-c.done:
+		return 0, net.ErrClosed
+	}
+	return c.send(p, 0, c.currentPeer())
+}
+
+// WriteTo sends p as a datagram to addr, a *net.UDPAddr.
+func (c *UDPConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	sa, err := udpAddrToSockaddr(addr)
+	if err != nil {
+		return 0, err
+	}
+	return c.send(p, 0, sa)
+}
+
+func (c *UDPConn) send(p []byte, flags int, sa syscall.Sockaddr) (int, error) {
+	n, err := SendTo(c.fd, p, flags, sa)
+	if err == syscall.EAGAIN && flags&MSG_DONTWAIT != 0 {
+		return 0, ErrWouldBlock
+	}
+	recordWrite(n, err)
+	if err == nil {
+		c.capture.Load().datagram(c.fd, true, sa, p[:n])
+	}
+	return n, err
+}
+
+func (c *UDPConn) currentPeer() syscall.Sockaddr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.peer
+}
+
+// Close closes the connection. Only the first call closes the socket, later
+// ones return net.ErrClosed.
+func (c *UDPConn) Close() error {
+	if !c.closed.CompareAndSwap(false, true) {
+		return net.ErrClosed
+	}
+	close(c.done)
+	err := Close(c.fd)
+	if logger := loggerOr(c.logger); debugEnabled(logger) {
+		logDebug(logger, "rsocket: close", appendErr([]slog.Attr{slog.Int("fd", c.fd), addrAttr("remote", c.RemoteAddr())}, err)...)
+	}
+	return err
+}
+
+// LocalAddr returns the local network address, nil if it is not known.
+func (c *UDPConn) LocalAddr() net.Addr {
+	sa, err := GetSockName(c.fd)
+	if err != nil {
+		return nil
+	}
+	if addr := sockaddrToUDPAddr(sa); addr != nil {
+		return addr
+	}
+	return nil
+}
+
+// RemoteAddr returns the peer of Write, nil while there is none.
+func (c *UDPConn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.remoteAddr == nil {
+		return nil
+	}
+	return c.remoteAddr
+}
+
+// SetDeadline sets the read and write deadlines associated with the connection.
+// not implementation.
+func (c *UDPConn) SetDeadline(time.Time) error {
+	return nil
+}
+
+// SetReadDeadline sets the read deadline on the connection.
+// not implementation.
+func (c *UDPConn) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+// SetWriteDeadline sets the write deadline on the connection.
+// not implementation.
+func (c *UDPConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+// sockaddrToUDPAddr converts an IPv4 or IPv6 sockaddr, or returns nil.
+func sockaddrToUDPAddr(sa syscall.Sockaddr) *net.UDPAddr {
+	if addr := sockaddrToTCPAddr(sa); addr != nil {
+		return &net.UDPAddr{IP: addr.IP, Port: addr.Port}
+	}
+	return nil
+}
+
+func udpAddrToSockaddr(addr net.Addr) (syscall.Sockaddr, error) {
+	a, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return nil, &net.AddrError{Err: "not a UDP address", Addr: addr.String()}
+	}
+	if ip4 := a.IP.To4(); ip4 != nil {
+		sa := &syscall.SockaddrInet4{Port: a.Port}
+		copy(sa.Addr[:], ip4)
+		return sa, nil
+	}
+	sa := &syscall.SockaddrInet6{Port: a.Port}
+	copy(sa.Addr[:], a.IP.To16())
+	return sa, nil
+}